@@ -1,323 +1,7924 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
+	"image"
+	_ "image/gif" // Decoded by the convert step
+	"image/jpeg"
+	"image/png"
 	"io"
 	"io/ioutil"
-	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	httppprof "net/http/pprof" // Served by the hidden --pprof flag
 	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const version = "1.7" // Current version
 
+const releasesURL = "https://api.github.com/repos/SegoCode/4cget/releases/latest"
+
+const historyFile = ".4cget/history.jsonl"   // Dedupe index, relative to the archive root
+const historyLock = ".4cget/history.lock"    // Held while a process writes to the dedupe index
+const blocklistFile = ".4cget/blocklist.txt" // Default blocklist, relative to the archive root
+const addedLogDir = ".4cget/added"           // Output of the threads sent to --listen, relative to the archive root
+const quarantineDir = ".quarantine"          // Bad downloads, relative to the archive root
+const skipListFile = ".4cget/skip.txt"       // Threads never to download, relative to the archive root
+const ignoreFile = ".4cgetignore"            // Boards, threads and files never to download, relative to the archive root
+const listenFile = ".4cget/listen.txt"       // Bookmarklet of --listen, with its token, relative to the archive root
+const turnsDir = ".4cget/turns"              // Downloads waiting or running with --max-downloads, relative to the archive root
+const apiSlotsDir = ".4cget/api"             // Time of the next API request to each site, relative to the archive root
+const catalogsDir = ".4cget/catalogs"        // Catalogs read by watch, for the threads it starts, relative to the archive root
+
 var monitorMode bool
+var dedupeMode bool
+var notifyMode bool
+var verboseMode bool
+var history *History
+var turns *downloadTurns // With --max-downloads
+var matrix *matrixRoom   // With --matrix-room
+var blocklist *Blocklist
+var ignores *IgnoreList
+var classifier *Classifier
+var sources *SourceLookup
+var feed *Feed
+var report *Report
+var events *progressEvents // With --progress-json
+var meter = &speedMeter{}
+var bandwidth = &rateLimiter{} // Unlimited unless --limit-rate is given
+var bans = &banGuard{}
+var budget = &retryBudget{}
+var throttle = &hostBackoff{hosts: map[string]*backoffState{}}
+var filterComment *regexp.Regexp
+var excludeComment *regexp.Regexp
+var since time.Time // With --since, files of older posts are skipped
+var archivePerms *permissions
+var xattrMode bool // With --xattr, files get their origin URL and MD5 as extended attributes
+var fsyncMode bool // With --fsync, downloads are flushed to disk before they count as done
+var tempDir string // With --direct-temp-dir, downloads are written there and moved into the archive once complete
+var spoilerMode string
+var groupBy string
+var layout string // "board" or "date"
+var numbered bool
+var verifyMD5 bool
+var chunkThreshold int64 // Files at least this big are downloaded in ranges, when their size is known
+var chunkCount int
+var existingPolicy string              // "skip", "overwrite" or "update"
+var fileNumbers = make(map[string]int) // Sequence number of each file URL, for --numbered
+var mediaHosts map[string]string       // Media host overrides from --media-host
+var archiveRoot string                 // Folder holding the board folders and .4cget
+var fileSteps []processStep            // --post-process chain, run on each downloaded file
+var exitFlush = func() {}              // Writes the profiles and flushes the logs, os.Exit skips deferred calls
 
 // SiteInfo holds the URL pattern, regex for image extraction, and an ID.
+// Sites with a ThreadAPI are read through their JSON API instead of scraping
+// the thread page, which gives access to post text and file metadata.
 type SiteInfo struct {
-	ID    string
-	URL   string
-	ImgRE *regexp.Regexp
+	ID         string
+	URL        string
+	ImgRE      *regexp.Regexp
+	ThreadAPI  string   // Format string taking board and thread
+	Engine     string   // Format of the ThreadAPI responses: "4chan" or "meguca"
+	ThreadsAPI string   // Format string taking board, lists the live threads by page
+	CatalogAPI string   // Format string taking board, lists the live threads with their opening post
+	MediaHosts []string // Hosts serving the files of posts, anything else is never downloaded
+
+	// API etiquette published by the site
+	APIInterval time.Duration // Minimum time between two API requests
+	MinRefresh  time.Duration // Minimum monitor interval for a thread
+}
+
+// Post is a single post of a thread, with its attached files, if any.
+type Post struct {
+	No      int64  `json:"no"`
+	Time    int64  `json:"time"` // Unix timestamp
+	Subject string `json:"subject,omitempty"`
+	Poster
+	Comment     string  `json:"comment,omitempty"`      // Post text as HTML
+	Files       []*File `json:"files,omitempty"`        // In post order, several on sites that allow it
+	FileDeleted bool    `json:"file_deleted,omitempty"` // The post had a file that was removed
+
+	Status *ThreadStatus `json:"status,omitempty"` // Only set on the opening post
+}
+
+// ThreadStatus is the lifecycle state of a thread, as published on its opening post.
+type ThreadStatus struct {
+	Sticky     bool `json:"sticky,omitempty"`
+	Closed     bool `json:"closed,omitempty"`
+	Archived   bool `json:"archived,omitempty"`
+	BumpLimit  bool `json:"bump_limit,omitempty"`  // New replies don't bump the thread anymore
+	ImageLimit bool `json:"image_limit,omitempty"` // No more images can be posted
+}
+
+// Poster is the information a site publishes about the author of a post.
+// Field names follow the 4chan API.
+type Poster struct {
+	Name        string `json:"name,omitempty"`
+	Trip        string `json:"trip,omitempty"`
+	Capcode     string `json:"capcode,omitempty"`
+	ID          string `json:"id,omitempty"` // Per-thread poster ID, on boards that have them
+	Country     string `json:"country,omitempty"`
+	CountryName string `json:"country_name,omitempty"`
+	BoardFlag   string `json:"board_flag,omitempty"`
+	FlagName    string `json:"flag_name,omitempty"`
+}
+
+// File is a media file attached to a post.
+type File struct {
+	URL     string `json:"url"`
+	Name    string `json:"name"`           // Filename to store it under
+	Path    string `json:"path,omitempty"` // Location inside the thread folder, once queued
+	MD5     string `json:"md5,omitempty"`  // Hex MD5, empty if the site doesn't publish it
+	Size    int64  `json:"size,omitempty"` // Size in bytes, 0 if the site doesn't publish it
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	Spoiler bool   `json:"spoiler,omitempty"`
 }
 
 // Initialize the site info map with URL patterns and corresponding regex.
 var siteInfoMap = map[string]SiteInfo{
 	"4chan": {
-		ID:    "4chan",
-		URL:   "https://boards.4chan.org",
-		ImgRE: regexp.MustCompile(`<a[^>]+href="(//i\.4cdn\.org[^"]+)"`),
-	},
-	"twochen": {
-		ID:    "twochen",
-		URL:   "https://sturdychan.help/",
-		ImgRE: regexp.MustCompile(`(https?://[^/]+/assets/images/src/[a-zA-Z0-9]+\.(?:png|jpg))`),
+		ID:         "4chan",
+		URL:        "https://boards.4chan.org",
+		ImgRE:      regexp.MustCompile(`<a[^>]+href="(//i\.4cdn\.org[^"]+)"`),
+		ThreadAPI:  "https://a.4cdn.org/%s/thread/%s.json",
+		Engine:     "4chan",
+		ThreadsAPI: "https://a.4cdn.org/%s/threads.json",
+		CatalogAPI: "https://a.4cdn.org/%s/catalog.json",
+		MediaHosts: []string{"i.4cdn.org", "is2.4chan.org"},
+
+		// https://github.com/4chan/4chan-API: at most one request per second,
+		// threads refreshed at most every 10 seconds, with If-Modified-Since
+		APIInterval: time.Second,
+		MinRefresh:  10 * time.Second,
 	},
+	"twochen": megucaSite("twochen", "https://sturdychan.help/"),
+}
+
+// Matches the files of meguca thread pages.
+var megucaImgRE = regexp.MustCompile(`(https?://[^/]+/assets/images/src/[a-zA-Z0-9]+\.(?:png|jpe?g|gif|webm|mp4))`)
+
+// megucaSite describes a site running the meguca engine at baseURL, which ends
+// with a slash. Its files are served from the same host.
+func megucaSite(id, baseURL string) SiteInfo {
+	host := baseURL
+	if u, err := url.Parse(baseURL); err == nil {
+		host = u.Hostname()
+	}
+	return SiteInfo{
+		ID:         id,
+		URL:        baseURL,
+		ImgRE:      megucaImgRE,
+		ThreadAPI:  baseURL + "json/boards/%s/%s",
+		Engine:     "meguca",
+		MediaHosts: []string{host},
+
+		// meguca publishes no etiquette, follow that of 4chan
+		APIInterval: time.Second,
+		MinRefresh:  10 * time.Second,
+	}
+}
+
+// mediaAllowed reports whether a file URL is on one of the site's media hosts,
+// so banners, captchas and other static assets can't slip into the downloads.
+func (s SiteInfo) mediaAllowed(fileURL string) bool {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return false
+	}
+	for _, host := range s.MediaHosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return true
+		}
+	}
+	return false
 }
 
-// findImages extracts image URLs from the given HTML based on the site specified.
-func findImages(html, siteID string) []string {
+// findImages extracts image URLs from the given HTML stream based on the site specified.
+// The page is scanned one tag or text run at a time, so it never has to be held
+// in memory as a whole.
+func findImages(page io.Reader, siteID string) ([]string, error) {
 	var out []string
 	siteInfo, exists := siteInfoMap[siteID]
 	if !exists {
 		fmt.Printf("No site information found for ID: %s\n", siteID)
-		return out
+		return out, nil
 	}
 
-	matches := siteInfo.ImgRE.FindAllStringSubmatch(html, -1)
-	for _, match := range matches {
-		url := match[1]
-		if siteID == siteInfoMap["4chan"].ID {
-			url = strings.Replace(url, "//i.4cdn.org", "https://i.4cdn.org", 1)
+	err := scanHTML(page, func(token string) {
+		matches := siteInfo.ImgRE.FindAllStringSubmatch(token, -1)
+		for _, match := range matches {
+			url := match[1]
+			if siteID == siteInfoMap["4chan"].ID {
+				url = strings.Replace(url, "//i.4cdn.org", "https://i.4cdn.org", 1)
+			}
+			if !siteInfo.mediaAllowed(url) {
+				continue
+			}
+			out = append(out, url)
 		}
-		out = append(out, url)
-	}
+	})
 
 	uniqueOut := unique(out) // Clear array of duplicates
-	return uniqueOut
+	return uniqueOut, err
 }
 
-// unique removes duplicate strings from a slice.
-func unique(input []string) []string {
-	u := make(map[string]bool)
-	var uniqueList []string
-	for _, val := range input {
-		if _, ok := u[val]; !ok {
-			u[val] = true
-			uniqueList = append(uniqueList, val)
+// scanHTML splits an HTML stream into tags ("<a href=...>") and the text between
+// them, calling fn for each. Quoted attribute values may contain '>'.
+func scanHTML(r io.Reader, fn func(token string)) error {
+	br := bufio.NewReader(r)
+	var token strings.Builder
+	inTag := false
+	var quote, last byte
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			if token.Len() > 0 {
+				fn(token.String())
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case !inTag && c == '<':
+			if token.Len() > 0 {
+				fn(token.String())
+				token.Reset()
+			}
+			inTag = true
+		case inTag && quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case inTag && (c == '"' || c == '\'') && last == '=':
+			quote = c
+		case inTag && c == '>':
+			token.WriteByte(c)
+			fn(token.String())
+			token.Reset()
+			inTag = false
+			continue
+		}
+		token.WriteByte(c)
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			last = c
 		}
 	}
-	return uniqueList
 }
 
-func downloadFile(wg *sync.WaitGroup, url string, fileName string, path string, client *http.Client) {
-	defer wg.Done()
+// siteForHost returns the ID of the supported site served from host, or "" if there is none.
+func siteForHost(host string) string {
+	for _, site := range siteInfoMap {
+		parsedSiteURL, err := url.Parse(site.URL)
+		if err != nil {
+			fmt.Printf("Error parsing site URL %s: %v\n", site.URL, err)
+			continue
+		}
+		if host == parsedSiteURL.Host {
+			return site.ID
+		}
+	}
+	return ""
+}
 
-	resp, err := client.Get(url)
+// loadSnapshot reads a thread saved by another tool or an earlier run: a
+// 4cget metadata.json, a 4chan API thread JSON or a saved thread page. board
+// and thread fill in what the snapshot itself doesn't record.
+func loadSnapshot(path, board, thread string) (*threadMetadata, error) {
+	body, err := ioutil.ReadFile(path)
 	if err != nil {
-		fmt.Println("[!] Error downloading file:", err)
-		return
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == 429 {
-		fmt.Println("[!] Received HTTP 429 Too Many Requests. You are being rate-limited.")
-		fmt.Println("[!] Consider using the --sleep flag to add delays between downloads.")
-		return
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".html" || ext == ".htm" {
+		if board == "" || thread == "" {
+			return nil, errors.New("--board and --thread are required for saved pages")
+		}
+		for _, site := range siteInfoMap {
+			images, err := findImages(bytes.NewReader(body), site.ID)
+			if err != nil || len(images) == 0 {
+				continue
+			}
+			meta := &threadMetadata{Site: site.ID, URL: path, Board: board, Thread: thread}
+			for _, each := range images {
+				parts := strings.Split(each, "/")
+				meta.Posts = append(meta.Posts, Post{Files: []*File{{URL: each, Name: parts[len(parts)-1]}}})
+			}
+			return meta, nil
+		}
+		return nil, errors.New("no media from a supported site found in the page")
 	}
 
-	if resp.StatusCode != 404 && resp.StatusCode == 200 {
-		filePath := path + "/" + fileName
-		if _, err := os.Stat(filePath); os.IsNotExist(err) || !monitorMode {
-			img, err := os.Create(filePath)
-			if err != nil {
-				fmt.Println("[!] Error creating file:", err)
-				return
+	// A metadata.json records where it came from
+	var meta threadMetadata
+	if err := json.Unmarshal(body, &meta); err == nil && meta.Board != "" && meta.Thread != "" {
+		if meta.Site == "" {
+			if u, err := url.Parse(meta.URL); err == nil {
+				meta.Site = siteForHost(u.Host)
 			}
-			defer img.Close()
+		}
+		return &meta, nil
+	}
 
-			b, err := io.Copy(img, resp.Body)
-			if err != nil {
-				fmt.Println("[!] Error copying response body:", err)
-				return
-			}
+	// Otherwise it must be a raw 4chan API thread
+	if board == "" {
+		return nil, errors.New("--board is required for API thread snapshots")
+	}
+	posts, err := parse4chanThread(body, board)
+	if err != nil {
+		return nil, err
+	}
+	if len(posts) == 0 {
+		return nil, errors.New("the snapshot has no posts")
+	}
+	if thread == "" {
+		thread = fmt.Sprint(posts[0].No)
+	}
+	return &threadMetadata{
+		Site:   "4chan",
+		URL:    fmt.Sprintf("%s/%s/thread/%s", siteInfoMap["4chan"].URL, board, thread),
+		Board:  board,
+		Thread: thread,
+		Posts:  posts,
+	}, nil
+}
 
-			suffixes := []string{"B", "KB", "MB", "GB", "TB"}
+// fetchAttempts is how many times a thread is requested on network and server
+// errors before giving up on it.
+const fetchAttempts = 5
+
+// fetchPosts reads the posts of a thread, retrying with the backoff shared with
+// the downloads when the site can't be reached or answers with a server error.
+func fetchPosts(client *http.Client, site SiteInfo, inputUrl, board, thread string) ([]Post, error) {
+	host := urlHost(inputUrl)
+	if site.ThreadAPI != "" {
+		host = urlHost(fmt.Sprintf(site.ThreadAPI, board, thread))
+	}
+	for attempt := 1; ; attempt++ {
+		throttle.Wait(host)
+		posts, err := fetchThreadPosts(client, site, inputUrl, board, thread)
+		var status *httpError
+		if errors.As(err, &status) && throttled(status.Status) {
+			throttle.Fail(host, "")
+		} else if err == nil {
+			throttle.Succeed(host)
+		}
+		if err == nil || !transient(err) {
+			return posts, err
+		}
+		if attempt == fetchAttempts {
+			return nil, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		delay := time.Second << (attempt - 1)
+		fmt.Printf("[!] Error fetching the thread, retrying in %s: %v\n", delay, err)
+		time.Sleep(delay)
+	}
+}
 
-			base := math.Log(float64(b)) / math.Log(1024)
-			getSize := math.Pow(1024, base-math.Floor(base))
-			getSuffix := suffixes[int(math.Floor(base))]
+// connectionErrors are the errors of a connection refused, reset or aborted,
+// with those of Windows sockets, which aren't the syscall ones there.
+var connectionErrors = []error{syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ECONNABORTED,
+	syscall.Errno(10061), syscall.Errno(10054), syscall.Errno(10053)}
 
-			fmt.Printf("File downloaded: %s - Size: %.2f %s\n", fileName, getSize, getSuffix)
+// transient reports whether a request failed in a way worth retrying: it timed
+// out, the connection was refused or broke off, or the server answered with an
+// error of its own. Certificate, proxy and URL errors fail the same way again.
+func transient(err error) bool {
+	var status *httpError
+	if errors.As(err, &status) {
+		return status.Status == 429 || status.Status >= 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, connErr := range connectionErrors {
+		if errors.Is(err, connErr) {
+			return true
 		}
-	} else {
-		fmt.Printf("[!] Received HTTP %d for %s\n", resp.StatusCode, url)
 	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
 }
 
-// checkForUpdates checks the latest release from GitHub and compares it with the current version.
-func checkForUpdates() (latestVersion string, updateAvailable bool) {
-	apiURL := "https://api.github.com/repos/SegoCode/4cget/releases/latest"
-	resp, err := http.Get(apiURL)
-	if err != nil {
-		fmt.Println("[!] Error checking for updates:", err)
-		return "", false
+// fetchThreadPosts reads the posts of a thread, through the site's API when it
+// has one or by scraping image links from the thread page otherwise.
+func fetchThreadPosts(client *http.Client, site SiteInfo, inputUrl, board, thread string) ([]Post, error) {
+	if site.ThreadAPI == "" {
+		resp, err := openPage(client, inputUrl)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		// Keep the start of the page to explain an empty result
+		page := bufio.NewReaderSize(resp.Body, 8192)
+		head, _ := page.Peek(8192)
+		head = append([]byte(nil), head...)
+		images, err := findImages(page, site.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(images) == 0 {
+			// Pages always have markup, and may mention captchas in their post form
+			if diagnostic := blockDiagnostic(resp.StatusCode, head, false); diagnostic != "" {
+				fmt.Println("[!] Warning: no files found,", diagnostic)
+			}
+		}
+		var posts []Post
+		for _, each := range images {
+			parts := strings.Split(each, "/")
+			posts = append(posts, Post{Files: []*File{{URL: each, Name: parts[len(parts)-1]}}})
+		}
+		return posts, nil
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		fmt.Printf("[!] GitHub API returned status code %d\n", resp.StatusCode)
-		return "", false
+	body, err := fetchAPI(client, site, fmt.Sprintf(site.ThreadAPI, board, thread))
+	if err != nil {
+		return nil, err
+	}
+	posts, err := parseThread(site, body, board)
+	if err != nil {
+		if diagnostic := blockDiagnostic(200, body, true); diagnostic != "" {
+			return nil, &failure{Category: "site", Err: errors.New(diagnostic)}
+		}
 	}
+	return posts, err
+}
 
-	var release struct {
-		TagName string `json:"tag_name"`
+// blockDiagnostic recognizes the block pages, captchas and ban notices sites
+// serve instead of a thread, and says what to do about them. It returns "" for
+// anything else. With expectJSON, any web page is suspicious. In verbose mode
+// the start of the page is included.
+func blockDiagnostic(status int, body []byte, expectJSON bool) string {
+	page := strings.ToLower(string(body))
+	isHTML := strings.Contains(page, "<html") || strings.Contains(page, "<!doctype html")
+	var diagnostic string
+	switch {
+	case strings.Contains(page, "cf-chl") || strings.Contains(page, "challenge-platform") || strings.Contains(page, "just a moment") || (expectJSON && strings.Contains(page, "captcha")):
+		diagnostic = "the site answered with a captcha or browser check instead of the thread. Open the thread in a browser from this machine, wait a while, or use --proxy or --pass-id"
+	case strings.Contains(page, "you are banned") || strings.Contains(page, "you have been banned") || strings.Contains(page, "not available in your country"):
+		diagnostic = "the site says this connection is banned or region blocked. Check in a browser, or use --proxy"
+	case status == 403:
+		diagnostic = "access denied (HTTP 403): this IP may be blocked or rate-limited. Wait a while, or use --proxy"
+	case expectJSON && isHTML && status == 200:
+		diagnostic = "the site answered with a web page instead of the thread, maybe a block or error page. Open the URL in a browser to see it"
+	default:
+		return ""
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
-		fmt.Println("[!] Error decoding GitHub API response:", err)
-		return "", false
+	if verboseMode && len(body) > 0 {
+		start := body
+		if len(start) > 300 {
+			start = start[:300]
+		}
+		diagnostic += fmt.Sprintf("\n[!] Start of the page: %q", start)
 	}
+	return diagnostic
+}
 
-	latestVersion = strings.TrimPrefix(release.TagName, "v")
-	if latestVersion != version {
-		return latestVersion, true
+// httpError is a response with an unexpected status. Diagnostic explains the
+// block pages recognized by blockDiagnostic.
+type httpError struct {
+	Status     int
+	URL        string
+	Diagnostic string
+}
+
+func (e *httpError) Error() string {
+	if e.Diagnostic != "" {
+		return fmt.Sprintf("received HTTP %d for %s: %s", e.Status, e.URL, e.Diagnostic)
 	}
-	return latestVersion, false
+	return fmt.Sprintf("received HTTP %d for %s", e.Status, e.URL)
 }
 
-// displayHelp shows the help message with explanations and examples.
-func displayHelp() {
-	fmt.Println(`
-4cget - A tool to download images from 4chan threads.
+// failure is an error with the kind of problem it is, "network", "site",
+// "rate-limit" or "filesystem", and what to do about it.
+type failure struct {
+	Category string
+	Hint     string
+	Err      error
+}
 
-Usage:
-  4cget [options] <thread_url>
+func (f *failure) Error() string { return f.Err.Error() }
+func (f *failure) Unwrap() error { return f.Err }
 
-Options:
-  --help                 Display this help message.
-  --monitor <seconds>    Enable monitor mode with interval in seconds.
-                         The program will check for new images every specified interval.
-  --sleep <seconds>      Sleep duration in seconds between downloads.
-                         Useful to avoid getting rate-limited by the server.
-  --proxy <proxy_url>    Proxy URL (e.g., http://proxyserver:port).
-  --proxyuser <user>     Proxy username for authentication.
-  --proxypass <pass>     Proxy password for authentication.
+// classify tells what kind of problem err is. Errors it doesn't recognize get
+// no category nor hint.
+func classify(err error) *failure {
+	var f *failure
+	if errors.As(err, &f) {
+		return f
+	}
+	var status *httpError
+	var netErr net.Error
+	var pathErr *os.PathError
+	var linkErr *os.LinkError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &status) && status.Status == http.StatusTooManyRequests:
+		return &failure{"rate-limit", "The site is rate-limiting this connection. Wait a while, and add delays with --sleep or a longer --monitor interval.", err}
+	case errors.As(err, &status) && status.Diagnostic != "":
+		return &failure{"site", "", err} // The diagnostic says what to do already
+	case errors.As(err, &status) && (status.Status == http.StatusForbidden || status.Status == http.StatusUnauthorized):
+		return &failure{"blocked", "The site is refusing this connection, which usually means the IP is banned or blocked. Try again through --proxy.", err}
+	case errors.As(err, &status) && (status.Status == http.StatusNotFound || status.Status == http.StatusGone):
+		return &failure{"site", "The thread was pruned or deleted, or the URL is wrong. Check it in a browser, or look for the thread in an archive.", err}
+	case errors.As(err, &status) && status.Status >= 500:
+		return &failure{"site", "The site is having problems. Try again later.", err}
+	case errors.As(err, &status):
+		return &failure{"site", "", err}
+	case errors.As(err, &netErr):
+		return &failure{"network", "Check the connection, and the --proxy, --resolver, --doh and TLS options if set.", err}
+	case errors.As(err, &pathErr), errors.As(err, &linkErr):
+		return &failure{"filesystem", "Check that the folder exists, is writable and has free space.", err}
+	case errors.Is(err, errEmptyResponse):
+		return &failure{"site", "The media host is having problems. Run 4cget again later to download the file.", err}
+	case errors.As(err, &syntaxErr):
+		return &failure{"site", "The site answered with something that isn't a thread. Open the URL in a browser to see it.", err}
+	}
+	return &failure{Err: err}
+}
 
-Examples:
+// printError shows an error as "[!] msg: err", followed by a hint when its
+// kind is known.
+func printError(msg string, err error) {
+	f := classify(err)
+	fmt.Printf("[!] %s: %v\n", msg, f.Err)
+	if f.Hint != "" {
+		fmt.Printf("[!] Hint (%s): %s\n", f.Category, f.Hint)
+	}
+}
 
-  Basic usage:
-    4cget https://boards.4chan.org/w/thread/123456
+// printFile shows a line about a single file. Monitor mode prints them with
+// --verbose only, its checks being summed up in one line each.
+func printFile(format string, a ...interface{}) {
+	if !monitorMode || verboseMode {
+		fmt.Printf(format, a...)
+	}
+}
 
-  Enable monitor mode with a 60-second interval:
-    4cget --monitor 60 https://boards.4chan.org/w/thread/123456
+// fail shows an error like printError and exits with status 1.
+func fail(msg string, err error) {
+	failWith(1, msg, err)
+}
 
-  Use a proxy with authentication:
-    4cget --proxy http://proxyserver:port --proxyuser username --proxypass password https://boards.4chan.org/w/thread/123456
+// failWith shows an error like printError and exits with status code.
+func failWith(code int, msg string, err error) {
+	printError(msg, err)
+	exitFlush()
+	os.Exit(code)
+}
 
-  Add delay between downloads to prevent rate-limiting:
-    4cget --sleep 2 https://boards.4chan.org/w/thread/123456
+// Exit statuses for a thread that can't be fetched, so scripts can tell a
+// thread that is gone from a site that is blocking or failing.
+const (
+	exitDeleted = 2 // The thread was deleted or pruned: HTTP 404 or 410
+	exitBlocked = 3 // The site refuses the connection: HTTP 401 or 403
+	exitServer  = 4 // The site kept failing or couldn't be reached
+	exitAborted = 5 // Downloads kept failing past --max-failures or --max-failure-rate
+)
 
-Note:
-  - Ensure that all flags are prefixed with '--'.
-  - The thread URL must be a valid URL from a supported site.
-  - Use '--sleep' to add delays between downloads to avoid getting rate-limited (HTTP 429 errors).
-`)
+// fetchExitCode is the exit status for a thread that couldn't be fetched.
+func fetchExitCode(err error) int {
+	var status *httpError
+	switch {
+	case errors.As(err, &status) && (status.Status == http.StatusNotFound || status.Status == http.StatusGone):
+		return exitDeleted
+	case errors.As(err, &status) && (status.Status == http.StatusForbidden || status.Status == http.StatusUnauthorized):
+		return exitBlocked
+	case transient(err):
+		return exitServer
+	}
+	return 1
 }
 
-func main() {
-	var wg sync.WaitGroup
-	var inputUrl string
-	var thread string
-	var siteID string
+// apiState tracks API requests per site and the last response per URL, so
+// requests can be spaced out and unchanged threads aren't downloaded again.
+var apiState = struct {
+	sync.Mutex
+	next     map[string]time.Time // Earliest time of the next request, by site ID
+	cache    map[string]apiResponse
+	inflight map[string]*apiCall
+}{next: make(map[string]time.Time), cache: make(map[string]apiResponse), inflight: make(map[string]*apiCall)}
 
-	// Define command-line flags
-	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-	helpFlag := fs.Bool("help", false, "Display this help message")
-	monitorIntervalFlag := fs.Int("monitor", 0, "Enable monitor mode with interval in seconds")
-	sleepFlag := fs.Int("sleep", 0, "Sleep duration in seconds between downloads")
-	proxyFlag := fs.String("proxy", "", "Proxy URL (e.g., http://proxyserver:port)")
-	proxyUserFlag := fs.String("proxyuser", "", "Proxy username")
-	proxyPassFlag := fs.String("proxypass", "", "Proxy password")
+// apiCall is an API request in progress, whose response goes to every caller
+// asking for the same URL meanwhile.
+type apiCall struct {
+	done chan struct{}
+	body []byte
+	err  error
+}
 
-	// Manually parse flags and positional arguments
-	var args []string
-	for i := 1; i < len(os.Args); i++ {
-		arg := os.Args[i]
-		if arg == "--" {
-			// All remaining args are positional
-			args = append(args, os.Args[i+1:]...)
-			break
-		}
-		if strings.HasPrefix(arg, "--") {
-			// Flag
-			fs.Parse(os.Args[i:])
-			break
-		}
-		if strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") {
-			fmt.Printf("Invalid flag: %s. Flags must start with '--'.\n", arg)
-			os.Exit(1)
-		}
-		// Positional argument
-		args = append(args, arg)
-	}
+// apiResponse is the last successful response of an API URL.
+type apiResponse struct {
+	LastModified string    `json:"last_modified,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+	Body         []byte    `json:"body"`
+}
 
-	// After parsing flags, any remaining arguments are positional
-	args = append(args, fs.Args()...)
+const cacheDir = ".4cget/cache" // Responses kept with --cache-ttl, relative to the archive root
 
-	// If --help is provided, display help message and exit
-	if *helpFlag {
-		displayHelp()
-		return
+var cacheTTL time.Duration // With --cache-ttl, API responses are kept on disk and reused for this long
+
+// cachePath is where the response of an API URL is kept on disk.
+func cachePath(apiURL string) string {
+	sum := sha256.Sum256([]byte(apiURL))
+	return filepath.Join(archiveRoot, cacheDir, hex.EncodeToString(sum[:8])+".json")
+}
+
+// loadCachedResponse reads the response of an API URL kept by an earlier run.
+func loadCachedResponse(apiURL string) (apiResponse, bool) {
+	var cached apiResponse
+	data, err := ioutil.ReadFile(cachePath(apiURL))
+	if err != nil || json.Unmarshal(data, &cached) != nil {
+		return cached, false
 	}
+	return cached, true
+}
 
-	// Input URL validation
-	if len(args) < 1 {
-		fmt.Println("[!] USAGE: 4cget [options] <thread_url>")
-		fmt.Println("Use '--help' to see available options.")
-		os.Exit(1)
+// saveCachedResponse keeps the response of an API URL for later runs.
+func saveCachedResponse(apiURL string, r apiResponse) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return
 	}
-	inputUrl = args[0]
+	os.MkdirAll(filepath.Join(archiveRoot, cacheDir), os.ModePerm)
+	ioutil.WriteFile(cachePath(apiURL), data, 0644)
+}
 
-	monitorMode = (*monitorIntervalFlag > 0)
-	secondsIteration := *monitorIntervalFlag
-	sleepDuration := *sleepFlag
-	proxyURL := *proxyFlag
+// apiSlotLockWait is how long to wait for another process booking an API request.
+const apiSlotLockWait = 5 * time.Second
 
-	parsedURL, errParse := url.ParseRequestURI(inputUrl)
-	if errParse != nil {
-		fmt.Println("[!] URL NOT VALID (Example: https://boards.4channel.org/w/thread/.../...)")
-		os.Exit(1)
+// reserveAPISlot books the first API request to a site at or after at, in
+// apiSlotsDir, and returns its time. Every 4cget archiving to the same folder,
+// such as the threads of 'watch', books its requests there, so together they
+// follow the etiquette of the site. Without the folder, at is kept.
+func reserveAPISlot(site SiteInfo, at time.Time) time.Time {
+	if site.APIInterval <= 0 || archiveRoot == "" {
+		return at
 	}
-
-	for _, site := range siteInfoMap {
-		parsedSiteURL, err := url.Parse(site.URL)
-		if err != nil {
-			fmt.Printf("Error parsing site URL %s: %v\n", site.URL, err)
-			continue
-		}
-		if parsedURL.Host == parsedSiteURL.Host {
-			siteID = site.ID
-			break
+	dir := filepath.Join(archiveRoot, apiSlotsDir)
+	if os.MkdirAll(dir, os.ModePerm) != nil {
+		return at
+	}
+	path := filepath.Join(dir, site.ID)
+	unlock, err := lockFile(path+".lock", apiSlotLockWait)
+	if err != nil {
+		return at
+	}
+	defer unlock()
+	if data, err := ioutil.ReadFile(path); err == nil {
+		// A slot far ahead was written with a clock set wrong
+		next, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+		if err == nil && next.After(at) && next.Before(time.Now().Add(time.Hour)) {
+			at = next
 		}
 	}
+	ioutil.WriteFile(path, []byte(at.Add(site.APIInterval).Format(time.RFC3339Nano)+"\n"), 0644)
+	return at
+}
 
-	if siteID == "" {
-		fmt.Println("[!] Unsupported site")
-		os.Exit(1)
+// fetchAPI requests an API URL following the site's etiquette: requests are
+// spaced by APIInterval, across the processes sharing the archive too, and
+// sent with If-Modified-Since, reusing the previous body when the server
+// answers 304 Not Modified. With --cache-ttl, responses are kept on disk, and
+// the first request of a run for a URL is answered from there while the
+// response is fresh enough. Callers asking for a URL already being requested
+// get the same response, without a request of their own.
+func fetchAPI(client *http.Client, site SiteInfo, apiURL string) ([]byte, error) {
+	apiState.Lock()
+	if call, inFlight := apiState.inflight[apiURL]; inFlight {
+		apiState.Unlock()
+		<-call.done
+		return call.body, call.err
 	}
+	call := &apiCall{done: make(chan struct{})}
+	apiState.inflight[apiURL] = call
+	apiState.Unlock()
 
-	fmt.Println(`
-░░██╗██╗░█████╗░░██████╗░███████╗████████╗
-░██╔╝██║██╔══██╗██╔════╝░██╔════╝╚══██╔══╝
-██╔╝░██║██║░░╚═╝██║░░██╗░█████╗░░░░░██║░░░
-███████║██║░░██╗██║░░╚██╗██╔══╝░░░░░██║░░░
-╚════██║╚█████╔╝╚██████╔╝███████╗░░░██║░░░
-░░░░░╚═╝░╚════╝░░╚═════╝░╚══════╝░░░╚═╝░░░
-                    [ github.com/SegoCode ]` + "\n")
+	call.body, call.err = requestAPI(client, site, apiURL)
+	apiState.Lock()
+	delete(apiState.inflight, apiURL)
+	apiState.Unlock()
+	close(call.done)
+	return call.body, call.err
+}
 
-	// Check for updates before starting the download
-	latestVersion, updateAvailable := checkForUpdates()
-	if updateAvailable {
-		fmt.Printf("[*] UPDATE AVAILABLE %s [*]\n\n", latestVersion)
+// requestAPI makes the request of fetchAPI.
+func requestAPI(client *http.Client, site SiteInfo, apiURL string) ([]byte, error) {
+	apiState.Lock()
+	if _, inMemory := apiState.cache[apiURL]; !inMemory && cacheTTL > 0 {
+		if cached, ok := loadCachedResponse(apiURL); ok {
+			apiState.cache[apiURL] = cached
+			if time.Since(cached.Fetched) < cacheTTL {
+				apiState.Unlock()
+				return cached.Body, nil
+			}
+		}
 	}
-
-	fmt.Println("[*] DOWNLOAD STARTED (" + inputUrl + ") [*]\n")
-	if monitorMode {
-		fmt.Println("[*] MONITOR MODE ENABLED [*]\n")
+	at := time.Now()
+	if next := apiState.next[site.ID]; next.After(at) {
+		at = next
 	}
+	at = reserveAPISlot(site, at)
+	apiState.next[site.ID] = at.Add(site.APIInterval)
+	cached, isCached := apiState.cache[apiURL]
+	apiState.Unlock()
+	time.Sleep(time.Until(at))
 
-	start := time.Now()
-	files := 0
-
-	// Parse board and thread from URL
-	parts := strings.Split(inputUrl, "/")
-	board := parts[3]
+	req, err := http.NewRequest("GET", apiURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if isCached && cached.LastModified != "" {
+		req.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+	if isCached && cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-	// Handle the thread part depending on the site
-	if siteID == siteInfoMap["4chan"].ID {
-		thread = parts[5]
-	} else {
-		thread = parts[4]
+	switch resp.StatusCode {
+	case 304:
+		if cacheTTL > 0 {
+			cached.Fetched = time.Now()
+			saveCachedResponse(apiURL, cached)
+		}
+		return cached.Body, nil
+	case 200:
+	default:
+		head, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 8192))
+		return nil, &httpError{resp.StatusCode, apiURL, blockDiagnostic(resp.StatusCode, head, true)}
 	}
 
-	// Create necessary directories
-	actualPath, _ := os.Getwd()
-	os.MkdirAll(fmt.Sprintf("%s/%s", actualPath, board), os.ModePerm)
-	os.MkdirAll(fmt.Sprintf("%s/%s/%s", actualPath, board, thread), os.ModePerm)
-	pathResult := fmt.Sprintf("%s/%s/%s", actualPath, board, thread)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	fresh := apiResponse{LastModified: resp.Header.Get("Last-Modified"), ETag: resp.Header.Get("ETag"), Fetched: time.Now(), Body: body}
+	apiState.Lock()
+	apiState.cache[apiURL] = fresh
+	apiState.Unlock()
+	if cacheTTL > 0 {
+		saveCachedResponse(apiURL, fresh)
+	}
+	return body, nil
+}
+
+// openPage requests a page and returns the response if it was successful.
+// The caller must close the body.
+func openPage(client *http.Client, pageURL string) (*http.Response, error) {
+	resp, err := client.Get(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		head, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 8192))
+		return nil, &httpError{resp.StatusCode, pageURL, blockDiagnostic(resp.StatusCode, head, false)}
+	}
+	return resp, nil
+}
+
+// fetchBody downloads a page and returns its body.
+func fetchBody(client *http.Client, pageURL string) ([]byte, error) {
+	resp, err := openPage(client, pageURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// parse4chanThread converts a 4chan API thread into posts.
+func parse4chanThread(body []byte, board string) ([]Post, error) {
+	var thread struct {
+		Posts []struct {
+			No       int64  `json:"no"`
+			Time     int64  `json:"time"`
+			Com      string `json:"com"`
+			Tim      int64  `json:"tim"`
+			Filename string `json:"filename"`
+			Ext      string `json:"ext"`
+			MD5      string `json:"md5"`
+			Fsize    int64  `json:"fsize"`
+			W        int    `json:"w"`
+			H        int    `json:"h"`
+			Sub      string `json:"sub"`
+			Poster
+
+			Spoiler     int `json:"spoiler"`
+			FileDeleted int `json:"filedeleted"`
+
+			// Opening post only
+			Sticky     int `json:"sticky"`
+			Closed     int `json:"closed"`
+			Archived   int `json:"archived"`
+			BumpLimit  int `json:"bumplimit"`
+			ImageLimit int `json:"imagelimit"`
+		} `json:"posts"`
+	}
+	if err := json.Unmarshal(body, &thread); err != nil {
+		return nil, err
+	}
+
+	var posts []Post
+	for i, p := range thread.Posts {
+		post := Post{No: p.No, Time: p.Time, Subject: p.Sub, Poster: p.Poster, Comment: p.Com, FileDeleted: p.FileDeleted == 1}
+		if i == 0 {
+			post.Status = &ThreadStatus{
+				Sticky:     p.Sticky == 1,
+				Closed:     p.Closed == 1,
+				Archived:   p.Archived == 1,
+				BumpLimit:  p.BumpLimit == 1,
+				ImageLimit: p.ImageLimit == 1,
+			}
+		}
+		if (p.Tim != 0 || (board == "f" && p.Filename != "")) && !post.FileDeleted {
+			name := fmt.Sprintf("%d%s", p.Tim, p.Ext)
+			fileURL := fmt.Sprintf("https://i.4cdn.org/%s/%s", board, name)
+			if board == "f" {
+				// Flash files keep the uploader's filename, which is also their URL
+				original := html.UnescapeString(p.Filename) + p.Ext
+				fileURL = "https://i.4cdn.org/f/" + url.PathEscape(original)
+				name = safeName(original)
+			}
+			sum, _ := normalizeMD5(p.MD5)
+			post.Files = []*File{{
+				URL:     fileURL,
+				Name:    name,
+				MD5:     sum,
+				Size:    p.Fsize,
+				Width:   p.W,
+				Height:  p.H,
+				Spoiler: p.Spoiler == 1,
+			}}
+		}
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+// parseThread converts a ThreadAPI response of site into posts.
+func parseThread(site SiteInfo, body []byte, board string) ([]Post, error) {
+	if site.Engine == "meguca" {
+		return parseMegucaThread(body, site)
+	}
+	return parse4chanThread(body, board)
+}
+
+// megucaExtensions are the file extensions of the meguca file types, by number.
+var megucaExtensions = []string{"jpg", "png", "gif", "webm", "pdf", "svg", "mp4", "mp3", "ogg", "zip", "7z", "tar.gz", "tar.xz", "flac", "", "txt"}
+
+// megucaPost is a post of the meguca JSON API.
+type megucaPost struct {
+	ID    int64  `json:"id"`
+	Time  int64  `json:"time"`
+	Body  string `json:"body"` // Plain text
+	Name  string `json:"name"`
+	Trip  string `json:"trip"`
+	Image *struct {
+		FileType int    `json:"file_type"`
+		Dims     []int  `json:"dims"` // Width, height and thumbnail width, height
+		Size     int64  `json:"size"`
+		MD5      string `json:"md5"`
+		SHA1     string `json:"sha1"` // Also the name of the file on the server
+		Spoiler  bool   `json:"spoiler"`
+	} `json:"image"`
+}
+
+// parseMegucaThread converts a thread of the meguca JSON API, such as that of
+// sturdychan, into posts. Files are named by their SHA-1 like on the site.
+func parseMegucaThread(body []byte, site SiteInfo) ([]Post, error) {
+	var thread struct {
+		megucaPost
+		Subject string       `json:"subject"`
+		Sticky  bool         `json:"sticky"`
+		Locked  bool         `json:"locked"`
+		Posts   []megucaPost `json:"posts"`
+	}
+	if err := json.Unmarshal(body, &thread); err != nil {
+		return nil, err
+	}
+
+	var posts []Post
+	for i, p := range append([]megucaPost{thread.megucaPost}, thread.Posts...) {
+		comment := strings.ReplaceAll(html.EscapeString(p.Body), "\n", "<br>")
+		post := Post{No: p.ID, Time: p.Time, Poster: Poster{Name: p.Name, Trip: p.Trip}, Comment: comment}
+		if i == 0 {
+			post.Subject = thread.Subject
+			post.Status = &ThreadStatus{Sticky: thread.Sticky, Closed: thread.Locked}
+		}
+		if img := p.Image; img != nil && img.FileType >= 0 && img.FileType < len(megucaExtensions) && megucaExtensions[img.FileType] != "" {
+			name := img.SHA1 + "." + megucaExtensions[img.FileType]
+			sum, _ := normalizeMD5(img.MD5)
+			file := &File{URL: strings.TrimSuffix(site.URL, "/") + "/assets/images/src/" + name, Name: name, MD5: sum, Size: img.Size, Spoiler: img.Spoiler}
+			if len(img.Dims) >= 2 {
+				file.Width, file.Height = img.Dims[0], img.Dims[1]
+			}
+			post.Files = []*File{file}
+		}
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+// Matches <br> tags, which become line breaks in post text.
+var brRE = regexp.MustCompile(`(?i)<br\s*/?>`)
+
+// Matches any other HTML tag.
+var tagRE = regexp.MustCompile(`<[^>]*>`)
+
+// postText converts an HTML post comment to plain text.
+func postText(comment string) string {
+	text := brRE.ReplaceAllString(comment, "\n")
+	text = tagRE.ReplaceAllString(text, "")
+	return html.UnescapeString(text)
+}
+
+// truncateText shortens text to at most n characters, ending it with "..."
+// when it was cut.
+func truncateText(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n-3]) + "..."
+}
+
+// matchesCommentFilters reports whether a post passes --filter-comment and --exclude-comment.
+func matchesCommentFilters(post Post) bool {
+	if filterComment == nil && excludeComment == nil {
+		return true
+	}
+	text := postText(post.Comment)
+	if filterComment != nil && !filterComment.MatchString(text) {
+		return false
+	}
+	if excludeComment != nil && excludeComment.MatchString(text) {
+		return false
+	}
+	return true
+}
+
+// parseSince reads --since: a duration before now (e.g. 2h, or 3d for days), a
+// date or an RFC 3339 timestamp.
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil && strings.HasSuffix(value, "d") {
+		return now.AddDate(0, 0, -days), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, format := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(format, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q (use a duration like 2h or 3d, a date like 2006-01-02 or an RFC 3339 time)", value)
+}
+
+// skipFile reports whether a file is blocked or already archived, when that
+// can be told before downloading it.
+func skipFile(f *File, filePath string) bool {
+	if ignores.IgnoresName(f.Name) {
+		setStatus(f.URL, "ignored", 0, "")
+		return true
+	}
+	if blocklist.BlocksName(f.Name) || blocklist.BlocksMD5(f.MD5) {
+		setStatus(f.URL, "blocked", 0, "")
+		return true
+	}
+	if classifier.Rejects(f.MD5, f.URL) {
+		setStatus(f.URL, "classified", 0, "")
+		return true
+	}
+	if dedupeMode && history != nil && f.MD5 != "" {
+		if dup, found := history.Duplicate(f.MD5, filepath.Clean(filePath)); found {
+			printFile("Duplicate skipped: %s - Already archived at %s\n", f.Name, dup.Path)
+			setStatus(f.URL, "duplicate", 0, "")
+			return true
+		}
+	}
+	return false
+}
+
+// placeFile decides where a file of a post goes inside the thread folder,
+// honoring --group-by and --spoilers.
+func placeFile(post Post, f *File) string {
+	var dir string
+	if groupBy == "poster" && post.ID != "" {
+		dir = safeName(post.ID) + "/"
+	}
+	name := f.Name
+	if numbered {
+		// Numbers are kept across monitor iterations so files never get renamed
+		if _, ok := fileNumbers[f.URL]; !ok {
+			fileNumbers[f.URL] = len(fileNumbers) + 1
+		}
+		name = fmt.Sprintf("%04d_%s", fileNumbers[f.URL], name)
+	}
+	if f.Spoiler {
+		switch spoilerMode {
+		case "prefix":
+			return dir + "spoiler_" + name
+		case "folder":
+			return dir + "spoilers/" + name
+		}
+	}
+	return dir + name
+}
+
+// threadFolder returns the folder of a thread in the archive, following
+// --layout: board/thread by default, or YYYY/MM/DD/board-thread from the time of
+// the opening post (UTC), or of the first archiving when the site doesn't say.
+func threadFolder(root, board, thread string, opTime int64) string {
+	if layout == "date" {
+		t := time.Now()
+		if opTime != 0 {
+			t = time.Unix(opTime, 0)
+		}
+		return filepath.Join(root, t.UTC().Format("2006/01/02"), board+"-"+thread)
+	}
+	return filepath.Join(root, board, thread)
+}
+
+// safeName replaces characters that can't be used in a file or folder name.
+func safeName(name string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", ":", "_", "*", "_", "?", "_", "\"", "_", "<", "_", ">", "_", "|", "_").Replace(name)
+}
+
+// threadMetadata is the metadata export written to metadata.json in the thread folder.
+type threadMetadata struct {
+	Site     string    `json:"site,omitempty"`
+	URL      string    `json:"url"`
+	Board    string    `json:"board"`
+	Thread   string    `json:"thread"`
+	Archived time.Time `json:"archived"`
+	Version  string    `json:"version"`
+	Posts    []Post    `json:"posts"`
+
+	Tombstones []tombstone `json:"tombstones,omitempty"` // With --tombstones
+}
+
+// tombstone records a post or file that was removed from the thread after
+// 4cget saw it. The local copy of the files is kept.
+type tombstone struct {
+	Post    int64     `json:"post"`
+	Files   []string  `json:"files,omitempty"` // Names of the removed files
+	Reason  string    `json:"reason"`          // "post deleted" or "file deleted"
+	Deleted time.Time `json:"deleted"`         // When the removal was noticed
+}
+
+// findDeletions compares two successive reads of a thread and returns a
+// tombstone for every post of prev missing from cur, and for the files removed
+// from posts that are still there. Posts without a number, as scraped from
+// sites without an API, can't be followed.
+func findDeletions(prev, cur []Post, now time.Time) []tombstone {
+	current := make(map[int64]Post)
+	for _, post := range cur {
+		current[post.No] = post
+	}
+	var found []tombstone
+	for _, post := range prev {
+		if post.No == 0 {
+			continue
+		}
+		after, ok := current[post.No]
+		if !ok {
+			t := tombstone{Post: post.No, Reason: "post deleted", Deleted: now}
+			for _, f := range post.Files {
+				t.Files = append(t.Files, f.Name)
+			}
+			found = append(found, t)
+			continue
+		}
+		kept := make(map[string]bool)
+		for _, f := range after.Files {
+			kept[f.Name] = true
+		}
+		var removed []string
+		for _, f := range post.Files {
+			if !kept[f.Name] {
+				removed = append(removed, f.Name)
+			}
+		}
+		if len(removed) > 0 {
+			found = append(found, tombstone{Post: post.No, Files: removed, Reason: "file deleted", Deleted: now})
+		}
+	}
+	return found
+}
+
+// writeMetadata saves the thread metadata export, replacing any previous one.
+func writeMetadata(path string, meta threadMetadata) error {
+	var buf strings.Builder
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // Keep post HTML readable
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(meta); err != nil {
+		return err
+	}
+	tmp := path + "/metadata.json.tmp"
+	if err := ioutil.WriteFile(tmp, []byte(buf.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path+"/metadata.json")
+}
+
+// String formats the poster the way a thread page shows them.
+func (p Poster) String() string {
+	label := p.Name
+	if label == "" {
+		label = "Anonymous"
+	}
+	if p.Trip != "" {
+		label += " " + p.Trip
+	}
+	if p.Capcode != "" {
+		label += " ## " + strings.ToUpper(p.Capcode[:1]) + p.Capcode[1:]
+	}
+	if p.ID != "" {
+		label += " (ID: " + p.ID + ")"
+	}
+	if p.CountryName != "" {
+		label += " [" + p.CountryName + "]"
+	} else if p.FlagName != "" {
+		label += " [" + p.FlagName + "]"
+	}
+	return label
+}
+
+// writeExports writes the thread in each of the requested formats ("markdown", "html").
+func writeExports(path string, meta threadMetadata, formats []string) error {
+	for _, format := range formats {
+		var err error
+		switch format {
+		case "markdown":
+			err = ioutil.WriteFile(path+"/thread.md", []byte(threadMarkdown(meta)), 0644)
+		case "html":
+			err = ioutil.WriteFile(path+"/thread.html", []byte(threadHTML(meta)), 0644)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// threadInfo is the info.json written to every thread folder, so folders
+// still say what they hold years later.
+type threadInfo struct {
+	URL           string     `json:"url"`
+	Site          string     `json:"site,omitempty"`
+	Board         string     `json:"board"`
+	Thread        string     `json:"thread"`
+	Subject       string     `json:"subject,omitempty"`
+	OP            string     `json:"op,omitempty"` // Text of the opening post
+	Posted        *time.Time `json:"posted,omitempty"`
+	FirstArchived time.Time  `json:"first_archived"`
+	Archived      time.Time  `json:"archived"` // Latest update of the folder
+	Version       string     `json:"version"`
+}
+
+// writeThreadInfo writes README.txt and info.json to the thread folder,
+// keeping the time of the first archival from an earlier info.json.
+func writeThreadInfo(path string, meta threadMetadata) error {
+	info := threadInfo{URL: meta.URL, Site: meta.Site, Board: meta.Board, Thread: meta.Thread,
+		FirstArchived: meta.Archived, Archived: meta.Archived, Version: meta.Version}
+	if len(meta.Posts) > 0 && meta.Posts[0].Time != 0 {
+		op := meta.Posts[0]
+		info.Subject = html.UnescapeString(op.Subject)
+		info.OP = strings.TrimSpace(postText(op.Comment))
+		posted := time.Unix(op.Time, 0).UTC()
+		info.Posted = &posted
+	}
+	var previous threadInfo
+	if data, err := readSidecar(path + "/info.json"); err == nil && json.Unmarshal(data, &previous) == nil && !previous.FirstArchived.IsZero() {
+		info.FirstArchived = previous.FirstArchived
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+"/info.json", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "/%s/%s - %s\n%s\n", meta.Board, meta.Thread, threadTitle(meta), meta.URL)
+	if info.OP != "" {
+		fmt.Fprintf(&b, "\n%s\n", info.OP)
+	}
+	b.WriteString("\n")
+	if info.Posted != nil {
+		fmt.Fprintf(&b, "Posted:         %s\n", info.Posted.Format(time.RFC1123))
+	}
+	fmt.Fprintf(&b, "First archived: %s\n", info.FirstArchived.UTC().Format(time.RFC1123))
+	fmt.Fprintf(&b, "Last updated:   %s by 4cget %s\n", info.Archived.UTC().Format(time.RFC1123), info.Version)
+	return ioutil.WriteFile(path+"/README.txt", []byte(b.String()), 0644)
+}
+
+// refreshMetadata reads again the threads archived under dirs, the folders
+// holding a metadata.json, and updates their text without downloading any
+// file. It returns the number of threads refreshed and of those that failed;
+// threads deleted from the site since are neither.
+func refreshMetadata(client *http.Client, dirs, formats []string, tombstones bool) (refreshed, failed int) {
+	var folders []string
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		dir, _ = filepath.Abs(dir)
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			switch {
+			case err != nil:
+				fmt.Println("[!] Error reading", path+":", err)
+			case info.IsDir() && path != dir && strings.HasPrefix(info.Name(), "."):
+				return filepath.SkipDir // 4cget's own state and other hidden folders
+			case info.Name() == "metadata.json" || info.Name() == "metadata.json"+encryptedSuffix:
+				if folder := filepath.Dir(path); !seen[folder] {
+					seen[folder] = true
+					folders = append(folders, folder)
+				}
+			}
+			return nil
+		})
+	}
+
+	for _, folder := range folders {
+		result, err := refreshThread(client, folder, formats, tombstones)
+		if err != nil && fetchExitCode(err) == exitDeleted {
+			// The archive is all that is left of the thread, as it was last seen
+			fmt.Printf("Gone: %s - deleted from the site, nothing to do\n", folder)
+			continue
+		}
+		if err != nil {
+			printError("Error refreshing "+folder, err)
+			failed++
+			continue
+		}
+		fmt.Printf("Refreshed: %s - %s\n", folder, result)
+		refreshed++
+	}
+	return refreshed, failed
+}
+
+// refreshThread updates the text of an archived thread from the site: its
+// metadata.json, info.json and README.txt, the exports it has or formats asks
+// for, and SHA256SUMS when it has one. Earlier tombstones are kept, and new ones
+// recorded with tombstones. Threads archived by the site can't change anymore
+// and are left as they are.
+func refreshThread(client *http.Client, folder string, formats []string, tombstones bool) (string, error) {
+	var meta threadMetadata
+	data, err := readSidecar(filepath.Join(folder, "metadata.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &meta)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(meta.Posts) > 0 && meta.Posts[0].Status != nil && meta.Posts[0].Status.Archived {
+		return "archived by the site, nothing to do", nil
+	}
+	siteID := meta.Site
+	if siteID == "" {
+		siteID = siteForHost(urlHost(meta.URL))
+	}
+	site, ok := siteInfoMap[siteID]
+	if !ok {
+		return "", fmt.Errorf("unsupported site for %s", meta.URL)
+	}
+	posts, err := fetchPosts(client, site, meta.URL, meta.Board, meta.Thread)
+	if err != nil {
+		return "", err
+	}
+
+	var newest int64
+	for _, post := range meta.Posts {
+		if post.No > newest {
+			newest = post.No
+		}
+	}
+	added := 0
+	for _, post := range posts {
+		if post.No > newest {
+			added++
+		}
+	}
+	found := 0
+	if tombstones {
+		deleted := findDeletions(meta.Posts, posts, time.Now())
+		meta.Tombstones = append(meta.Tombstones, deleted...)
+		found = len(deleted)
+	}
+	meta.Site, meta.Posts, meta.Archived, meta.Version = siteID, posts, time.Now(), version
+
+	has := func(name string) bool {
+		_, err := os.Stat(filepath.Join(folder, name))
+		if os.IsNotExist(err) {
+			_, err = os.Stat(filepath.Join(folder, name+encryptedSuffix))
+		}
+		return err == nil
+	}
+	exports := append([]string(nil), formats...)
+	asked := make(map[string]bool)
+	for _, format := range formats {
+		asked[format] = true
+	}
+	for format, name := range map[string]string{"markdown": "thread.md", "html": "thread.html"} {
+		if has(name) && !asked[format] {
+			exports = append(exports, format)
+		}
+	}
+	if err := writeMetadata(folder, meta); err != nil {
+		return "", err
+	}
+	if err := writeExports(folder, meta, exports); err != nil {
+		return "", err
+	}
+	if has("info.json") && len(posts) > 0 {
+		if err := writeThreadInfo(folder, meta); err != nil {
+			return "", err
+		}
+	}
+	if has(checksumsFile) {
+		if err := writeChecksums(folder); err != nil {
+			return "", err
+		}
+		if signKey != "" {
+			if err := writeProvenance(folder, meta); err != nil {
+				return "", err
+			}
+		}
+	}
+	if archiveKey != nil {
+		if err := encryptFolder(folder); err != nil {
+			return "", err
+		}
+	}
+	result := fmt.Sprintf("%d posts, %d new", len(posts), added)
+	if found > 0 {
+		result += fmt.Sprintf(", %d tombstones", found)
+	}
+	return result, nil
+}
+
+// fileTags returns the booru tags of a file: lower case with underscores,
+// namespaced for the board, thread, subject and poster, plus the Danbooru
+// resolution tags.
+func fileTags(meta threadMetadata, post Post, f *File) []string {
+	tag := func(s string) string {
+		return strings.Join(strings.Fields(strings.ToLower(postText(s))), "_")
+	}
+	tags := []string{"board:" + meta.Board, "thread:" + meta.Thread}
+	if len(meta.Posts) > 0 && meta.Posts[0].Subject != "" {
+		tags = append(tags, "subject:"+tag(meta.Posts[0].Subject))
+	}
+	if post.ID != "" {
+		tags = append(tags, "poster:"+tag(post.ID))
+	}
+	switch w, h := f.Width, f.Height; {
+	case w == 0 || h == 0:
+	case w >= 10000 || h >= 10000:
+		tags = append(tags, "incredibly_absurdres", "absurdres", "highres")
+	case w >= 3200 || h >= 2400:
+		tags = append(tags, "absurdres", "highres")
+	case w >= 1600 || h >= 1200:
+		tags = append(tags, "highres")
+	case w <= 500 && h <= 500:
+		tags = append(tags, "lowres")
+	}
+	switch strings.ToLower(filepath.Ext(f.Name)) {
+	case ".webm", ".mp4":
+		tags = append(tags, "video")
+	}
+	if f.Spoiler {
+		tags = append(tags, "spoiler")
+	}
+	return tags
+}
+
+// writeTags saves the tags of the archived files of a thread for booru
+// importers: with "sidecar", one tag per line in <file>.txt; with "file", all of
+// them in tags.txt, one "<path>\t<tags>" line per file.
+func writeTags(path string, meta threadMetadata, mode string) error {
+	var all strings.Builder
+	for _, post := range meta.Posts {
+		for _, f := range post.Files {
+			filePath := filepath.Join(path, f.Path)
+			if _, err := os.Stat(filePath); f.Path == "" || err != nil {
+				continue
+			}
+			tags := fileTags(meta, post, f)
+			if mode == "file" {
+				fmt.Fprintf(&all, "%s\t%s\n", filepath.ToSlash(f.Path), strings.Join(tags, " "))
+				continue
+			}
+			if err := ioutil.WriteFile(filePath+".txt", []byte(strings.Join(tags, "\n")+"\n"), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	if mode == "file" {
+		return ioutil.WriteFile(filepath.Join(path, "tags.txt"), []byte(all.String()), 0644)
+	}
+	return nil
+}
+
+// threadTitle returns the subject of the thread, or its number when it has none.
+func threadTitle(meta threadMetadata) string {
+	if len(meta.Posts) > 0 && meta.Posts[0].Subject != "" {
+		return html.UnescapeString(meta.Posts[0].Subject)
+	}
+	return "Thread " + meta.Thread
+}
+
+// fileLink is where exports link a file: its local copy, or the original when it
+// wasn't downloaded (--no-media, filters).
+func fileLink(f *File) string {
+	if f.Path == "" {
+		return f.URL
+	}
+	return f.Path
+}
+
+// threadMarkdown renders the thread as a Markdown document.
+func threadMarkdown(meta threadMetadata) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# /%s/ - %s\n\n", meta.Board, threadTitle(meta))
+	fmt.Fprintf(&b, "Source: <%s>  \nArchived: %s by 4cget %s\n", meta.URL, meta.Archived.UTC().Format(time.RFC1123), meta.Version)
+
+	for _, post := range meta.Posts {
+		fmt.Fprintf(&b, "\n---\n\n### No.%d - %s - %s\n\n", post.No, post.Poster, time.Unix(post.Time, 0).UTC().Format(time.RFC1123))
+		for _, f := range post.Files {
+			fmt.Fprintf(&b, "[%s](%s)\n\n", f.Name, fileLink(f))
+		}
+		if post.FileDeleted {
+			b.WriteString("*File deleted.*\n\n")
+		}
+		for _, line := range strings.Split(postText(post.Comment), "\n") {
+			if strings.HasPrefix(line, ">") {
+				line = "\\" + line // Greentext, not a Markdown quote
+			}
+			b.WriteString(line + "  \n")
+		}
+	}
+	return b.String()
+}
+
+// threadHTML renders the thread as a standalone HTML page.
+func threadHTML(meta threadMetadata) string {
+	var b strings.Builder
+	title := html.EscapeString(fmt.Sprintf("/%s/ - %s", meta.Board, threadTitle(meta)))
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n<body>\n", title)
+	fmt.Fprintf(&b, "<h1>%s</h1>\n<p>Source: <a href=\"%s\">%[2]s</a><br>Archived: %s by 4cget %s</p>\n",
+		title, html.EscapeString(meta.URL), meta.Archived.UTC().Format(time.RFC1123), meta.Version)
+
+	for _, post := range meta.Posts {
+		fmt.Fprintf(&b, "<hr>\n<div id=\"p%d\">\n<p><b>No.%[1]d</b> %s - %s</p>\n",
+			post.No, html.EscapeString(post.Poster.String()), time.Unix(post.Time, 0).UTC().Format(time.RFC1123))
+		for _, f := range post.Files {
+			fmt.Fprintf(&b, "<p><a href=\"%s\">%s</a></p>\n", html.EscapeString(fileLink(f)), html.EscapeString(f.Name))
+		}
+		if post.FileDeleted {
+			b.WriteString("<p><i>File deleted.</i></p>\n")
+		}
+		text := html.EscapeString(postText(post.Comment))
+		fmt.Fprintf(&b, "<p>%s</p>\n</div>\n", strings.ReplaceAll(text, "\n", "<br>\n"))
+	}
+	b.WriteString("</body>\n</html>\n")
+	return b.String()
+}
+
+// unique removes duplicate strings from a slice.
+func unique(input []string) []string {
+	u := make(map[string]bool)
+	var uniqueList []string
+	for _, val := range input {
+		if _, ok := u[val]; !ok {
+			u[val] = true
+			uniqueList = append(uniqueList, val)
+		}
+	}
+	return uniqueList
+}
+
+// HistoryEntry is a single record of the dedupe index.
+type HistoryEntry struct {
+	MD5  string    `json:"md5"`
+	Path string    `json:"path"`
+	URL  string    `json:"url,omitempty"`
+	Size int64     `json:"size"`
+	Time time.Time `json:"time"`
+}
+
+// History is the dedupe index: every file 4cget has stored, keyed by MD5.
+// It is kept as an append-only JSON lines file under the archive root.
+//
+// Several 4cget processes can share it, such as cron runs overlapping an
+// interactive one: writes are made holding historyLock, and the entries the
+// other processes appended are read before every lookup and write.
+type History struct {
+	mu    sync.Mutex
+	root  string
+	path  string
+	read  int64 // Bytes of the file already loaded
+	byMD5 map[string][]HistoryEntry
+}
+
+const historyLockWait = 30 * time.Second // How long to wait for another process to finish writing
+
+// openHistory loads the dedupe index of the archive rooted at root.
+func openHistory(root string) (*History, error) {
+	h := &History{
+		root:  root,
+		path:  filepath.Join(root, historyFile),
+		byMD5: make(map[string][]HistoryEntry),
+	}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// load reads the entries appended to the index file since the last call, by
+// this process or another one. A line still being written is left for the next
+// call. The caller holds h.mu.
+func (h *History) load() error {
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() == h.read {
+		return err
+	}
+	if info.Size() < h.read {
+		// The file was replaced, by a restore of the archive state
+		h.read, h.byMD5 = 0, make(map[string][]HistoryEntry)
+	}
+	if _, err := f.Seek(h.read, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		h.read += int64(len(line))
+		var e HistoryEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			continue // Skip torn or corrupted lines
+		}
+		h.byMD5[e.MD5] = append(h.byMD5[e.MD5], e)
+	}
+}
+
+// lock takes historyLock, waiting for the process holding it to be done. It
+// returns the function releasing the lock.
+func (h *History) lock() (func(), error) {
+	return lockFile(filepath.Join(h.root, historyLock), historyLockWait)
+}
+
+const lockStale = 2 * time.Minute // Age of a lock file taken over even if its process seems to run
+
+// lockFile takes the lock file at path, shared with other processes, waiting
+// up to wait for the one holding it. The file holds the PID of its holder and
+// a token: a lock whose process died, or older than lockStale, is taken over,
+// and releasing a lock never removes one taken over by another process.
+func lockFile(path string, wait time.Duration) (func(), error) {
+	token := fmt.Sprintf("%d %d", os.Getpid(), time.Now().UnixNano())
+	deadline := time.Now().Add(wait)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = fmt.Fprintln(f, token)
+			f.Close()
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return func() {
+				if data, err := ioutil.ReadFile(path); err == nil && strings.TrimSpace(string(data)) == token {
+					os.Remove(path)
+				}
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if staleLock(path) {
+			// Move the lock aside before removing it, so of the processes
+			// taking over the same stale lock only one succeeds, and a lock
+			// taken in the meantime is put back
+			moved := path + "." + strings.ReplaceAll(token, " ", "-")
+			if os.Rename(path, moved) == nil {
+				if !staleLock(moved) {
+					os.Link(moved, path)
+				}
+				os.Remove(moved)
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s is still held after %v, remove it if no other 4cget is running", path, wait)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// staleLock reports whether the lock file at path was left by a process that
+// died.
+func staleLock(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if time.Since(info.ModTime()) > lockStale {
+		return true
+	}
+	data, err := ioutil.ReadFile(path)
+	fields := strings.Fields(string(data))
+	if err != nil || len(fields) == 0 {
+		return false // Still being written
+	}
+	pid, err := strconv.Atoi(fields[0])
+	return err == nil && !processRunning(pid)
+}
+
+// processRunning reports whether a process is running. On Windows, where
+// processes can't be signaled, finding it is enough.
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	defer p.Release()
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Add records a stored file in the index.
+func (h *History) Add(e HistoryEntry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if rel, err := filepath.Rel(h.root, e.Path); err == nil && !strings.HasPrefix(rel, "..") {
+		e.Path = filepath.ToSlash(rel)
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), os.ModePerm); err != nil {
+		return err
+	}
+	unlock, err := h.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := h.load(); err != nil {
+		return err
+	}
+	for _, known := range h.byMD5[e.MD5] {
+		if known.Path == e.Path {
+			return nil // Already indexed
+		}
+	}
+
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if info, err := f.Stat(); err == nil && info.Size() > h.read {
+		// A process that crashed while writing left a line unfinished
+		line = append([]byte{'\n'}, line...)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return h.load()
+}
+
+// Lookup returns every indexed file with the given MD5, including those other
+// processes have added since.
+func (h *History) Lookup(md5sum string) []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.load(); err != nil {
+		printError("Error reading dedupe index", err)
+	}
+	return append([]HistoryEntry(nil), h.byMD5[md5sum]...)
+}
+
+// Duplicate returns an indexed copy of md5sum stored somewhere other than path
+// that still exists on disk.
+func (h *History) Duplicate(md5sum, path string) (HistoryEntry, bool) {
+	for _, e := range h.Lookup(md5sum) {
+		if h.abs(e.Path) == path {
+			continue
+		}
+		if _, err := os.Stat(h.abs(e.Path)); err == nil || storedAway(h.abs(e.Path)) {
+			return e, true
+		}
+	}
+	return HistoryEntry{}, false
+}
+
+// abs resolves an indexed path against the archive root.
+func (h *History) abs(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(h.root, filepath.FromSlash(path))
+}
+
+// normalizeMD5 accepts an MD5 as hex, base64 (the form used by the 4chan API)
+// or unpadded URL-safe base64 (used by meguca) and returns it as lowercase hex.
+func normalizeMD5(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if b, err := hex.DecodeString(s); err == nil && len(b) == md5.Size {
+		return strings.ToLower(s), nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == md5.Size {
+		return hex.EncodeToString(b), nil
+	}
+	if b, err := base64.RawURLEncoding.DecodeString(s); err == nil && len(b) == md5.Size {
+		return hex.EncodeToString(b), nil
+	}
+	return "", fmt.Errorf("not a valid MD5 hash: %s", s)
+}
+
+// hashFile returns the hex MD5 and size of a local file.
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	hasher := md5.New()
+	n, err := io.Copy(hasher, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), n, nil
+}
+
+// Blocklist holds MD5s and filename patterns that must never be kept.
+type Blocklist struct {
+	md5s     map[string]bool
+	patterns []string
+}
+
+// listLine returns a line of a list file without its surrounding spaces, or
+// nothing for a comment line. Only a leading '#' starts a comment, elsewhere it
+// belongs to the pattern or URL.
+func listLine(line string) string {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "#") {
+		return ""
+	}
+	return line
+}
+
+// loadBlocklist reads a blocklist file. Each line is an MD5 (hex or base64)
+// or a filename glob pattern such as "*.gif"; a line starting with '#' is a
+// comment.
+func loadBlocklist(path string) (*Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &Blocklist{md5s: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := listLine(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if sum, err := normalizeMD5(line); err == nil {
+			b.md5s[sum] = true
+			continue
+		}
+		if _, err := filepath.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", line, err)
+		}
+		b.patterns = append(b.patterns, strings.ToLower(line))
+	}
+	return b, scanner.Err()
+}
+
+// BlocksName reports whether a filename matches one of the blocked patterns.
+func (b *Blocklist) BlocksName(name string) bool {
+	if b == nil {
+		return false
+	}
+	for _, pattern := range b.patterns {
+		if ok, _ := filepath.Match(pattern, strings.ToLower(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// BlocksMD5 reports whether a hex MD5 is blocked.
+func (b *Blocklist) BlocksMD5(sum string) bool {
+	return b != nil && b.md5s[sum]
+}
+
+// progressEvents writes the --progress-json events to stdout, one JSON object
+// per line, so GUI front-ends and scripts can show the progress of the
+// downloads their own way. Everything else 4cget prints goes to stderr then.
+type progressEvents struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// progressEvent is a line of --progress-json. Event is "queued", "started",
+// "percent", "done" (downloaded), "skipped" or "failed".
+type progressEvent struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	URL     string    `json:"url"`
+	Path    string    `json:"path,omitempty"`    // Where the file goes, when queued
+	Size    int64     `json:"size,omitempty"`    // Expected size, or the actual one once done
+	Bytes   int64     `json:"bytes,omitempty"`   // Downloaded so far
+	Percent int64     `json:"percent,omitempty"` // Of the expected size, when it is known
+	Status  string    `json:"status,omitempty"`  // As in --report, for done, skipped and failed
+	MD5     string    `json:"md5,omitempty"`
+
+	Category string `json:"category,omitempty"` // Of the error of a failed download, as in the hints
+	Hint     string `json:"hint,omitempty"`     // What to do about it
+}
+
+func newProgressEvents(w io.Writer) *progressEvents {
+	return &progressEvents{enc: json.NewEncoder(w)}
+}
+
+func (p *progressEvents) emit(e progressEvent) {
+	if p == nil {
+		return
+	}
+	e.Time = time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.enc.Encode(e)
+}
+
+// Queued reports a file handed to the workers.
+func (p *progressEvents) Queued(job downloadJob) {
+	p.emit(progressEvent{Event: "queued", URL: job.File.URL, Path: filepath.Join(job.Path, job.FileName), Size: job.File.Size})
+}
+
+// Started reports a download starting.
+func (p *progressEvents) Started(url string, size int64) {
+	p.emit(progressEvent{Event: "started", URL: url, Size: size})
+}
+
+// Finished reports the outcome of a file, with a status of setStatus.
+func (p *progressEvents) Finished(url, status string, size int64, sum string) {
+	event := "skipped"
+	switch status {
+	case "downloaded":
+		event = "done"
+	case "failed", "quarantined":
+		event = "failed"
+	}
+	p.emit(progressEvent{Event: event, URL: url, Size: size, Status: status, MD5: sum})
+}
+
+// Failed reports a download that failed with an error, of the given kind.
+func (p *progressEvents) Failed(url string, f *failure) {
+	p.emit(progressEvent{Event: "failed", URL: url, Status: "failed", Category: f.Category, Hint: f.Hint})
+}
+
+// Meter returns a writer to add to the writers of a download of size bytes,
+// reporting every percent it completes. Without a known size, or without
+// --progress-json, it does nothing.
+func (p *progressEvents) Meter(url string, size int64) io.Writer {
+	if p == nil || size <= 0 {
+		return ioutil.Discard
+	}
+	return &percentWriter{events: p, url: url, size: size}
+}
+
+// percentWriter counts the bytes of a download for progressEvents. Ranges of a
+// chunked download write to it concurrently.
+type percentWriter struct {
+	events       *progressEvents
+	url          string
+	size         int64
+	bytes, shown int64 // Accessed atomically
+}
+
+func (w *percentWriter) Write(b []byte) (int, error) {
+	n := atomic.AddInt64(&w.bytes, int64(len(b)))
+	percent := n * 100 / w.size
+	if shown := atomic.LoadInt64(&w.shown); percent > shown && atomic.CompareAndSwapInt64(&w.shown, shown, percent) {
+		w.events.emit(progressEvent{Event: "percent", URL: w.url, Size: w.size, Bytes: n, Percent: percent})
+	}
+	return len(b), nil
+}
+
+// feedEntries is how many downloads the Atom feed remembers.
+const feedEntries = 200
+
+// Feed is an Atom feed of the latest downloaded files, so a feed reader can
+// follow a monitored thread.
+type Feed struct {
+	mu   sync.Mutex
+	path string
+	atom atomFeed
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated time.Time   `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Updated time.Time  `xml:"updated"`
+	Links   []atomLink `xml:"link"`
+	Summary string     `xml:"summary"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+// openFeed loads the feed at path, keeping the entries of previous runs.
+func openFeed(path string) (*Feed, error) {
+	f := &Feed{path: path, atom: atomFeed{Title: "4cget downloads", ID: "urn:4cget:" + filepath.Base(path)}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := xml.Unmarshal(data, &f.atom); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return f, nil
+}
+
+// Add records a downloaded file. The entry links to the local copy, and to
+// the original file as the related link.
+func (f *Feed) Add(file *File, fileName, filePath string, size int64) {
+	if f == nil {
+		return
+	}
+	local := filePath
+	if abs, err := filepath.Abs(filePath); err == nil {
+		local = abs
+	}
+	entry := atomEntry{
+		Title:   fileName,
+		ID:      file.URL,
+		Updated: time.Now().UTC(),
+		Links: []atomLink{
+			{Href: (&url.URL{Scheme: "file", Path: filepath.ToSlash(local)}).String()},
+			{Href: file.URL, Rel: "related"},
+		},
+		Summary: fmt.Sprintf("%s (%s)", filepath.ToSlash(local), formatBytes(size)),
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.atom.Entries = append([]atomEntry{entry}, f.atom.Entries...)
+	if len(f.atom.Entries) > feedEntries {
+		f.atom.Entries = f.atom.Entries[:feedEntries]
+	}
+	f.atom.Updated = entry.Updated
+}
+
+// Save writes the feed, replacing the previous file atomically so readers
+// never see a partial one.
+func (f *Feed) Save() error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	data, err := xml.MarshalIndent(f.atom, "", "  ")
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append([]byte(xml.Header), data...), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// Report is the --report listing of every file seen by the run and what
+// happened to it, written as CSV.
+type Report struct {
+	mu    sync.Mutex
+	path  string
+	rows  []reportRow
+	index map[string]int // Row of each file URL
+}
+
+type reportRow struct {
+	Board, Thread string
+	Post          int64
+	URL, Path     string
+	Size          int64
+	MD5           string
+	Status        string // queued, downloaded, exists, blocked, duplicate, classified, quarantined or failed
+}
+
+func newReport(path string) *Report {
+	return &Report{path: path, index: make(map[string]int)}
+}
+
+// Track adds a file to the report the first time it is seen.
+func (r *Report) Track(board, thread string, job downloadJob) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.index[job.File.URL]; ok {
+		return
+	}
+	r.index[job.File.URL] = len(r.rows)
+	r.rows = append(r.rows, reportRow{
+		Board:  board,
+		Thread: thread,
+		Post:   job.Post,
+		URL:    job.File.URL,
+		Path:   filepath.Join(job.Path, job.FileName),
+		Size:   job.File.Size,
+		MD5:    job.File.MD5,
+		Status: "queued",
+	})
+}
+
+// cycleStats counts the outcomes of the files of a monitor check, for the
+// summary printed at its end.
+type cycleStats struct {
+	downloaded, skipped, failed int64 // Accessed atomically
+}
+
+var cycle cycleStats
+
+// Count records the outcome of a file.
+func (c *cycleStats) Count(status string) {
+	switch status {
+	case "downloaded":
+		atomic.AddInt64(&c.downloaded, 1)
+	case "exists", "blocked", "ignored", "duplicate", "classified":
+		atomic.AddInt64(&c.skipped, 1)
+	case "failed", "quarantined":
+		atomic.AddInt64(&c.failed, 1)
+	}
+}
+
+// Summary describes the check and starts counting the next one.
+func (c *cycleStats) Summary(newPosts int) string {
+	return fmt.Sprintf("%d new posts, %d files downloaded, %d skipped, %d failed", newPosts,
+		atomic.SwapInt64(&c.downloaded, 0), atomic.SwapInt64(&c.skipped, 0), atomic.SwapInt64(&c.failed, 0))
+}
+
+// runStats counts the files of the whole run for the final report, each one
+// once however many monitor checks queued it, by its latest outcome. Files
+// skipped before being queued count as queued too. Downloads finish
+// concurrently, so it is locked.
+type runStats struct {
+	mu     sync.Mutex
+	status map[string]string // By URL, "queued" until the outcome is known
+	sizes  map[string]int64  // Of the downloaded files, by URL
+}
+
+var stats = runStats{status: make(map[string]string), sizes: make(map[string]int64)}
+
+// Queue records a file handed to the workers.
+func (s *runStats) Queue(url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, seen := s.status[url]; !seen {
+		s.status[url] = "queued"
+	}
+}
+
+// Count records the outcome of a file, and its size when it was downloaded. A
+// file downloaded earlier in the run stays downloaded when found on disk later.
+func (s *runStats) Count(url, status string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status == "exists" && s.status[url] == "downloaded" {
+		return
+	}
+	s.status[url] = status
+	delete(s.sizes, url)
+	if status == "downloaded" {
+		s.sizes[url] = size
+	}
+}
+
+// Downloaded returns the number of files downloaded so far.
+func (s *runStats) Downloaded() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sizes)
+}
+
+// Summary describes the outcome of the queued files.
+func (s *runStats) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var skipped, failed int
+	var bytes int64
+	for _, status := range s.status {
+		switch status {
+		case "exists", "blocked", "ignored", "duplicate", "classified":
+			skipped++
+		case "failed", "quarantined":
+			failed++
+		}
+	}
+	for _, size := range s.sizes {
+		bytes += size
+	}
+	return fmt.Sprintf("%d queued: %d downloaded (%s), %d skipped, %d failed", len(s.status), len(s.sizes), formatBytes(bytes), skipped, failed)
+}
+
+// setStatus records the outcome for a file in the check summary, the run
+// statistics and the report.
+func setStatus(url, status string, size int64, sum string) {
+	cycle.Count(status)
+	stats.Count(url, status, size)
+	budget.Count(status)
+	events.Finished(url, status, size, sum)
+	report.Set(url, status, size, sum)
+}
+
+// setUntried records a file not even requested, the media host banning this
+// connection or the downloads having stopped, as failed like setStatus but
+// without counting it against the retry budget.
+func setUntried(url string) {
+	cycle.Count("failed")
+	stats.Count(url, "failed", 0)
+	events.Finished(url, "failed", 0, "")
+	report.Set(url, "failed", 0, "")
+}
+
+// setFailed records a file whose download failed with err like setStatus,
+// its --progress-json event telling the kind of error.
+func setFailed(url string, err error) {
+	cycle.Count("failed")
+	stats.Count(url, "failed", 0)
+	budget.Count("failed")
+	events.Failed(url, classify(err))
+	report.Set(url, "failed", 0, "")
+}
+
+// Set records the outcome for a file, with its actual size and MD5 when it
+// was downloaded. A file downloaded earlier in a monitor session stays
+// "downloaded" when later checks find it on disk.
+func (r *Report) Set(url, status string, size int64, sum string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i, ok := r.index[url]
+	if !ok || (status == "exists" && r.rows[i].Status == "downloaded") {
+		return
+	}
+	r.rows[i].Status = status
+	if sum != "" {
+		r.rows[i].Size, r.rows[i].MD5 = size, sum
+	}
+}
+
+// Save writes the whole report.
+func (r *Report) Save() error {
+	if r == nil {
+		return nil
+	}
+	f, err := os.Create(r.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"board", "thread", "post", "url", "path", "size", "md5", "status"})
+	r.mu.Lock()
+	for _, row := range r.rows {
+		w.Write([]string{row.Board, row.Thread, fmt.Sprint(row.Post), row.URL, row.Path, fmt.Sprint(row.Size), row.MD5, row.Status})
+	}
+	r.mu.Unlock()
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// IgnoreList holds the patterns of the .4cgetignore of the archive, for the
+// thread being archived. As in a .gitignore, each line is a glob pattern
+// matched against <board>/<thread>/<file name>: a pattern without a slash
+// matches any of them ("*.gif", "b"), one with a slash matches from the board
+// ("g/*/*.webm", "/wg/123456"), one ending with a slash only matches a board
+// or thread, and a leading '!' brings back what an earlier line ignored. '#'
+// starts a comment.
+type IgnoreList struct {
+	rules         []ignoreRule
+	board, thread string
+}
+
+// ignoreRule is a line of a .4cgetignore.
+type ignoreRule struct {
+	parts    []string // Pattern of each path element, from the board if anchored
+	anchored bool
+	dirOnly  bool
+	negate   bool
+}
+
+// loadIgnoreList reads the .4cgetignore of the archive for a thread. A missing
+// file ignores nothing.
+func loadIgnoreList(root, board, thread string) (*IgnoreList, error) {
+	l := &IgnoreList{board: strings.ToLower(board), thread: thread}
+	f, err := os.Open(filepath.Join(root, ignoreFile))
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := listLine(scanner.Text())
+		var r ignoreRule
+		if strings.HasPrefix(line, "!") {
+			r.negate, line = true, line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			r.anchored, line = true, strings.TrimLeft(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		r.parts = strings.Split(strings.ToLower(line), "/")
+		for _, part := range r.parts {
+			if _, err := filepath.Match(part, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", line, err)
+			}
+		}
+		l.rules = append(l.rules, r)
+	}
+	return l, scanner.Err()
+}
+
+// IgnoresThread reports whether the whole thread is ignored.
+func (l *IgnoreList) IgnoresThread() bool {
+	return l != nil && l.ignores([]string{l.board, l.thread}, false)
+}
+
+// IgnoresName reports whether a file of the thread is ignored.
+func (l *IgnoreList) IgnoresName(name string) bool {
+	return l != nil && l.ignores([]string{l.board, l.thread, strings.ToLower(name)}, true)
+}
+
+// ignores applies the rules to a path, the last one matching deciding. The
+// last element of the path is a file if file is set, a folder otherwise.
+func (l *IgnoreList) ignores(elems []string, file bool) bool {
+	ignored := false
+	for _, r := range l.rules {
+		if r.matches(elems, file) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+func (r ignoreRule) matches(elems []string, file bool) bool {
+	if !r.anchored {
+		for i, elem := range elems {
+			if r.dirOnly && file && i == len(elems)-1 {
+				continue
+			}
+			if ok, _ := filepath.Match(r.parts[0], elem); ok {
+				return true
+			}
+		}
+		return false
+	}
+	// Fewer parts than elements match a folder holding the path
+	if len(r.parts) > len(elems) || (r.dirOnly && file && len(r.parts) == len(elems)) {
+		return false
+	}
+	for i, part := range r.parts {
+		if ok, _ := filepath.Match(part, elems[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// threadSkipped reports whether the skip list of the archive names a thread,
+// as a thread URL, board/thread or a bare thread number; '#' starts a comment.
+// The file is read on every call so it can be edited while 4cget runs.
+func threadSkipped(root, board, thread string) bool {
+	f, err := os.Open(filepath.Join(root, skipListFile))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := listLine(scanner.Text())
+		if u, err := url.Parse(line); err == nil && u.Host != "" {
+			// /<board>/thread/<thread>/<slug> on 4chan, /<board>/<thread> elsewhere
+			parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+			if len(parts) >= 3 && parts[1] == "thread" {
+				parts = append(parts[:1], parts[2])
+			}
+			if len(parts) >= 2 {
+				line = parts[0] + "/" + parts[1]
+			}
+		}
+		line = strings.Trim(line, "/")
+		if line == thread || line == board+"/"+thread {
+			return true
+		}
+	}
+	return false
+}
+
+// keepExisting reports whether an existing local copy of a file should be kept
+// instead of downloading it again, according to the --skip-existing, --overwrite
+// and --update policy. known is false when --update can't tell without asking
+// the server.
+func keepExisting(file *File, filePath string) (keep bool, known bool) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return storedAway(filePath), true
+	}
+	switch existingPolicy {
+	case "overwrite":
+		return false, true
+	case "update":
+		if !fileComplete(file, filePath, info, true) {
+			return false, true
+		}
+		return file.Size != 0 || file.MD5 != "", file.Size != 0 || file.MD5 != ""
+	}
+	if !fileComplete(file, filePath, info, verifyMD5) {
+		fmt.Printf("Repairing incomplete file: %s\n", filepath.Base(filePath))
+		return false, true
+	}
+	return true, true
+}
+
+// fileComplete reports whether a local file matches the size the site published
+// for it and, if checkMD5 is set, its MD5. Files the site publishes nothing about
+// are assumed complete.
+func fileComplete(file *File, filePath string, info os.FileInfo, checkMD5 bool) bool {
+	if file.Size != 0 && info.Size() != file.Size {
+		return false
+	}
+	if checkMD5 && file.MD5 != "" {
+		sum, _, err := hashFile(filePath)
+		return err == nil && sum == file.MD5
+	}
+	return true
+}
+
+// skippedFile reports whether a file of a thread stays out of the thread folder
+// on purpose: outside the site's media hosts, ignored, blocked or classified.
+func skippedFile(site SiteInfo, f *File) bool {
+	return !site.mediaAllowed(f.URL) || ignores.IgnoresName(f.Name) || blocklist.BlocksName(f.Name) || blocklist.BlocksMD5(f.MD5) || classifier.Rejects(f.MD5, f.URL)
+}
+
+// missingFiles lists the files of a thread that should be in the thread folder
+// but are missing or incomplete there. Filtered, blocked, classified and
+// duplicate files aren't expected, nor files outside the site's media hosts.
+func missingFiles(site SiteInfo, posts []Post, pathResult string) []string {
+	var missing []string
+	for _, post := range posts {
+		if !matchesCommentFilters(post) || post.Time < since.Unix() {
+			continue
+		}
+		for _, f := range post.Files {
+			if skippedFile(site, f) {
+				continue
+			}
+			filePath := filepath.Join(pathResult, placeFile(post, f))
+			info, err := os.Stat(filePath)
+			if (err == nil && fileComplete(f, filePath, info, verifyMD5)) || (err != nil && storedAway(filePath)) {
+				continue
+			}
+			if dedupeMode && history != nil && f.MD5 != "" {
+				if _, found := history.Duplicate(f.MD5, filePath); found {
+					continue
+				}
+			}
+			if err == nil {
+				missing = append(missing, fmt.Sprintf("%s (post %d, incomplete)", filePath, post.No))
+			} else {
+				missing = append(missing, fmt.Sprintf("%s (post %d)", filePath, post.No))
+			}
+		}
+	}
+	return missing
+}
+
+// threadPage returns the index page a thread is currently on (from 1) and the
+// number of pages of the board, or 0 pages if the thread isn't listed. The
+// catalog of the board read by watch answers without a request while fresh.
+func threadPage(client *http.Client, site SiteInfo, board, thread string) (page, pages int, err error) {
+	if threads, ok := loadSharedCatalog(site, board); ok {
+		for _, t := range threads {
+			if t.Page > pages {
+				pages = t.Page
+			}
+			if fmt.Sprint(t.Thread) == thread {
+				page = t.Page
+			}
+		}
+		if page == 0 {
+			return 0, 0, nil
+		}
+		return page, pages, nil
+	}
+	body, err := fetchAPI(client, site, fmt.Sprintf(site.ThreadsAPI, board))
+	if err != nil {
+		return 0, 0, err
+	}
+	var index []struct {
+		Page    int `json:"page"`
+		Threads []struct {
+			No int64 `json:"no"`
+		} `json:"threads"`
+	}
+	if err := json.Unmarshal(body, &index); err != nil {
+		return 0, 0, err
+	}
+	for _, p := range index {
+		for _, t := range p.Threads {
+			if fmt.Sprint(t.No) == thread {
+				return p.Page, len(index), nil
+			}
+		}
+	}
+	return 0, 0, nil
+}
+
+// threadLifecycle describes where a thread is in its life and returns how long
+// to wait before the next check. With adaptive set, the wait shrinks as the
+// thread nears pruning so its last posts aren't missed, down to minWait.
+func threadLifecycle(status *ThreadStatus, page, pages int, wait, minWait time.Duration, adaptive bool) (string, time.Duration) {
+	var notes []string
+	if pages > 0 {
+		notes = append(notes, fmt.Sprintf("page %d of %d", page, pages))
+	}
+	if status != nil && status.Sticky {
+		notes = append(notes, "sticky")
+	}
+	if status != nil && status.BumpLimit {
+		notes = append(notes, "bump limit reached")
+	}
+	if status != nil && status.ImageLimit {
+		notes = append(notes, "image limit reached")
+	}
+
+	dying := pages > 0 && page >= pages-1
+	if dying {
+		notes = append(notes, "about to be pruned")
+	}
+	if adaptive {
+		switch {
+		case dying:
+			wait /= 4
+		case status != nil && status.BumpLimit:
+			wait /= 2
+		}
+		if wait < minWait {
+			wait = minWait
+		}
+	}
+	return strings.Join(notes, ", "), wait
+}
+
+// notify shows a native desktop notification when --notify is set, and posts
+// the message to the Matrix room of --matrix-room. It is best effort: a missing
+// notifier never interrupts the download.
+func notify(title, message string) {
+	matrix.Send(message)
+	if !notifyMode {
+		return
+	}
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace
+		cmd = exec.Command("osascript", "-e", `display notification "`+quote(message)+`" with title "`+quote(title)+`"`)
+	case "windows":
+		quote := strings.NewReplacer(`'`, `''`).Replace
+		script := `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$xml = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $xml.GetElementsByTagName('text')
+$text.Item(0).AppendChild($xml.CreateTextNode('` + quote(title) + `')) > $null
+$text.Item(1).AppendChild($xml.CreateTextNode('` + quote(message) + `')) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('4cget').Show([Windows.UI.Notifications.ToastNotification]::new($xml))`
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	default:
+		cmd = exec.Command("notify-send", "--app-name=4cget", title, message)
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Println("[!] Error showing notification:", err)
+		return
+	}
+	go cmd.Wait()
+}
+
+// matrixQueueSize is how many messages can wait for the homeserver before new
+// ones are dropped.
+const matrixQueueSize = 100
+
+// matrixRoom is the Matrix room notifications are posted to, as the user of
+// the access token. Messages are posted in order by a goroutine of their own,
+// so a slow homeserver never holds up the downloads.
+type matrixRoom struct {
+	client     *http.Client
+	homeserver string // Base URL, such as https://matrix.org
+	token      string
+	room       string // Room ID, such as !abcdef:matrix.org
+	mu         sync.Mutex
+	queue      chan string
+	closed     bool
+	done       chan struct{} // Closed once the queue is drained
+}
+
+func newMatrixRoom(client *http.Client, homeserver, token, room string) *matrixRoom {
+	m := &matrixRoom{client: client, homeserver: homeserver, token: token, room: room,
+		queue: make(chan string, matrixQueueSize), done: make(chan struct{})}
+	go func() {
+		defer close(m.done)
+		for message := range m.queue {
+			m.post(message)
+		}
+	}()
+	return m
+}
+
+// Send queues a text message for the room.
+func (m *matrixRoom) Send(message string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return // Exiting, too late for new messages
+	}
+	select {
+	case m.queue <- message:
+	default:
+		fmt.Println("[!] Error sending Matrix notification: too many messages waiting, dropping one")
+	}
+}
+
+// Close posts the messages still queued, waiting for them at most 30 seconds.
+func (m *matrixRoom) Close() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+	m.mu.Unlock()
+	select {
+	case <-m.done:
+	case <-time.After(30 * time.Second):
+	}
+}
+
+// post sends a text message to the room. Errors are only printed.
+func (m *matrixRoom) post(message string) {
+	body, _ := json.Marshal(map[string]string{"msgtype": "m.text", "body": message})
+	// The transaction ID makes the homeserver ignore a message sent twice
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/4cget-%d",
+		strings.TrimSuffix(m.homeserver, "/"), url.PathEscape(m.room), time.Now().UnixNano())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, bytes.NewReader(body))
+	if err != nil {
+		fmt.Println("[!] Error sending Matrix notification:", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = &httpError{Status: resp.StatusCode, URL: endpoint}
+		}
+	}
+	if err != nil {
+		fmt.Println("[!] Error sending Matrix notification:", err)
+	}
+}
+
+// resourceUsage describes the goroutines, open files and heap of the process,
+// so that --verbose monitor sessions running for weeks show any leak. Open
+// files are only counted where /proc/self/fd exists.
+func resourceUsage(baseline int) string {
+	goroutines := runtime.NumGoroutine()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	usage := fmt.Sprintf("%d goroutines (%+d since the first check)", goroutines, goroutines-baseline)
+	if fds, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+		usage += fmt.Sprintf(", %d open files", len(fds))
+	}
+	return usage + fmt.Sprintf(", %s heap", formatBytes(int64(mem.HeapAlloc)))
+}
+
+// threadDeath describes a monitored thread that died, for --on-death and
+// --death-webhook.
+type threadDeath struct {
+	Event  string `json:"event"` // Always "thread_died"
+	Site   string `json:"site"`
+	Board  string `json:"board"`
+	Thread string `json:"thread"`
+	URL    string `json:"url"`
+	Dir    string `json:"dir"`
+	Reason string `json:"reason"` // deleted (pruned or removed), archived or closed
+	Posts  int    `json:"posts"`
+	Files  int    `json:"files"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// announceDeath tells that a monitored thread died, so its successor can be
+// looked for: with a desktop notification, the --on-death command (the fields
+// of the death replacing {board}, {thread}, {url}, {dir}, {reason}, {posts}
+// and {files}) and a JSON POST to the --death-webhook.
+func announceDeath(client *http.Client, command, webhook string, d threadDeath) {
+	d.Event = "thread_died"
+	fmt.Printf("[*] /%s/%s DIED (%s) AFTER %d POSTS AND %d FILES [*]\n", d.Board, d.Thread, d.Reason, d.Posts, d.Files)
+	notify("4cget", fmt.Sprintf("/%s/%s was %s after %d posts and %d files", d.Board, d.Thread, d.Reason, d.Posts, d.Files))
+	if command != "" {
+		vars := map[string]string{"board": d.Board, "thread": d.Thread, "url": d.URL, "dir": d.Dir, "reason": d.Reason,
+			"posts": strconv.Itoa(d.Posts), "files": strconv.Itoa(d.Files)}
+		if err := runStepCommand(command, d.Dir, vars); err != nil {
+			printError("Error running --on-death", err)
+		}
+	}
+	if webhook != "" {
+		body, _ := json.Marshal(d)
+		resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = &httpError{Status: resp.StatusCode, URL: webhook}
+			}
+		}
+		if err != nil {
+			printError("Error calling --death-webhook", err)
+		}
+	}
+}
+
+// threadActivity summarizes how active a thread is from its post timestamps,
+// or returns "" if the site doesn't publish them.
+func threadActivity(posts []Post, now time.Time) string {
+	if len(posts) == 0 || posts[0].Time == 0 {
+		return ""
+	}
+	var images, recentPosts, recentImages int
+	hourAgo := now.Add(-time.Hour).Unix()
+	for _, post := range posts {
+		hasFile := len(post.Files) > 0 || post.FileDeleted
+		if hasFile {
+			images++
+		}
+		if post.Time >= hourAgo {
+			recentPosts++
+			if hasFile {
+				recentImages++
+			}
+		}
+	}
+	// At least an hour, so young threads don't show inflated rates
+	hours := now.Sub(time.Unix(posts[0].Time, 0)).Hours()
+	if hours < 1 {
+		hours = 1
+	}
+	return fmt.Sprintf("%d posts and %d images in the last hour, %.1f posts/h and %.1f images/h overall",
+		recentPosts, recentImages, float64(len(posts))/hours, float64(images)/hours)
+}
+
+// speedMeter counts downloaded bytes to report throughput. It is an io.Writer
+// so it can be added to the writers of every download.
+type speedMeter struct {
+	bytes int64 // Accessed atomically
+	start time.Time
+}
+
+func (m *speedMeter) Write(p []byte) (int, error) {
+	atomic.AddInt64(&m.bytes, int64(len(p)))
+	return len(p), nil
+}
+
+// Total returns the number of bytes downloaded so far.
+func (m *speedMeter) Total() int64 {
+	return atomic.LoadInt64(&m.bytes)
+}
+
+// Average returns the average throughput since the meter was started, in bytes per second.
+func (m *speedMeter) Average() float64 {
+	elapsed := time.Since(m.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(m.Total()) / elapsed
+}
+
+// report prints the current and average throughput every interval while data
+// is coming in, until stop is closed.
+func (m *speedMeter) report(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := m.Total()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			total := m.Total()
+			if total == last {
+				continue // Idle, e.g. waiting for the next monitor check
+			}
+			current := float64(total-last) / interval.Seconds()
+			fmt.Printf("[~] Speed: %s now, %s average, %s downloaded\n", formatRate(current), formatRate(m.Average()), formatBytes(total))
+			last = total
+		}
+	}
+}
+
+// formatBytes formats a byte count with a binary unit, e.g. "1.50 MB", or
+// "512 B" below a kilobyte. Every size shown by 4cget goes through it.
+func formatBytes(n int64) string {
+	if n < 0 {
+		return "-" + formatBytes(-n)
+	}
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	suffixes := []string{"KB", "MB", "GB", "TB", "PB"}
+	size := float64(n) / 1024
+	i := 0
+	for size >= 1024 && i < len(suffixes)-1 {
+		size /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.2f %s", size, suffixes[i])
+}
+
+// formatRate formats a throughput in bytes per second, e.g. "1.50 MB/s".
+func formatRate(bytesPerSecond float64) string {
+	return formatBytes(int64(bytesPerSecond)) + "/s"
+}
+
+// rateLimiter caps the overall download rate for --limit-rate, following a
+// schedule of rates by time of day. Like speedMeter it is an io.Writer added
+// to the writers of every download, and it holds back the writes going over
+// the current rate, which slows down reading from the connections.
+type rateLimiter struct {
+	mu       sync.Mutex
+	windows  []rateWindow
+	fallback int64     // Bytes per second outside the windows, 0 for unlimited
+	next     time.Time // When the bytes written so far are within the rate
+}
+
+// rateWindow is a time of day with its own rate.
+type rateWindow struct {
+	from, to int   // Minutes since midnight, to before from wraps around midnight
+	rate     int64 // Bytes per second, 0 for unlimited
+}
+
+// parseRateSchedule parses a --limit-rate value: a rate such as 500K or 2M
+// (bytes per second), or comma separated HH:MM-HH:MM=<rate> windows with an
+// else=<rate> for the rest of the day, e.g. "01:00-08:00=0,else=1M".
+func parseRateSchedule(value string) (*rateLimiter, error) {
+	l := &rateLimiter{}
+	for _, item := range strings.Split(value, ",") {
+		span, rate, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			span, rate = "else", span
+		}
+		r, err := parseRate(rate)
+		if err != nil {
+			return nil, err
+		}
+		if span == "else" {
+			l.fallback = r
+			continue
+		}
+		from, to, _ := strings.Cut(span, "-")
+		start, err1 := time.Parse("15:04", from)
+		end, err2 := time.Parse("15:04", to)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid time window %q (use HH:MM-HH:MM)", span)
+		}
+		l.windows = append(l.windows, rateWindow{start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute(), r})
+	}
+	return l, nil
+}
+
+// parseRate parses a rate in bytes per second, with an optional K, M or G
+// suffix (binary units, as formatBytes shows them).
+func parseRate(value string) (int64, error) {
+	number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	unit := 1.0
+	if n := len(number); n > 0 {
+		switch number[n-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		}
+		if unit > 1 {
+			number = number[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid rate %q (use e.g. 500K, 2M or 0 for unlimited)", value)
+	}
+	return int64(f * unit), nil
+}
+
+// Rate returns the rate in force at t, in bytes per second, 0 for unlimited.
+func (l *rateLimiter) Rate(t time.Time) int64 {
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range l.windows {
+		if (w.from <= w.to && minute >= w.from && minute < w.to) ||
+			(w.from > w.to && (minute >= w.from || minute < w.to)) {
+			return w.rate
+		}
+	}
+	return l.fallback
+}
+
+func (l *rateLimiter) Write(p []byte) (int, error) {
+	now := time.Now()
+	rate := l.Rate(now)
+	l.mu.Lock()
+	if rate == 0 || l.next.Before(now) {
+		l.next = now // No credit for idle time, so there are no bursts
+	}
+	if rate == 0 {
+		l.mu.Unlock()
+		return len(p), nil
+	}
+	l.next = l.next.Add(time.Duration(float64(len(p)) / float64(rate) * float64(time.Second)))
+	wait := l.next.Sub(now)
+	l.mu.Unlock()
+	time.Sleep(wait)
+	return len(p), nil
+}
+
+// downloadJob is a file waiting in the download queue.
+type downloadJob struct {
+	File     *File  `json:"file"`
+	FileName string `json:"file_name"`
+	Path     string `json:"path"`
+	Post     int64  `json:"post,omitempty"`
+	Time     int64  `json:"time,omitempty"` // Post timestamp
+}
+
+// startWorkers starts n download workers serving the queue until it is closed.
+// Every finished job is removed from the persisted queue.
+func startWorkers(n int, jobs <-chan downloadJob, wg *sync.WaitGroup, client *http.Client, queue *persistentQueue) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range jobs {
+				done := turns.Wait()
+				downloadFile(wg, job.File, job.FileName, job.Path, client)
+				done()
+				queue.Done(job)
+			}
+		}()
+	}
+}
+
+// turnStale is how long a ticket of --max-downloads lives without being
+// refreshed: longer, its 4cget died.
+const turnStale = time.Minute
+
+// downloadTurns shares --max-downloads between every 4cget running from the
+// same archive root, such as the threads of a watch list. Each download takes
+// a ticket, a file in turnsDir named after the time it was taken, and starts
+// once it is among the max oldest. Workers take a new ticket for every file,
+// at the back of the line, so threads take turns file by file and a thread of
+// huge files can't keep the others waiting until it is done.
+type downloadTurns struct {
+	dir     string
+	max     int
+	tickets int64 // Taken by this process, to name them
+}
+
+// Wait takes a ticket and waits for its turn. It returns the function to call
+// once the download is over.
+func (t *downloadTurns) Wait() func() {
+	if t == nil {
+		return func() {}
+	}
+	ticket := fmt.Sprintf("%020d-%d-%d", time.Now().UnixNano(), os.Getpid(), atomic.AddInt64(&t.tickets, 1))
+	path := filepath.Join(t.dir, ticket)
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		printError("Error taking a download turn", err)
+		return func() {}
+	}
+	stop := make(chan struct{})
+	go func() {
+		// Show the other processes the ticket is still in use
+		refresh := time.NewTicker(turnStale / 4)
+		defer refresh.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-refresh.C:
+				os.Chtimes(path, now, now)
+			}
+		}
+	}()
+	for !t.turn(ticket) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return func() {
+		close(stop)
+		os.Remove(path)
+	}
+}
+
+// turn reports whether ticket is among the max oldest tickets, removing those
+// left by processes that died.
+func (t *downloadTurns) turn(ticket string) bool {
+	entries, err := ioutil.ReadDir(t.dir) // Sorted by name, which is by age
+	if err != nil {
+		return true
+	}
+	ahead := 0
+	for _, e := range entries {
+		switch {
+		case e.Name() == ticket:
+			return ahead < t.max
+		case time.Since(e.ModTime()) > turnStale:
+			os.Remove(filepath.Join(t.dir, e.Name()))
+		default:
+			ahead++
+		}
+	}
+	return true // Taken as stale by another process after a long pause
+}
+
+// sortJobs orders a batch of downloads according to --order. Without it the
+// files are downloaded in thread order.
+func sortJobs(batch []downloadJob, order string) {
+	switch order {
+	case "smallest", "largest":
+		// Files of unknown size go last
+		sort.SliceStable(batch, func(i, j int) bool {
+			a, b := batch[i].File.Size, batch[j].File.Size
+			if order == "largest" {
+				return a > b
+			}
+			return a != 0 && (b == 0 || a < b)
+		})
+	case "newest":
+		sort.SliceStable(batch, func(i, j int) bool { return batch[i].Time > batch[j].Time })
+	case "oldest":
+		// Files left over from the previous run are queued after the thread's
+		sort.SliceStable(batch, func(i, j int) bool { return batch[i].Time < batch[j].Time })
+	}
+}
+
+// persistentQueue mirrors the downloads that haven't finished yet in a file
+// under .4cget/queue, so a crashed or interrupted run can pick them up again
+// even if the thread is gone by then.
+type persistentQueue struct {
+	mu      sync.Mutex
+	path    string
+	pending map[string]downloadJob // Keyed by file URL
+	saved   time.Time
+}
+
+// openQueue loads the persisted queue of a thread and returns it along with
+// the jobs a previous run left unfinished.
+func openQueue(root, board, thread string) (*persistentQueue, []downloadJob) {
+	q := &persistentQueue{
+		path:    filepath.Join(root, ".4cget", "queue", safeName(board)+"-"+safeName(thread)+".json"),
+		pending: make(map[string]downloadJob),
+	}
+	var leftover []downloadJob
+	if data, err := ioutil.ReadFile(q.path); err == nil {
+		json.Unmarshal(data, &leftover)
+	}
+	return q, leftover
+}
+
+// Add records a batch of jobs as pending.
+func (q *persistentQueue) Add(batch []downloadJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, job := range batch {
+		q.pending[job.File.URL] = job
+	}
+	q.save(true)
+}
+
+// Done removes a finished job. The file is rewritten at most once per second,
+// and always once the queue is empty.
+func (q *persistentQueue) Done(job downloadJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, job.File.URL)
+	q.save(len(q.pending) == 0 || time.Since(q.saved) > time.Second)
+}
+
+// save writes the pending jobs out, or removes the file when there are none.
+func (q *persistentQueue) save(now bool) {
+	if !now {
+		return
+	}
+	q.saved = time.Now()
+	if len(q.pending) == 0 {
+		os.Remove(q.path)
+		return
+	}
+	jobs := make([]downloadJob, 0, len(q.pending))
+	for _, job := range q.pending {
+		jobs = append(jobs, job)
+	}
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		return
+	}
+	os.MkdirAll(filepath.Dir(q.path), os.ModePerm)
+	if err := ioutil.WriteFile(q.path+".tmp", data, 0644); err == nil {
+		os.Rename(q.path+".tmp", q.path)
+	}
+}
+
+// threadState is what a run of a thread leaves in .4cget/state for the next
+// one, so stopping monitor mode and starting it again later carries on where
+// it stopped instead of treating every post as new.
+type threadState struct {
+	LastPost    int64          `json:"last_post"` // Newest post seen
+	Posts       int            `json:"posts"`
+	FileNumbers map[string]int `json:"file_numbers,omitempty"` // For --numbered
+	Checked     time.Time      `json:"checked"`
+	Died        string         `json:"died,omitempty"` // Why the thread ended, once --on-death was run for it
+}
+
+// threadStatePath is where the state of a thread is kept. The site is part of
+// the name, since two sites can have a thread of the same number on a board of
+// the same name.
+func threadStatePath(root, site, board, thread string) string {
+	return filepath.Join(root, ".4cget", "state", safeName(site)+"-"+safeName(board)+"-"+safeName(thread)+".json")
+}
+
+// loadThreadState reads the state a previous run of the thread left, or
+// returns an empty one.
+func loadThreadState(root, site, board, thread string) threadState {
+	var st threadState
+	if data, err := ioutil.ReadFile(threadStatePath(root, site, board, thread)); err == nil {
+		json.Unmarshal(data, &st)
+	}
+	return st
+}
+
+// saveThreadState writes the state of the thread for the next run, replacing
+// the previous one at once so an interrupted run can't leave half of it.
+func saveThreadState(root, site, board, thread string, st threadState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	path := threadStatePath(root, site, board, thread)
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// banThreshold is how many HTTP 403 in a row from the media host mean that this
+// connection is banned or rate-limited, rather than that some files are gone.
+const banThreshold = 5
+
+// banGuard watches media downloads for a streak of HTTP 403. Past banThreshold,
+// downloads move to the --fallback-proxy client if there is one, or stop.
+type banGuard struct {
+	mu          sync.Mutex
+	consecutive int
+	fallback    *http.Client
+	switched    bool
+	banned      bool
+}
+
+// Client returns the client downloads should use now.
+func (g *banGuard) Client(client *http.Client) *http.Client {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.switched {
+		return g.fallback
+	}
+	return client
+}
+
+// Banned reports whether downloads have stopped because of a ban.
+func (g *banGuard) Banned() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.banned
+}
+
+// Record counts the status of a media response.
+func (g *banGuard) Record(host string, status int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if status != 403 {
+		g.consecutive = 0
+		return
+	}
+	g.consecutive++
+	if g.consecutive < banThreshold || g.banned {
+		return
+	}
+	if g.fallback != nil && !g.switched {
+		fmt.Printf("[!] %d HTTP 403 in a row from %s, switching to the fallback proxy\n", g.consecutive, host)
+		g.switched, g.consecutive = true, 0
+		return
+	}
+	fmt.Printf("[!] %d HTTP 403 in a row from %s: you appear to be banned or rate-limited.\n", g.consecutive, host)
+	fmt.Println("[!] Stopping downloads. Try again later, or use --proxy or --fallback-proxy.")
+	g.banned = true
+}
+
+// budgetMinFiles is how many files must have been tried before
+// --max-failure-rate applies, so a couple of early failures don't abort a run.
+const budgetMinFiles = 20
+
+// retryBudget stops the downloads of a run that keeps failing, such as behind
+// a misconfigured proxy or a sitewide block, instead of trying every file of
+// the thread several times: past --max-failures failed requests, retries
+// included, or once more than --max-failure-rate percent of the files tried
+// failed. In monitor mode the counts start over at every check, so the
+// failures of weeks of monitoring don't add up to an abort.
+type retryBudget struct {
+	mu          sync.Mutex
+	maxFailures int     // 0 disables
+	maxRate     float64 // Percent, 0 disables
+	failures    int     // Failed requests
+	tried       int     // Files downloaded or failed
+	failed      int
+	exhausted   string // Why downloads stopped, empty while they go on
+}
+
+// Fail counts a failed request, whether the file is retried or not.
+func (b *retryBudget) Fail() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.check()
+}
+
+// Count records the outcome of a file.
+func (b *retryBudget) Count(status string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch status {
+	case "downloaded":
+		b.tried++
+	case "failed", "quarantined":
+		b.tried++
+		b.failed++
+		b.failures++
+	}
+	b.check()
+}
+
+func (b *retryBudget) check() {
+	if b.exhausted != "" {
+		return
+	}
+	switch {
+	case b.maxFailures > 0 && b.failures >= b.maxFailures:
+		b.exhausted = fmt.Sprintf("%d failed requests (--max-failures %d)", b.failures, b.maxFailures)
+	case b.maxRate > 0 && b.tried >= budgetMinFiles && float64(b.failed)*100 > b.maxRate*float64(b.tried):
+		b.exhausted = fmt.Sprintf("%d of %d files failed (--max-failure-rate %g)", b.failed, b.tried, b.maxRate)
+	default:
+		return
+	}
+	fmt.Printf("[!] Downloads keep failing, %s. Stopping downloads.\n", b.exhausted)
+}
+
+// Reset starts counting again, at the start of a monitor check.
+func (b *retryBudget) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures, b.tried, b.failed = 0, 0, 0
+}
+
+// Exhausted returns why downloads stopped, or "" while they go on.
+func (b *retryBudget) Exhausted() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.exhausted
+}
+
+// downloadAttempts is how many times a file is requested while the host
+// answers HTTP 429 or 503, or sends it empty, before giving up on it.
+const downloadAttempts = 5
+
+// errEmptyResponse is reported for a file the media host keeps sending empty.
+var errEmptyResponse = errors.New("the server sent an empty file")
+
+// emptyBody reports whether a response has no body, peeking at it when its
+// length isn't known.
+func emptyBody(resp *http.Response) bool {
+	if resp.ContentLength >= 0 {
+		return resp.ContentLength == 0
+	}
+	body := bufio.NewReader(resp.Body)
+	_, err := body.Peek(1)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, resp.Body}
+	return err == io.EOF
+}
+
+// hostBackoff is the backoff state of every host, shared by all downloads so
+// that when a host starts answering HTTP 429 or 503 the whole queue waits for
+// it together, instead of each download sleeping and retrying on its own.
+type hostBackoff struct {
+	mu    sync.Mutex
+	hosts map[string]*backoffState
+}
+
+type backoffState struct {
+	failures int
+	until    time.Time
+}
+
+// throttled reports whether a status asks the client to slow down.
+func throttled(status int) bool {
+	return status == 429 || status == 503
+}
+
+// Wait blocks until host can be requested again.
+func (b *hostBackoff) Wait(host string) {
+	for {
+		b.mu.Lock()
+		var delay time.Duration
+		if state := b.hosts[host]; state != nil {
+			delay = time.Until(state.until)
+		}
+		b.mu.Unlock()
+		if delay <= 0 {
+			return
+		}
+		time.Sleep(delay)
+	}
+}
+
+// Fail backs host off after a throttled response, doubling the delay on each
+// failure from 2 seconds up to 2 minutes, or for as long as the server's
+// Retry-After says. Responses to requests already in flight when the backoff
+// started don't extend it.
+func (b *hostBackoff) Fail(host, retryAfter string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.hosts[host]
+	if state == nil {
+		state = &backoffState{}
+		b.hosts[host] = state
+	}
+	if time.Now().Before(state.until) {
+		return
+	}
+	state.failures++
+	delay := 2 * time.Second << (state.failures - 1)
+	if delay > 2*time.Minute || delay <= 0 {
+		delay = 2 * time.Minute
+	}
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && time.Duration(seconds)*time.Second > delay {
+		delay = time.Duration(seconds) * time.Second
+	}
+	state.until = time.Now().Add(delay)
+	fmt.Printf("[!] %s is rate-limiting downloads, waiting %s before the next request\n", host, delay)
+}
+
+// Succeed resets the backoff of host after a response that wasn't throttled.
+func (b *hostBackoff) Succeed(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.hosts, host)
+}
+
+// urlHost returns the host of rawURL, or rawURL itself if it doesn't parse.
+func urlHost(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		return u.Host
+	}
+	return rawURL
+}
+
+func downloadFile(wg *sync.WaitGroup, file *File, fileName string, path string, client *http.Client) {
+	defer wg.Done()
+
+	url := file.URL
+	filePath := path + "/" + fileName
+	keep, known := keepExisting(file, filePath)
+	if keep {
+		setStatus(url, "exists", 0, "")
+		return
+	}
+	if bans.Banned() || budget.Exhausted() != "" {
+		setUntried(url)
+		return
+	}
+	client = bans.Client(client)
+	events.Started(url, file.Size)
+	// The file keeps the URL published by the site, only requests go to the --media-host
+	fetchURL := rewriteMediaHost(url)
+
+	if chunkThreshold > 0 && chunkCount > 1 && file.Size >= chunkThreshold {
+		writePath := stagingPath(filePath)
+		sum, err := downloadChunked(client, fetchURL, writePath, file.Size, events.Meter(url, file.Size))
+		if err == nil {
+			err = moveIntoPlace(writePath, filePath)
+		}
+		if err == nil {
+			if reason := badDownload(file, sum, file.Size, ""); reason != "" {
+				quarantine(file, filePath, reason)
+				return
+			}
+			finishDownload(file, fileName, filePath, sum, file.Size)
+			return
+		}
+		if err != errNoRanges {
+			fmt.Printf("[!] Error downloading %s in chunks, retrying in one piece: %v\n", fileName, err)
+			budget.Fail()
+		}
+	}
+
+	host := urlHost(fetchURL)
+	var resp *http.Response
+	empty := false // A 200 without a body, as CDNs sometimes send
+	for attempt := 1; ; attempt++ {
+		throttle.Wait(host)
+		var err error
+		resp, err = client.Get(fetchURL)
+		if err != nil {
+			printError("Error downloading file", err)
+			setFailed(url, err)
+			return
+		}
+		if throttled(resp.StatusCode) {
+			throttle.Fail(host, resp.Header.Get("Retry-After"))
+		} else {
+			throttle.Succeed(host)
+			if empty = resp.StatusCode == 200 && emptyBody(resp); !empty {
+				break
+			}
+		}
+		if attempt == downloadAttempts || budget.Exhausted() != "" {
+			break
+		}
+		budget.Fail()
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096)) // Lets the connection be reused
+		resp.Body.Close()
+		if empty {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	defer resp.Body.Close()
+	bans.Record(resp.Request.URL.Host, resp.StatusCode)
+
+	if empty {
+		printError("Error downloading "+fileName, errEmptyResponse)
+		setFailed(url, errEmptyResponse)
+		return
+	}
+
+	if resp.StatusCode != 404 && resp.StatusCode == 200 {
+		// Without size or MD5 from the site, --update compares against the response size
+		if info, err := os.Stat(filePath); known || err != nil || info.Size() != resp.ContentLength {
+			writePath := stagingPath(filePath)
+			img, err := os.Create(writePath)
+			if err != nil {
+				printError("Error creating file", err)
+				setFailed(url, err)
+				return
+			}
+
+			hasher := md5.New()
+			buf := bufio.NewWriterSize(img, writeBufferSize)
+			size := file.Size
+			if size == 0 {
+				size = resp.ContentLength
+			}
+			if size >= preallocMinSize {
+				if err := preallocate(img, size); err != nil {
+					img.Close()
+					os.Remove(writePath)
+					printError("Error creating "+fileName, err)
+					setFailed(url, err)
+					return
+				}
+			}
+			b, err := io.Copy(io.MultiWriter(buf, hasher, meter, bandwidth, events.Meter(url, size)), resp.Body)
+			if err == nil {
+				err = buf.Flush()
+			}
+			if err == nil && fsyncMode {
+				err = img.Sync()
+			}
+			if errClose := img.Close(); err == nil {
+				err = errClose
+			}
+			if errMove := moveIntoPlace(writePath, filePath); errMove != nil {
+				printError("Error moving file into the archive", errMove)
+				os.Remove(writePath)
+				setFailed(url, errMove)
+				return
+			}
+			if err != nil {
+				printError("Error copying response body", err)
+				quarantine(file, filePath, fmt.Sprintf("truncated: %v after %d bytes", err, b))
+				return
+			}
+
+			sum := hex.EncodeToString(hasher.Sum(nil))
+			if reason := badDownload(file, sum, b, resp.Header.Get("Content-Type")); reason != "" {
+				quarantine(file, filePath, reason)
+				return
+			}
+			finishDownload(file, fileName, filePath, sum, b)
+		} else {
+			setStatus(url, "exists", 0, "")
+		}
+	} else {
+		err := &httpError{Status: resp.StatusCode, URL: url}
+		printError("Error downloading file", err)
+		setFailed(url, err)
+	}
+}
+
+// writeBufferSize is the size of the buffer downloads are written through.
+const writeBufferSize = 1 << 20
+
+// preallocMinSize is the size from which the disk space of a download of known
+// size is reserved before it starts.
+const preallocMinSize = 1 << 20
+
+// preallocate reserves size bytes of disk space for f without changing its
+// size, failing if the disk doesn't have them, so a full disk stops a download
+// before it starts rather than halfway. It does nothing but on Linux, where
+// prealloc_linux.go replaces it.
+var preallocate = func(f *os.File, size int64) error { return nil }
+
+// stagingPath is where a download for filePath is written: filePath itself,
+// or with --direct-temp-dir a file of that folder named after filePath.
+func stagingPath(filePath string) string {
+	if tempDir == "" {
+		return filePath
+	}
+	sum := md5.Sum([]byte(filePath))
+	return filepath.Join(tempDir, hex.EncodeToString(sum[:6])+"-"+filepath.Base(filePath))
+}
+
+// moveIntoPlace moves a finished download from its staging path to dst,
+// copying it when they are on different filesystems, such as a local disk and
+// a NAS. With --fsync, the copy and the folder entry are flushed to disk too.
+func moveIntoPlace(src, dst string) error {
+	if src != dst {
+		if err := os.Rename(src, dst); err != nil {
+			if err := copyFile(src, dst); err != nil {
+				os.Remove(dst)
+				return err
+			}
+			os.Remove(src)
+		}
+	}
+	if fsyncMode {
+		// Folders can't be synced on Windows, where closing is enough
+		if dir, err := os.Open(filepath.Dir(dst)); err == nil {
+			dir.Sync()
+			dir.Close()
+		}
+	}
+	return nil
+}
+
+// copyFile copies src to dst, a new file.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil && fsyncMode {
+		err = out.Sync()
+	}
+	if errClose := out.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// permissions are the --chmod mode and --chown owner given to the files and
+// folders 4cget creates in the archive, so a web server can serve them.
+type permissions struct {
+	mode     os.FileMode // Mode of files, 0 to leave it; folders also get x where r is set
+	uid, gid int         // -1 to leave them
+}
+
+// parsePermissions reads --chmod (an octal mode such as 0644) and --chown
+// (user, user:group or :group, by name or number). It returns nil when
+// neither is given.
+func parsePermissions(mode, owner string) (*permissions, error) {
+	if mode == "" && owner == "" {
+		return nil, nil
+	}
+	p := &permissions{uid: -1, gid: -1}
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0777 {
+			return nil, fmt.Errorf("invalid --chmod %q, expected an octal mode such as 0644", mode)
+		}
+		p.mode = os.FileMode(m)
+	}
+	if owner == "" {
+		return p, nil
+	}
+	if runtime.GOOS == "windows" {
+		return nil, errors.New("--chown is not supported on Windows")
+	}
+	name, group, _ := strings.Cut(owner, ":")
+	if name != "" {
+		id := name
+		if u, err := user.Lookup(name); err == nil {
+			id = u.Uid
+		}
+		uid, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("unknown --chown user %q", name)
+		}
+		p.uid = uid
+	}
+	if group != "" {
+		id := group
+		if g, err := user.LookupGroup(group); err == nil {
+			id = g.Gid
+		}
+		gid, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("unknown --chown group %q", group)
+		}
+		p.gid = gid
+	}
+	return p, nil
+}
+
+// Apply sets the permissions of everything in dir, and of the folders between
+// root and dir. Symbolic links are left alone.
+func (p *permissions) Apply(root, dir string) error {
+	if p == nil {
+		return nil
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return p.set(path, info)
+	})
+	for parent := filepath.Dir(dir); err == nil && parent != root && strings.HasPrefix(parent, root); parent = filepath.Dir(parent) {
+		var info os.FileInfo
+		if info, err = os.Lstat(parent); err == nil {
+			err = p.set(parent, info)
+		}
+	}
+	return err
+}
+
+func (p *permissions) set(path string, info os.FileInfo) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	if p.mode != 0 {
+		mode := p.mode
+		if info.IsDir() {
+			mode |= (mode & 0444) >> 2
+		}
+		if info.Mode().Perm() != mode {
+			if err := os.Chmod(path, mode); err != nil {
+				return err
+			}
+		}
+	}
+	if p.uid != -1 || p.gid != -1 {
+		return os.Lchown(path, p.uid, p.gid)
+	}
+	return nil
+}
+
+// quarantine moves a bad download out of the thread folder into .quarantine/,
+// under the same relative path and next to a .reason.txt saying what was wrong,
+// so it can be inspected instead of passing for a good file.
+func quarantine(file *File, filePath, reason string) {
+	rel, err := filepath.Rel(archiveRoot, filePath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(filePath)
+	}
+	dest := filepath.Join(archiveRoot, quarantineDir, rel)
+	os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+	if err := os.Rename(filePath, dest); err != nil {
+		os.Remove(filePath)
+	}
+	note := fmt.Sprintf("%s\nURL: %s\nTime: %s\n", reason, file.URL, time.Now().Format(time.RFC3339))
+	ioutil.WriteFile(dest+".reason.txt", []byte(note), 0644)
+
+	printFile("Quarantined: %s - %s\n", filepath.Base(filePath), reason)
+	setStatus(file.URL, "quarantined", 0, "")
+}
+
+// badDownload checks a finished download against what the site and the server
+// said about it, and returns why it is bad or "" if it looks right.
+func badDownload(file *File, sum string, b int64, contentType string) string {
+	if file.Size != 0 && b != file.Size {
+		return fmt.Sprintf("truncated: got %d of %d bytes", b, file.Size)
+	}
+	if file.MD5 != "" && sum != file.MD5 {
+		return fmt.Sprintf("corrupted: MD5 %s, expected %s", sum, file.MD5)
+	}
+	// A block page or error served with a 200 instead of the media
+	expected := mime.TypeByExtension(filepath.Ext(file.URL))
+	got, _, _ := mime.ParseMediaType(contentType)
+	if expected != "" && got != "" && got != "application/octet-stream" && strings.Split(got, "/")[0] != strings.Split(expected, "/")[0] {
+		return fmt.Sprintf("content type mismatch: got %s, expected %s", got, expected)
+	}
+	return ""
+}
+
+// finishDownload applies the blocklist and dedupe checks to a freshly written
+// file, records it in the dedupe index and reports it.
+func finishDownload(file *File, fileName, filePath, sum string, b int64) {
+	var url string
+	if file.MD5 == "" {
+		url = file.URL
+	}
+	reject, label, score, err := classifier.Check(filePath, sum, url)
+	if err != nil {
+		printError("Error classifying "+fileName, err)
+	}
+	if reject {
+		os.Remove(filePath)
+		printFile("Classified file removed: %s - %s (%.2f)\n", fileName, label, score)
+		setStatus(file.URL, "classified", b, sum)
+		return
+	}
+	if blocklist.BlocksMD5(sum) {
+		os.Remove(filePath)
+		printFile("Blocked file removed: %s - MD5 %s is in the blocklist\n", fileName, sum)
+		setStatus(file.URL, "blocked", b, sum)
+		return
+	}
+	if history != nil {
+		if dup, found := history.Duplicate(sum, filepath.Clean(filePath)); dedupeMode && found {
+			os.Remove(filePath)
+			printFile("Duplicate skipped: %s - Already archived at %s\n", fileName, dup.Path)
+			setStatus(file.URL, "duplicate", b, sum)
+			return
+		}
+		entry := HistoryEntry{MD5: sum, Path: filePath, URL: file.URL, Size: b, Time: time.Now()}
+		if err := history.Add(entry); err != nil {
+			printError("Error updating dedupe index", err)
+		}
+	}
+	feed.Add(file, fileName, filePath, b)
+	setStatus(file.URL, "downloaded", b, sum)
+
+	printFile("File downloaded: %s - Size: %s\n", fileName, formatBytes(b))
+	if xattrMode {
+		if err := setXattrs(filePath, map[string]string{"user.xdg.origin.url": file.URL, "user.checksum.md5": sum}); err != nil {
+			printError("Error setting extended attributes of "+fileName, err)
+		}
+	}
+	sources.Add(file.URL, filePath)
+	if err := runFileSteps(fileSteps, filePath); err != nil {
+		printError("Error post-processing "+fileName, err)
+	}
+	// Image source lookups read the file later, the end of the check encrypts it then
+	if archiveKey != nil && sources == nil {
+		if err := encryptFile(filePath); err != nil {
+			printError("Error encrypting "+fileName, err)
+		}
+	}
+}
+
+// setXattr sets an extended attribute of a file. It is nil on the systems
+// without them; Linux and macOS set it up in their own files.
+var setXattr func(path, name string, value []byte) error
+
+// setXattrs sets extended attributes on a file, named like those wget and
+// browsers write (user.xdg.origin.url), so where a file came from can be told
+// later without sidecar files.
+func setXattrs(path string, attrs map[string]string) error {
+	for name, value := range attrs {
+		if value == "" {
+			continue
+		}
+		if err := setXattr(path, name, []byte(value)); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// processedDir is the subfolder of the thread folder where the post-processing
+// steps write the files they make, the downloaded files being left untouched.
+const processedDir = "processed"
+
+// processStep is a step of a --post-process or --thread-process chain, such as
+// "convert png" or "exec <command>".
+type processStep struct {
+	name, arg string
+}
+
+// parseSteps reads a post-processing chain, allowing the steps in allowed.
+func parseSteps(values []string, allowed ...string) ([]processStep, error) {
+	var steps []processStep
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		name, arg := value, ""
+		if i := strings.IndexAny(value, " \t"); i >= 0 {
+			name, arg = value[:i], strings.TrimSpace(value[i+1:])
+		}
+		known := false
+		for _, a := range allowed {
+			known = known || a == name
+		}
+		switch {
+		case !known:
+			return nil, fmt.Errorf("unknown step %q (use %s)", name, strings.Join(allowed, ", "))
+		case name == "convert" && arg != "png" && arg != "jpeg":
+			return nil, fmt.Errorf("convert needs a format, 'png' or 'jpeg'")
+		case name == "exec" && arg == "":
+			return nil, fmt.Errorf("exec needs a command")
+		}
+		steps = append(steps, processStep{name, arg})
+	}
+	return steps, nil
+}
+
+// runFileSteps runs the chain on a downloaded file. Each step works on what the
+// previous one made: strip-exif and convert write to the processed subfolder,
+// hash writes a .sha256 file next to its input and exec runs a command where
+// {path} is the input, {original} the downloaded file and {name} its name.
+func runFileSteps(steps []processStep, filePath string) error {
+	current := filePath
+	out := filepath.Join(filepath.Dir(filePath), processedDir)
+	for _, step := range steps {
+		var err error
+		switch step.name {
+		case "strip-exif":
+			current, err = stripEXIFFile(current, out)
+		case "convert":
+			current, err = convertImage(current, out, step.arg)
+		case "hash":
+			var data []byte
+			if data, err = ioutil.ReadFile(current); err == nil {
+				sum := sha256.Sum256(data)
+				err = ioutil.WriteFile(current+".sha256", []byte(hex.EncodeToString(sum[:])+"  "+filepath.Base(current)+"\n"), 0644)
+			}
+		case "exec":
+			err = runStepCommand(step.arg, filepath.Dir(filePath), map[string]string{"path": current, "original": filePath, "name": filepath.Base(filePath)})
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", step.name, err)
+		}
+	}
+	return nil
+}
+
+// stripEXIFFile writes a copy of a JPEG file without its APP1 (EXIF and XMP)
+// segments to dir. Other files are returned as they are.
+func stripEXIFFile(path, dir string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return path, nil // Not a JPEG
+	}
+	stripped := []byte{0xFF, 0xD8}
+	for i := 2; ; {
+		if i+4 > len(data) || data[i] != 0xFF {
+			return "", errors.New("invalid JPEG")
+		}
+		marker := data[i+1]
+		if marker == 0xDA { // Start of scan, the image data follows
+			stripped = append(stripped, data[i:]...)
+			break
+		}
+		end := i + 2 + (int(data[i+2])<<8 | int(data[i+3]))
+		if end > len(data) {
+			return "", errors.New("invalid JPEG")
+		}
+		if marker != 0xE1 {
+			stripped = append(stripped, data[i:end]...)
+		}
+		i = end
+	}
+	os.MkdirAll(dir, os.ModePerm)
+	out := filepath.Join(dir, filepath.Base(path))
+	return out, ioutil.WriteFile(out, stripped, 0644)
+}
+
+// convertImage writes a copy of a JPEG, PNG or GIF image in format ("png" or
+// "jpeg") to dir. Other files, such as videos, are returned as they are.
+func convertImage(path, dir, format string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err == image.ErrFormat {
+		return path, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	os.MkdirAll(dir, os.ModePerm)
+	ext := ".png"
+	if format == "jpeg" {
+		ext = ".jpg"
+	}
+	out := filepath.Join(dir, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))+ext)
+	w, err := os.Create(out)
+	if err != nil {
+		return "", err
+	}
+	if format == "jpeg" {
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: 95})
+	} else {
+		err = png.Encode(w, img)
+	}
+	if errClose := w.Close(); err == nil {
+		err = errClose
+	}
+	return out, err
+}
+
+// runStepCommand runs an exec step through the shell from dir, replacing the
+// {name} placeholders of command with the values of vars, escaped.
+func runStepCommand(command, dir string, vars map[string]string) error {
+	cmd := stepCommand(command, dir, vars)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// shellCommand prepares command to run through the shell. On Windows, cmd
+// with delayed expansion, which happens once cmd has parsed the line so the
+// values of expandCommand are never parsed.
+var shellCommand = func(command string) *exec.Cmd { return exec.Command("sh", "-c", command) }
+
+// stepCommand prepares a shell command like runStepCommand.
+func stepCommand(command, dir string, vars map[string]string) *exec.Cmd {
+	command, env := expandCommand(command, vars, runtime.GOOS == "windows")
+	cmd := shellCommand(command)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Dir = dir
+	return cmd
+}
+
+// expandCommand replaces the {name} placeholders of command with the values of
+// vars, escaped for the quotes they are in: none, '...' or "...". For cmd on
+// Windows, which has no way to escape % inside quotes, the values go to
+// environment variables, returned, that the command reads with delayed
+// expansion (!FOURCGET_STEP_PATH!).
+func expandCommand(command string, vars map[string]string, windows bool) (string, []string) {
+	var b strings.Builder
+	var env []string
+	used := make(map[string]bool)
+	var quote byte // Quote the text is in, 0 outside quotes
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		if end := strings.IndexByte(command[i:], '}'); c == '{' && end > 0 {
+			if v, ok := vars[command[i+1:i+end]]; ok {
+				name := command[i+1 : i+end]
+				i += end
+				switch {
+				case windows:
+					variable := "FOURCGET_STEP_" + strings.ToUpper(name)
+					if !used[name] {
+						used[name] = true
+						env = append(env, variable+"="+v)
+					}
+					if quote == 0 {
+						b.WriteString(`"!` + variable + `!"`)
+					} else {
+						b.WriteString("!" + variable + "!")
+					}
+				case quote == '\'':
+					b.WriteString(strings.ReplaceAll(v, "'", `'\''`))
+				case quote == '"':
+					b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(v))
+				default:
+					b.WriteString("'" + strings.ReplaceAll(v, "'", `'\''`) + "'")
+				}
+				continue
+			}
+		}
+		switch {
+		case c == '\\' && !windows && quote != '\'' && i+1 < len(command):
+			// An escaped character doesn't open nor close quotes
+			b.WriteByte(c)
+			i++
+			c = command[i]
+		case quote == 0 && (c == '"' || (c == '\'' && !windows)):
+			quote = c
+		case c == quote:
+			quote = 0
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), env
+}
+
+const sauceNAOAPI = "https://saucenao.com/search.php"
+const sauceNAOInterval = 8 * time.Second // Free keys allow 4 searches every 30 seconds
+
+// sourceInfo is the best reverse image search match of a file, saved next to
+// it as <file>.source.json.
+type sourceInfo struct {
+	Similarity float64  `json:"similarity"`
+	Index      string   `json:"index,omitempty"` // Database of the match, e.g. Danbooru or Pixiv
+	Title      string   `json:"title,omitempty"`
+	Artist     string   `json:"artist,omitempty"`
+	URLs       []string `json:"urls,omitempty"`
+	Source     string   `json:"source,omitempty"`
+}
+
+// SourceLookup looks up the source and artist of downloaded images on
+// SauceNAO, one at a time and spaced by sauceNAOInterval, in the background so
+// downloads don't wait for it. SauceNAO fetches the images from the site.
+type SourceLookup struct {
+	client  *http.Client
+	key     string
+	min     float64 // Minimum similarity, in percent
+	mu      sync.Mutex
+	pending []sourceJob
+	wake    chan struct{}
+	wg      sync.WaitGroup
+}
+
+type sourceJob struct {
+	url, path string
+}
+
+func newSourceLookup(client *http.Client, key string, min float64) *SourceLookup {
+	l := &SourceLookup{client: client, key: key, min: min, wake: make(chan struct{}, 1)}
+	go l.run()
+	return l
+}
+
+// Add queues a downloaded file. Videos and other files aren't looked up.
+func (l *SourceLookup) Add(fileURL, filePath string) {
+	if l == nil {
+		return
+	}
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp":
+	default:
+		return
+	}
+	l.wg.Add(1)
+	l.mu.Lock()
+	l.pending = append(l.pending, sourceJob{fileURL, filePath})
+	l.mu.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Wait blocks until every queued file was looked up.
+func (l *SourceLookup) Wait() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if n := len(l.pending); n > 0 {
+		fmt.Printf("[*] LOOKING UP THE SOURCE OF %d FILES ON SAUCENAO [*]\n", n)
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+}
+
+func (l *SourceLookup) run() {
+	stopped := false // Once the key is rejected or out of searches
+	var next time.Time
+	for range l.wake {
+		for {
+			l.mu.Lock()
+			if len(l.pending) == 0 {
+				l.mu.Unlock()
+				break
+			}
+			job := l.pending[0]
+			l.pending = l.pending[1:]
+			l.mu.Unlock()
+
+			if !stopped {
+				time.Sleep(time.Until(next))
+				next = time.Now().Add(sauceNAOInterval)
+				info, err := l.lookup(job.url)
+				if err == nil && info != nil {
+					var data []byte
+					if data, err = json.MarshalIndent(info, "", "  "); err == nil {
+						err = ioutil.WriteFile(job.path+".source.json", append(data, '\n'), 0644)
+					}
+				}
+				var status *httpError
+				if errors.As(err, &status) && (status.Status == http.StatusTooManyRequests || status.Status == http.StatusForbidden) {
+					stopped = true
+					err = fmt.Errorf("%v, no more lookups this run", err)
+				}
+				if err != nil {
+					printError("Error looking up "+filepath.Base(job.path)+" on SauceNAO", err)
+				}
+			}
+			l.wg.Done()
+		}
+	}
+}
+
+// lookup returns the best SauceNAO match of an image URL, nil if none is similar
+// enough.
+func (l *SourceLookup) lookup(imageURL string) (*sourceInfo, error) {
+	query := url.Values{"output_type": {"2"}, "numres": {"1"}, "api_key": {l.key}, "url": {imageURL}}
+	resp, err := l.client.Get(sauceNAOAPI + "?" + query.Encode())
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = sauceNAOAPI // Keep the API key out of the error
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpError{Status: resp.StatusCode, URL: sauceNAOAPI}
+	}
+	var answer struct {
+		Header struct {
+			Status  int    `json:"status"`
+			Message string `json:"message"`
+		} `json:"header"`
+		Results []struct {
+			Header struct {
+				Similarity string `json:"similarity"`
+				IndexName  string `json:"index_name"`
+			} `json:"header"`
+			Data struct {
+				ExtURLs    []string        `json:"ext_urls"`
+				Title      string          `json:"title"`
+				Source     string          `json:"source"`
+				Creator    json.RawMessage `json:"creator"` // A name or a list of names
+				MemberName string          `json:"member_name"`
+				AuthorName string          `json:"author_name"`
+			} `json:"data"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, err
+	}
+	if answer.Header.Status != 0 {
+		return nil, fmt.Errorf("SauceNAO: %s", postText(answer.Header.Message))
+	}
+	if len(answer.Results) == 0 {
+		return nil, nil
+	}
+	best := answer.Results[0]
+	similarity, _ := strconv.ParseFloat(best.Header.Similarity, 64)
+	if similarity < l.min {
+		return nil, nil
+	}
+	info := &sourceInfo{Similarity: similarity, Index: best.Header.IndexName, Title: best.Data.Title, URLs: best.Data.ExtURLs, Source: best.Data.Source}
+	var creators []string
+	if json.Unmarshal(best.Data.Creator, &info.Artist) != nil && json.Unmarshal(best.Data.Creator, &creators) == nil {
+		info.Artist = strings.Join(creators, ", ")
+	}
+	for _, name := range []string{best.Data.MemberName, best.Data.AuthorName} {
+		if info.Artist == "" {
+			info.Artist = name
+		}
+	}
+	return info, nil
+}
+
+const classifiedFile = ".4cget/classified.txt" // Files rejected by --classify, relative to the archive root
+
+// Classifier runs the --classify command on downloaded files and rejects those
+// it labels with one of the skipped categories. Rejected MD5s are written to
+// .4cget/classified.txt, followed by the file URL on sites that don't publish
+// MD5s, so they aren't downloaded and classified again.
+type Classifier struct {
+	command   string
+	skip      map[string]bool
+	threshold float64
+	path      string
+	mu        sync.Mutex
+	md5s      map[string]bool
+	urls      map[string]bool
+}
+
+func openClassifier(root, command string, skip []string, threshold float64) (*Classifier, error) {
+	c := &Classifier{command: command, skip: make(map[string]bool), threshold: threshold, path: filepath.Join(root, classifiedFile)}
+	for _, label := range skip {
+		c.skip[strings.ToLower(strings.TrimSpace(label))] = true
+	}
+	c.md5s, c.urls = make(map[string]bool), make(map[string]bool)
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if sum, err := normalizeMD5(fields[0]); err == nil {
+			c.md5s[sum] = true
+		}
+		if len(fields) > 1 {
+			c.urls[fields[1]] = true
+		}
+	}
+	return c, scanner.Err()
+}
+
+// Rejects reports whether a file was rejected before, by its hex MD5 or, when
+// the site doesn't publish one, by its URL.
+func (c *Classifier) Rejects(sum, url string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sum != "" {
+		return c.md5s[sum]
+	}
+	return c.urls[url]
+}
+
+// Classify runs the command on a file, {path} being replaced by its path. The
+// command prints one "<category> [score]" line per category it recognizes, the
+// score defaulting to 1; the highest scoring one is returned.
+func (c *Classifier) Classify(filePath string) (label string, score float64, err error) {
+	out, err := stepCommand(c.command, filepath.Dir(filePath), map[string]string{"path": filePath}).Output()
+	if err != nil {
+		return "", 0, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		s := 1.0
+		if len(fields) > 1 {
+			if s, err = strconv.ParseFloat(fields[1], 64); err != nil {
+				return "", 0, fmt.Errorf("invalid score in %q", line)
+			}
+		}
+		if label == "" || s > score {
+			label, score = strings.ToLower(fields[0]), s
+		}
+	}
+	return label, score, nil
+}
+
+// Check classifies a downloaded file and reports whether it must be rejected,
+// recording it if so. url is recorded along with the MD5 when not empty.
+func (c *Classifier) Check(filePath, sum, url string) (reject bool, label string, score float64, err error) {
+	if c == nil {
+		return false, "", 0, nil
+	}
+	if label, score, err = c.Classify(filePath); err != nil || !c.skip[label] || score < c.threshold {
+		return false, label, score, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.md5s[sum] = true
+	entry := sum
+	if url != "" {
+		c.urls[url] = true
+		entry += " " + url
+	}
+	os.MkdirAll(filepath.Dir(c.path), os.ModePerm)
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return true, label, score, err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s # %s %.2f %s\n", entry, label, score, filepath.Base(filePath))
+	return true, label, score, err
+}
+
+// errNoRanges is returned by downloadChunked when the server ignores Range requests.
+var errNoRanges = errors.New("server doesn't support ranged downloads")
+
+// downloadChunked downloads a file of known size as --chunks concurrent byte
+// ranges written straight into place, and returns its hex MD5.
+func downloadChunked(client *http.Client, url, filePath string, size int64, progress io.Writer) (string, error) {
+	img, err := os.Create(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer img.Close()
+	if err := preallocate(img, size); err != nil {
+		return "", err
+	}
+	if err := img.Truncate(size); err != nil {
+		return "", err
+	}
+
+	chunk := (size + int64(chunkCount) - 1) / int64(chunkCount)
+	errs := make(chan error, chunkCount)
+	var chunks sync.WaitGroup
+	for start := int64(0); start < size; start += chunk {
+		end := start + chunk
+		if end > size {
+			end = size
+		}
+		chunks.Add(1)
+		go func(start, end int64) {
+			defer chunks.Done()
+			errs <- downloadRange(client, url, img, start, end, progress)
+		}(start, end)
+	}
+	chunks.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			img.Close()
+			os.Remove(filePath)
+			return "", err
+		}
+	}
+
+	if fsyncMode {
+		if err := img.Sync(); err != nil {
+			return "", err
+		}
+	}
+
+	// Hash once every range is in place
+	if _, err := img.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, img); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// downloadRange downloads the bytes [start, end) of url into img at the same
+// offset, also copying them to progress.
+func downloadRange(client *http.Client, url string, img *os.File, start, end int64, progress io.Writer) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+
+	throttle.Wait(req.URL.Host)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if throttled(resp.StatusCode) {
+		throttle.Fail(req.URL.Host, resp.Header.Get("Retry-After"))
+	}
+
+	if resp.StatusCode == 200 {
+		return errNoRanges
+	}
+	if resp.StatusCode != 206 {
+		return fmt.Errorf("received HTTP %d", resp.StatusCode)
+	}
+
+	n, err := io.Copy(io.MultiWriter(io.NewOffsetWriter(img, start), meter, bandwidth, progress), io.LimitReader(resp.Body, end-start))
+	if err != nil {
+		return err
+	}
+	if n != end-start {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// netOptions configures the transport shared by every request.
+type netOptions struct {
+	Proxy    *url.URL
+	MaxConns int
+	Resolver string // DNS server (host or host:port), empty for the system resolver
+	DoH      string // DNS-over-HTTPS endpoint, empty to resolve normally
+	Network  string // "tcp4" or "tcp6" to force an address family, empty for either
+	TLS      *tls.Config
+}
+
+// newTLSConfig builds the TLS settings from --tls-min, --ca-file and --insecure.
+func newTLSConfig(minVersion, caFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+
+	switch minVersion {
+	case "":
+	case "1.0":
+		config.MinVersion = tls.VersionTLS10
+	case "1.1":
+		config.MinVersion = tls.VersionTLS11
+	case "1.2":
+		config.MinVersion = tls.VersionTLS12
+	case "1.3":
+		config.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unknown TLS version %q (use 1.0, 1.1, 1.2 or 1.3)", minVersion)
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		// Trust the extra CAs on top of the system ones
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// newHTTPClient builds the client shared by every request 4cget makes, so
+// connections are pooled and reused across thread pages and downloads.
+func newHTTPClient(opts netOptions) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if opts.Resolver != "" {
+		server := opts.Resolver
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       opts.TLS,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   opts.MaxConns,
+		MaxConnsPerHost:       opts.MaxConns,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 2 * time.Minute, // A stalled server mustn't hold a worker forever
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if opts.Proxy != nil {
+		transport.Proxy = http.ProxyURL(opts.Proxy)
+	}
+
+	if opts.DoH != "" {
+		// The DoH server itself is reached through a plain copy of the transport
+		doh := &dohResolver{
+			endpoint: opts.DoH,
+			client:   &http.Client{Transport: transport.Clone(), Timeout: 10 * time.Second},
+			cache:    make(map[string]dohAnswer),
+		}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil || net.ParseIP(host) != nil {
+				return dialer.DialContext(ctx, network, addr)
+			}
+			ips, err := doh.lookup(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range ips {
+				var conn net.Conn
+				conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+				if err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		}
+	}
+
+	if opts.Network != "" {
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx, opts.Network, addr)
+		}
+	}
+	return &http.Client{Transport: transport}
+}
+
+// dohResolver resolves host names with DNS-over-HTTPS (RFC 8484).
+type dohResolver struct {
+	endpoint string
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[string]dohAnswer
+}
+
+// dohAnswer is a cached lookup result.
+type dohAnswer struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// lookup returns the IPv4 and IPv6 addresses of host.
+func (r *dohResolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	answer, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(answer.expires) {
+		return answer.ips, nil
+	}
+
+	answer = dohAnswer{expires: time.Now().Add(time.Hour)}
+	for _, qtype := range []uint16{1, 28} { // A, AAAA
+		ips, ttl, err := r.query(ctx, host, qtype)
+		if err != nil {
+			return nil, err
+		}
+		answer.ips = append(answer.ips, ips...)
+		if expires := time.Now().Add(ttl); len(ips) > 0 && expires.Before(answer.expires) {
+			answer.expires = expires
+		}
+	}
+	if len(answer.ips) == 0 {
+		return nil, fmt.Errorf("DoH: no addresses found for %s", host)
+	}
+
+	r.mu.Lock()
+	r.cache[host] = answer
+	r.mu.Unlock()
+	return answer.ips, nil
+}
+
+// query sends a single DNS question and returns the addresses in the answer.
+func (r *dohResolver) query(ctx context.Context, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	// Header: ID 0, recursion desired, one question
+	msg := []byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", r.endpoint, bytes.NewReader(msg))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("DoH: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, 0, fmt.Errorf("DoH: server returned HTTP %d", resp.StatusCode)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseDNSAnswer(b)
+}
+
+// parseDNSAnswer extracts the A and AAAA records from a DNS response message.
+func parseDNSAnswer(b []byte) ([]net.IP, time.Duration, error) {
+	errMalformed := errors.New("DoH: malformed DNS response")
+	if len(b) < 12 {
+		return nil, 0, errMalformed
+	}
+	if rcode := b[3] & 0x0f; rcode != 0 && rcode != 3 { // 3 is NXDOMAIN
+		return nil, 0, fmt.Errorf("DoH: DNS error code %d", rcode)
+	}
+	questions := int(b[4])<<8 | int(b[5])
+	answers := int(b[6])<<8 | int(b[7])
+
+	// skipName skips a possibly compressed domain name starting at off
+	skipName := func(off int) int {
+		for off < len(b) {
+			switch {
+			case b[off] == 0:
+				return off + 1
+			case b[off]&0xc0 == 0xc0:
+				return off + 2
+			default:
+				off += int(b[off]) + 1
+			}
+		}
+		return len(b) + 1
+	}
+
+	off := 12
+	for i := 0; i < questions; i++ {
+		off = skipName(off) + 4
+	}
+
+	var ips []net.IP
+	ttl := time.Hour
+	for i := 0; i < answers; i++ {
+		off = skipName(off)
+		if off+10 > len(b) {
+			return nil, 0, errMalformed
+		}
+		rtype := int(b[off])<<8 | int(b[off+1])
+		rttl := time.Duration(uint32(b[off+4])<<24|uint32(b[off+5])<<16|uint32(b[off+6])<<8|uint32(b[off+7])) * time.Second
+		length := int(b[off+8])<<8 | int(b[off+9])
+		off += 10
+		if off+length > len(b) {
+			return nil, 0, errMalformed
+		}
+		if (rtype == 1 && length == 4) || (rtype == 28 && length == 16) {
+			ips = append(ips, net.IP(append([]byte(nil), b[off:off+length]...)))
+			if rttl < ttl {
+				ttl = rttl
+			}
+		}
+		off += length
+	}
+	return ips, ttl, nil
+}
+
+// startProfiling starts the hidden --pprof, --cpuprofile and --memprofile
+// diagnostics and returns a function that writes the profiles out.
+func startProfiling(pprofAddr, cpuPath, memPath string) func() {
+	if pprofAddr != "" {
+		// A mux of its own, so nothing else registered on the default one is served
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", httppprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+		if host, _, _ := net.SplitHostPort(pprofAddr); host != "localhost" && !net.ParseIP(host).IsLoopback() {
+			fmt.Println("[!] Warning: --pprof is reachable from other machines, anyone can read the memory and command line of 4cget")
+		}
+		go func() {
+			fmt.Printf("[*] PPROF LISTENING ON %s [*]\n", pprofAddr)
+			if err := http.ListenAndServe(pprofAddr, mux); err != nil {
+				fmt.Println("[!] Error serving pprof:", err)
+			}
+		}()
+	}
+
+	if cpuPath != "" {
+		f, err := os.Create(cpuPath)
+		if err != nil {
+			fail("Error creating CPU profile", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			fail("Error starting CPU profile", err)
+		}
+	}
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			if cpuPath != "" {
+				pprof.StopCPUProfile()
+			}
+			if memPath != "" {
+				f, err := os.Create(memPath)
+				if err != nil {
+					fmt.Println("[!] Error creating memory profile:", err)
+					return
+				}
+				defer f.Close()
+				runtime.GC() // Get up-to-date statistics
+				if err := pprof.WriteHeapProfile(f); err != nil {
+					fmt.Println("[!] Error writing memory profile:", err)
+				}
+			}
+		})
+	}
+	return stop
+}
+
+// stopping is closed by the first Ctrl+C of a monitor session, which then
+// stops at the end of the check in progress.
+var stopping = make(chan struct{})
+
+var stoppable int32 // Set while monitoring, accessed atomically
+
+// handleInterrupts handles Ctrl+C for the whole run. While monitoring, the
+// first one closes stopping, so the run ends normally after the check in
+// progress. Otherwise, or at the second one, the profiles and logs are
+// flushed and 4cget exits with status 130.
+func handleInterrupts() {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		for range interrupt {
+			select {
+			case <-stopping:
+			default:
+				if atomic.LoadInt32(&stoppable) != 0 {
+					close(stopping)
+					fmt.Println("\n[*] STOPPING, PRESS CTRL+C AGAIN TO QUIT NOW [*]")
+					continue
+				}
+			}
+			exitFlush()
+			os.Exit(130)
+		}
+	}()
+}
+
+// logBackups is how many rotated log files are kept, as <log>.1 (newest) to <log>.5.
+const logBackups = 5
+
+// rotatingLog is a log file that is rotated once it reaches maxSize bytes or
+// maxAge, when they are set.
+type rotatingLog struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	file    *os.File
+	size    int64
+	opened  time.Time
+}
+
+func openRotatingLog(path string, maxSize int64, maxAge time.Duration) (*rotatingLog, error) {
+	l := &rotatingLog{path: path, maxSize: maxSize, maxAge: maxAge}
+	return l, l.open()
+}
+
+func (l *rotatingLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.file, l.size, l.opened = f, 0, time.Now()
+	if info, err := f.Stat(); err == nil {
+		l.size = info.Size()
+		l.opened = info.ModTime()
+		if l.size == 0 {
+			l.opened = time.Now()
+		}
+	}
+	return nil
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	full := l.maxSize > 0 && l.size+int64(len(p)) > l.maxSize
+	old := l.maxAge > 0 && time.Since(l.opened) > l.maxAge
+	if l.size > 0 && (full || old) {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups up by one, dropping the oldest, and starts a new file.
+func (l *rotatingLog) rotate() error {
+	l.file.Close()
+	for i := logBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	os.Rename(l.path, l.path+".1")
+	return l.open()
+}
+
+// dialSyslog connects to the local syslog daemon (journald listens on it too).
+// log/syslog isn't available on Windows, where 4cget is also built.
+func dialSyslog() (net.Conn, error) {
+	for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+		if conn, err := net.Dial("unixgram", path); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, errors.New("no syslog socket found")
+}
+
+// startLogging copies everything 4cget prints to a log file and/or syslog, one
+// timestamped line at a time, while still printing it to the terminal. The
+// returned function flushes the log and must be called before exiting.
+func startLogging(path string, maxSize int64, maxAge time.Duration, useSyslog bool) (func(), error) {
+	var file *rotatingLog
+	var sys net.Conn
+	var err error
+	if path != "" {
+		if file, err = openRotatingLog(path, maxSize, maxAge); err != nil {
+			return nil, err
+		}
+	}
+	if useSyslog {
+		if sys, err = dialSyslog(); err != nil {
+			return nil, err
+		}
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	terminal := os.Stdout
+	os.Stdout = w
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var line []byte
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buf)
+			terminal.Write(buf[:n])
+			line = append(line, buf[:n]...)
+			for {
+				i := bytes.IndexByte(line, '\n')
+				if i < 0 {
+					break
+				}
+				text := strings.TrimSpace(string(line[:i]))
+				line = line[i+1:]
+				if text == "" {
+					continue
+				}
+				if file != nil {
+					fmt.Fprintf(file, "%s %s\n", time.Now().Format(time.RFC3339), text)
+				}
+				if sys != nil {
+					// Facility user, severity notice (or error for "[!]" lines)
+					priority := 13
+					if strings.HasPrefix(text, "[!]") {
+						priority = 11
+					}
+					fmt.Fprintf(sys, "<%d>%s 4cget[%d]: %s", priority, time.Now().Format(time.Stamp), os.Getpid(), text)
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			os.Stdout = terminal
+			w.Close()
+			<-done
+			if file != nil {
+				file.file.Close()
+			}
+			if sys != nil {
+				sys.Close()
+			}
+		})
+	}
+	return stop, nil
+}
+
+// githubRelease is the part of a GitHub release used to check for and install updates.
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+const iaEndpoint = "https://s3.us.archive.org" // Internet Archive S3-like API
+
+var iaIdentifierRE = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// iaIdentifier names the Internet Archive item of a thread from a template where
+// {site}, {board} and {thread} are replaced, keeping only the characters allowed
+// in identifiers.
+func iaIdentifier(template, site, board, thread string) string {
+	name := strings.NewReplacer("{site}", site, "{board}", board, "{thread}", thread).Replace(template)
+	return strings.Trim(iaIdentifierRE.ReplaceAllString(name, "-"), "-")
+}
+
+// uploadToArchive pushes every file of a thread folder to the Internet Archive
+// item identifier, creating it with the thread title on the first upload.
+// Uploads are authenticated with the S3 keys of archive.org/account/s3.php.
+func uploadToArchive(client *http.Client, dir, identifier, access, secret string, meta threadMetadata) (int, error) {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			paths = append(paths, path)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, path := range paths {
+		rel, _ := filepath.Rel(dir, path)
+		f, err := os.Open(path)
+		if err != nil {
+			return i, err
+		}
+		info, _ := f.Stat()
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		for j := range parts {
+			parts[j] = url.PathEscape(parts[j])
+		}
+		req, err := http.NewRequest("PUT", iaEndpoint+"/"+identifier+"/"+strings.Join(parts, "/"), f)
+		if err != nil {
+			f.Close()
+			return i, err
+		}
+		req.ContentLength = info.Size()
+		req.Header.Set("Authorization", "LOW "+access+":"+secret)
+		if i == 0 {
+			req.Header.Set("x-amz-auto-make-bucket", "1")
+			req.Header.Set("x-archive-meta-mediatype", "image")
+			req.Header.Set("x-archive-meta-collection", "opensource_media")
+			req.Header.Set("x-archive-meta-title", "uri("+url.PathEscape(threadTitle(meta))+")") // Titles can be anything, headers can't
+			req.Header.Set("x-archive-meta-source", meta.URL)
+			req.Header.Set("x-archive-meta-subject", meta.Site+";"+meta.Board)
+		}
+		resp, err := client.Do(req)
+		f.Close()
+		if err != nil {
+			return i, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return i, &httpError{Status: resp.StatusCode, URL: req.URL.String()}
+		}
+	}
+	return len(paths), nil
+}
+
+// checkForUpdates checks the latest release from GitHub and compares it with the current version.
+func checkForUpdates(client *http.Client) (latestVersion string, updateAvailable bool) {
+	resp, err := client.Get(releasesURL)
+	if err != nil {
+		fmt.Println("[!] Error checking for updates:", err)
+		return "", false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		fmt.Printf("[!] GitHub API returned status code %d\n", resp.StatusCode)
+		return "", false
+	}
+
+	var release githubRelease
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		fmt.Println("[!] Error decoding GitHub API response:", err)
+		return "", false
+	}
+
+	latestVersion = strings.TrimPrefix(release.TagName, "v")
+	if latestVersion != version {
+		return latestVersion, true
+	}
+	return latestVersion, false
+}
+
+// selfUpdateCommand replaces the running binary with the one of the latest
+// release for this platform, after checking it against the SHA256SUMS file
+// published with the release. With --check it only tells whether there is one.
+func selfUpdateCommand(args []string) {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	checkFlag := fs.Bool("check", false, "Only check whether a newer release exists")
+	parseArgs(fs, args)
+
+	client := newHTTPClient(netOptions{MaxConns: 2})
+	resp, err := client.Get(releasesURL)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("GitHub API returned status code %d", resp.StatusCode)
+	}
+	if err != nil {
+		fail("Error checking for updates", err)
+	}
+	var release githubRelease
+	err = json.NewDecoder(resp.Body).Decode(&release)
+	resp.Body.Close()
+	if err != nil {
+		fail("Error decoding GitHub API response", err)
+	}
+	latest := strings.TrimPrefix(release.TagName, "v")
+	if latest == version {
+		fmt.Printf("[*] 4cget %s IS UP TO DATE [*]\n", version)
+		return
+	}
+	if *checkFlag {
+		fmt.Printf("[*] UPDATE AVAILABLE %s (running %s) [*]\n", latest, version)
+		return
+	}
+
+	if err := selfUpdate(client, release); err != nil {
+		fail("Error updating", err)
+	}
+	fmt.Printf("[*] UPDATED 4cget %s TO %s [*]\n", version, latest)
+}
+
+// selfUpdate downloads the binary of release for this platform next to the
+// running one, checks its SHA-256 and swaps it in.
+func selfUpdate(client *http.Client, release githubRelease) error {
+	name := "4cget-" + runtime.GOOS + "-" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	var binaryURL, sumsURL string
+	for _, asset := range release.Assets {
+		switch asset.Name {
+		case name:
+			binaryURL = asset.URL
+		case "SHA256SUMS":
+			sumsURL = asset.URL
+		}
+	}
+	if binaryURL == "" {
+		return fmt.Errorf("release %s has no %s binary", release.TagName, name)
+	}
+	if sumsURL == "" {
+		return fmt.Errorf("release %s publishes no SHA256SUMS, not installing an unverified binary", release.TagName)
+	}
+
+	sums, err := fetchBody(client, sumsURL)
+	if err != nil {
+		return err
+	}
+	var want string
+	for _, line := range strings.Split(string(sums), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			want = strings.ToLower(fields[0])
+		}
+	}
+	if want == "" {
+		return fmt.Errorf("SHA256SUMS has no checksum for %s", name)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	resp, err := client.Get(binaryURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &httpError{Status: resp.StatusCode, URL: binaryURL}
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(exe), ".4cget-update-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != want {
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", name, got, want)
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+
+	// Windows can't replace a running binary, but it can rename it
+	if runtime.GOOS == "windows" {
+		os.Remove(exe + ".old")
+		if err := os.Rename(exe, exe+".old"); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), exe)
+}
+
+// displayHelp shows the help message with explanations and examples.
+func displayHelp() {
+	fmt.Print(`
+4cget - A tool to download images from 4chan threads.
+
+Usage:
+  4cget [options] <thread_url>
+  4cget <command> [options]
+
+Commands:
+  find --md5 <hash>      Look up an image in the archive by MD5 (hex or base64).
+  find --file <image>    Hash a local image and look it up in the archive.
+  index <dir>            Hash an existing collection and add it to the dedupe index.
+  from-file <snapshot>   Download or repair the media of a saved thread: a
+                         metadata.json, a 4chan API thread JSON (with --board)
+                         or a saved page (with --board and --thread).
+  watch <list> [options] Archive every thread URL listed in a file (one per line,
+                         from any supported site), each by its own 4cget with
+                         these options. Lines added later are picked up. A list
+                         of - is read from stdin.
+  catalog [--format json|csv] <board>
+                         Print the live threads of a board (a 4chan board name
+                         or a board URL): URL, subject, replies, images, times,
+                         page and thumbnail of the opening post.
+  gui [options]          Open a page in the browser to paste thread URLs and
+                         follow their downloads, each by its own 4cget with
+                         these options.
+  diff <thread_url>      Compare a thread with its folder without downloading:
+                         the files missing from the folder and the files no
+                         longer in the thread. Exits with status 1 if they differ.
+  state export|import <file> [--watch <list>]
+                         Save the dedupe index, thread checkpoints, queues and
+                         lists (and a watch list) to a JSON file, or merge such
+                         a file into the archive, to move it or back it up.
+  tier --remote <remote:path> [--older-than 30d] [--dry-run] [dir]
+                         Move the files older than --older-than to an rclone
+                         remote (S3, B2, SFTP...), leaving a .tiered stub so they
+                         aren't downloaded again.
+  verify [--workers <n>] [dir]...
+                         Check the files of every thread folder against its
+                         SHA256SUMS, hashing --workers files at once (default
+                         one per CPU).
+  keygen <keyfile>       Write a new random key for --encrypt-key.
+  decrypt --key <keyfile> <file.enc>...
+                         Decrypt files encrypted with --encrypt-key next to them.
+  service install <URL> [options]
+                         Run 4cget with these options from the current folder
+                         in the background at logon (systemd user unit,
+                         launchd agent or Windows scheduled task). --name
+                         names the service (default 4cget).
+  service start|stop|uninstall
+                         Manage an installed service.
+  completion bash|zsh|fish|powershell
+                         Print the shell completion script of 4cget.
+  self-update [--check]  Replace 4cget with the binary of the latest release, after
+                         verifying its SHA-256. --check only tells if there is one.
+
+Options:
+  --help                 Display this help message.
+  --verbose              Show more details when something goes wrong, such as the
+                         start of a block page served instead of the thread, and
+                         in monitor mode the goroutines, open files and memory
+                         used after each check.
+  --config <file>        Configuration file (default: 4cget/config in the user
+                         configuration folder, e.g. ~/.config/4cget/config).
+                         Options can also be set with FOURCGET_<OPTION>
+                         environment variables, e.g. FOURCGET_SLEEP=1.
+  --profile <name>       Use the settings of the [profile.<name>] section of the
+                         configuration file, over the global and board ones.
+  --monitor <seconds>    Enable monitor mode with interval in seconds.
+                         The program will check for new images every specified interval.
+  --adaptive             In monitor mode, check more often once the thread has hit
+                         its bump limit or is about to be pruned.
+  --live                 In monitor mode on meguca sites such as sturdychan, follow
+                         the thread's websocket and check it as soon as a post
+                         gets a file, besides every interval.
+  --notify               In monitor mode, show a desktop notification when the thread
+                         gets new files or dies.
+  --on-death <command>   In monitor mode, run a command once the thread is deleted,
+                         archived or closed. {board}, {thread}, {url}, {dir},
+                         {reason}, {posts} and {files} are replaced.
+  --death-webhook <url>  In monitor mode, POST a JSON event with the same fields to
+                         this URL once the thread dies.
+  --matrix-homeserver <url>
+                         In monitor mode, post a message to a Matrix room when the
+                         thread gets new files or dies, through this homeserver
+                         (e.g. https://matrix.org), with:
+  --matrix-token <token> The access token of the account posting the messages,
+                         best set in the configuration file or FOURCGET_MATRIX_TOKEN
+                         since other users can see the command line.
+  --matrix-token-file <path>
+                         Read the access token from this file instead.
+  --matrix-room <id>     The ID of the room, such as !abcdef:matrix.org.
+  --listen <addr>        In monitor mode, accept threads to archive from a bookmarklet
+                         with POST /add?url=<thread URL> on this address (e.g.
+                         127.0.0.1:8765). Each one runs as a new 4cget with the
+                         same options, logging to .4cget/added.
+  --token <secret>       Token that --listen requests must carry, as a token
+                         parameter or a Bearer header (default: a random one,
+                         printed at start).
+  --clipboard            In monitor mode, also archive every thread URL copied to the
+                         clipboard, like --listen (needs xclip or wl-paste on Linux).
+  --log-file <file>      Also write the output to a log file, rotated every
+                         --log-max-size MB (default 10) and/or --log-max-age
+                         (e.g. 24h). The last 5 rotated logs are kept.
+  --syslog               Also send the output to syslog/journald.
+  --check                Fetch the thread again at the end and verify that every
+                         file exists locally with the right size, listing any
+                         file missed. Exits with status 1 if some are missing.
+  --cache-ttl <duration> Keep the thread data in .4cget/cache and reuse it in later
+                         runs for this long (e.g. 10m) instead of fetching it again.
+  --report <file.csv>    Write a CSV report of every file of the thread: post, URL,
+                         local path, size, MD5 and status (downloaded, exists,
+                         blocked, ignored, duplicate, classified, quarantined
+                         or failed).
+  --feed <file>          Keep an Atom feed of the latest downloaded files, so any
+                         feed reader can follow a monitored thread.
+  --progress-json        Print the progress of the downloads as JSON lines on
+                         stdout (queued, started, percent, done, skipped and
+                         failed events), and everything else on stderr.
+  --sleep <seconds>      Sleep duration in seconds between downloads.
+                         Useful to avoid getting rate-limited by the server.
+  --limit-rate <rate>    Cap the overall download rate, e.g. 500K or 2M per second,
+                         or by time of day: "01:00-08:00=0,else=1M" (0 is unlimited).
+  --chunk-threshold <MB> Download files of at least this size as parallel ranges
+                         (default 10, 0 disables). Needs the size from the site API.
+  --chunks <n>           Number of parallel ranges for large files (default 4).
+  --order <order>        Download the 'newest' or 'oldest' posts, or the 'largest'
+                         or 'smallest' files first (default: thread order).
+  --workers <n>          Number of simultaneous downloads (default 8).
+  --queue-size <n>       Maximum number of files waiting for a worker (default 64).
+                         Keeps memory bounded on very large threads.
+  --max-downloads <n>    Share n simultaneous downloads between every 4cget running
+                         from this folder, such as the threads of a watch list,
+                         which take turns file by file.
+  --max-conns <n>        Maximum simultaneous connections per host (default 8).
+  --api-conns <n>        Maximum simultaneous connections per host for thread
+                         pages and API calls, kept apart from downloads (default 2).
+                         Connections are kept alive and reused, over HTTP/2 when
+                         the server supports it.
+  --resolver <server>    DNS server to use instead of the system one (e.g. 9.9.9.9).
+  --doh <url>            Resolve names with DNS-over-HTTPS
+                         (e.g. https://1.1.1.1/dns-query).
+  --4, --6               Only connect over IPv4 or IPv6.
+  --tls-min <version>    Minimum TLS version: 1.0, 1.1, 1.2 or 1.3.
+  --ca-file <file>       PEM file of extra certificate authorities to trust, for
+                         interception proxies or chans with a private CA.
+  --insecure             Don't verify TLS certificates at all.
+  --media-host <a=b>     Fetch media from host b instead of a (a host name or a base
+                         URL such as http://cache.local:8080). Repeatable.
+  --proxy <proxy_url>    Proxy URL (e.g., http://proxyserver:port).
+  --fallback-proxy <url> Proxy to switch downloads to when the media host answers
+                         HTTP 403 to several files in a row, such as Tor
+                         (socks5://127.0.0.1:9050). Without it, downloads stop.
+  --max-failures <n>     Abort the run after this many failed requests, retries
+                         included, in monitor mode within one check (default
+                         200, 0 disables).
+  --max-failure-rate <percent>
+                         Abort the run once more than this share of the files
+                         failed, after 20 files, in monitor mode within one
+                         check (default 50, 0 disables).
+  --proxyuser <user>     Proxy username for authentication.
+  --proxypass <pass>     Proxy password for authentication.
+  --pass-id <id>         Use a 4chan Pass session: the value of the pass_id cookie
+                         set when logging in to the Pass on 4chan.
+  --cookie <name=value>  Send a session cookie to the site (repeatable).
+  --skip-existing        Never download a file that already exists locally
+                         (default in monitor mode).
+  --overwrite            Download every file again, replacing local copies
+                         (default for a single run).
+  --update               Download a file again only if its remote size or MD5
+                         differs from the local copy.
+  --verify-md5           Also compare MD5s, not just sizes, when checking whether
+                         an existing file is complete.
+  --dedupe               Don't keep files already stored anywhere in the archive
+                         (including folders imported with 'index').
+  --blocklist <file>     File of MD5s and filename patterns that are never kept.
+                         Defaults to .4cget/blocklist.txt when it exists.
+  --filter-comment <re>  Only download files of posts whose text matches the regex.
+  --exclude-comment <re> Skip files of posts whose text matches the regex.
+  --since <when>         Only download files of posts newer than a duration ago
+                         (e.g. 2h or 3d) or a time (2006-01-02 or RFC 3339).
+  --spoilers <mode>      Mark spoilered files: 'prefix' names them spoiler_<name>,
+                         'folder' puts them in a spoilers subfolder.
+  --numbered             Name files 0001_<name>, 0002_<name>, ... in post order.
+  --group-by poster      Put files into subfolders by poster ID, on boards with IDs.
+  --layout <layout>      'board' saves threads in <board>/<thread> (default), 'date'
+                         in YYYY/MM/DD/<board>-<thread> from the opening post.
+  --chmod <mode>         Give the files of the thread folder this mode (e.g. 0644),
+                         and its folders the same with x where r is set (0755).
+  --chown <user:group>   Give the files and folders of the thread this owner, e.g.
+                         when running as root in a container.
+  --metadata             Write post and file metadata to metadata.json in the
+                         thread folder, including posts whose files were deleted.
+  --sign-key <file>      Write provenance.json (URL, capture time and the SHA-256 of
+                         every file) to the thread folder and sign it with this
+                         OpenSSH (ssh-keygen) or minisign private key.
+  --no-checksums         Don't write SHA256SUMS, the SHA-256 of every file of the
+                         thread folder checked by sha256sum -c or 4cget verify.
+  --no-info              Don't write README.txt and info.json, which describe the
+                         thread (URL, subject, OP text, dates), to its folder.
+  --tombstones           Record the posts and files deleted from the thread since
+                         they were seen in metadata.json, keeping the local copies
+                         (implies --metadata).
+  --export <formats>     Also save the thread as 'markdown' (thread.md) and/or
+                         'html' (thread.html), comma separated.
+  --fsync                Flush every download to disk before counting it as done, for
+                         network filesystems and other storage that must not lose
+                         files on a crash.
+  --direct-temp-dir <dir>
+                         Write downloads to a folder on a fast local disk first and
+                         move them into the archive (e.g. on a NAS) once complete.
+  --encrypt-key <file>   Encrypt every file stored in the thread folders, sidecars
+                         and metadata included, with AES-256-GCM and this key
+                         (from 4cget keygen). Files get a .enc extension.
+  --xattr                Store the URL and MD5 of each file in its extended attributes
+                         user.xdg.origin.url and user.checksum.md5, where the
+                         filesystem supports them (needs setfattr on Linux).
+  --tags <mode>          Write booru tags (board, thread, subject, poster ID and
+                         resolution) of the files: 'sidecar' as <file>.txt, one
+                         tag per line, or 'file' as a single tags.txt.
+  --save-thread          Save the thread text, same as --metadata --export
+                         markdown,html.
+  --no-media             Don't download any file. With --save-thread and
+                         --monitor, keeps a text-only archive of the thread.
+  --refresh-metadata     Instead of a thread URL, take archive folders (default .)
+                         and update the text of the threads archived there from
+                         the site: metadata.json, info.json and thread.md/.html.
+                         No file is downloaded.
+  --classify <command>   Run a classifier on each downloaded file ({path} is replaced).
+                         It prints "<category> [score]" lines, the best one wins.
+  --classify-skip <list> Remove files classified in these categories (comma separated)
+                         with at least --classify-threshold (default 0.5). They are
+                         listed in .4cget/classified.txt and not downloaded again.
+  --saucenao-key <key>   Look up the source and artist of each downloaded image on
+                         SauceNAO (one every 8 seconds) and save the best match
+                         with at least --saucenao-min similarity (default 80%)
+                         as <file>.source.json.
+  --post-process <step>  Run a step on each downloaded file, repeatable to make a
+                         chain: strip-exif, convert png|jpeg (copies written to
+                         the processed subfolder, originals are kept), hash (a
+                         .sha256 file) or exec <command> ({path}, {original} and
+                         {name} are replaced). Best declared in the config file.
+  --thread-process <step>
+                         Run a step on the finished thread folder: exec <command>
+                         ({dir}, {board}, {thread} and {url} are replaced) or
+                         upload (see --ia-item). Repeatable.
+  --ia-item <name>       Upload the finished thread folder, metadata included, to
+                         this Internet Archive item. {site}, {board} and {thread}
+                         are replaced, e.g. 4cget-{board}-{thread}.
+  --ia-access <key>      Internet Archive S3 access key (archive.org/account/s3.php).
+  --ia-secret <key>      Internet Archive S3 secret key.
+
+Examples:
+
+  Basic usage:
+    4cget https://boards.4chan.org/w/thread/123456
+
+  Enable monitor mode with a 60-second interval:
+    4cget --monitor 60 https://boards.4chan.org/w/thread/123456
+
+  Use a proxy with authentication:
+    4cget --proxy http://proxyserver:port --proxyuser username --proxypass password https://boards.4chan.org/w/thread/123456
+
+  Add delay between downloads to prevent rate-limiting:
+    4cget --sleep 2 https://boards.4chan.org/w/thread/123456
+
+  Only download files from posts mentioning a resolution:
+    4cget --filter-comment "1920x1080" https://boards.4chan.org/w/thread/123456
+
+  Import an existing collection and skip anything already in it:
+    4cget index ~/Pictures/walls
+    4cget --dedupe https://boards.4chan.org/w/thread/123456
+
+  Repair the media of a thread saved by another system:
+    4cget from-file --board w --update 123456.json
+
+  Check whether an image is already in the archive:
+    4cget find --file wallpaper.jpg
+
+Note:
+  - Ensure that all flags are prefixed with '--'.
+  - The thread URL must be a valid URL from a supported site.
+  - Use '--sleep' to add delays between downloads to avoid getting rate-limited (HTTP 429 errors).
+`)
+}
+
+// listFlag is a flag that can be given several times.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Config is a parsed configuration file. Each key is the name of a command-line
+// flag, without the dashes, and sets its default value:
+//
+//	# Global settings
+//	sleep = 1
+//	media-host = i.4cdn.org=is2.4chan.org
+//
+//	# Settings of the threads of /wg/, over the global ones
+//	[board.wg]
+//	monitor = 600
+//
+//	# Settings used with --profile videos, over both
+//	[profile.videos]
+//	filter-comment = (?i)webm
+//
+// Flags that can be given several times can be repeated. [site.<name>]
+// sections add sites instead, see addSites.
+type Config struct {
+	path     string
+	sections map[string][]configEntry // Keyed by section name, "" for the global one
+}
+
+// configEntry is a single "key = value" line.
+type configEntry struct {
+	key, value string
+	line       int
+}
+
+// defaultConfigPath returns where the configuration file lives when --config isn't given.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "4cget", "config")
+}
+
+// loadConfig reads a configuration file. A missing file is an empty configuration
+// unless mustExist is set.
+func loadConfig(path string, mustExist bool) (*Config, error) {
+	c := &Config{path: path, sections: make(map[string][]configEntry)}
+	if path == "" {
+		return c, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && !mustExist {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		entry := configEntry{
+			key:   strings.TrimSpace(line[:i]),
+			value: strings.Trim(strings.TrimSpace(line[i+1:]), `"`),
+			line:  n,
+		}
+		c.sections[section] = append(c.sections[section], entry)
+	}
+	return c, scanner.Err()
+}
+
+// exposesSecrets reports whether the file sets one of keys while other users
+// can read it. Windows files don't have Unix permissions.
+func (c *Config) exposesSecrets(keys ...string) bool {
+	if c.path == "" || runtime.GOOS == "windows" {
+		return false
+	}
+	if info, err := os.Stat(c.path); err != nil || info.Mode().Perm()&0077 == 0 {
+		return false
+	}
+	for _, entries := range c.sections {
+		for _, e := range entries {
+			for _, key := range keys {
+				if e.key == key {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// meguca websocket messages start with their type as two digits. Several
+// messages can be sent as one, separated by NUL bytes.
+const (
+	megucaClosePost   = 6  // A post is finished, with its text final
+	megucaInsertImage = 8  // A file was attached to a post
+	megucaSynchronise = 30 // Subscribes to the updates of a thread
+)
+
+// liveDelay is how long after a live update the thread is checked, so a post
+// being written can get its file first.
+const liveDelay = 2 * time.Second
+
+// watchLive follows the websocket of a meguca thread and signals changed when
+// one of its posts gets a file or is finished, so monitor mode can check it
+// right away instead of waiting for the next interval. Dropped connections are
+// opened again after a growing delay; polling goes on meanwhile.
+func watchLive(client *http.Client, site SiteInfo, board, thread string, changed chan<- struct{}) {
+	delay := time.Second
+	for {
+		start := time.Now()
+		err := followSocket(client, site, board, thread, changed)
+		if time.Since(start) > time.Minute {
+			delay = time.Second
+		}
+		printError(fmt.Sprintf("Live updates interrupted, reconnecting in %v", delay), err)
+		time.Sleep(delay)
+		if delay *= 2; delay > 5*time.Minute {
+			delay = 5 * time.Minute
+		}
+	}
+}
+
+// followSocket opens the websocket of a meguca site through client, so the
+// proxy, DNS and TLS settings apply, and reads it until it fails.
+func followSocket(client *http.Client, site SiteInfo, board, thread string, changed chan<- struct{}) error {
+	id, err := strconv.ParseInt(thread, 10, 64)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	socketURL := site.URL + "api/socket"
+	req, err := http.NewRequest("GET", socketURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	req.Header.Set("Origin", strings.TrimSuffix(site.URL, "/"))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	accept := sha1.Sum([]byte(base64.StdEncoding.EncodeToString(key) + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		return &httpError{Status: resp.StatusCode, URL: socketURL}
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		return errors.New("the server didn't accept the websocket")
+	}
+
+	var writeMu sync.Mutex
+	send := func(opcode byte, payload []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return writeFrame(conn, opcode, payload)
+	}
+	subscribe, _ := json.Marshal(map[string]interface{}{"board": board, "thread": id})
+	if err := send(1, append([]byte(fmt.Sprintf("%02d", megucaSynchronise)), subscribe...)); err != nil {
+		return err
+	}
+
+	// Pings keep the connection from idling out; a silent one is closed
+	idle := time.AfterFunc(90*time.Second, func() { conn.Close() })
+	defer idle.Stop()
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-ping.C:
+				if send(9, nil) != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		opcode, payload, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+		idle.Reset(90 * time.Second)
+		switch opcode {
+		case 8:
+			return errors.New("closed by the server")
+		case 9:
+			send(10, payload)
+		case 1:
+			for _, msg := range bytes.Split(payload, []byte{0}) {
+				if len(msg) < 2 {
+					continue
+				}
+				if kind, err := strconv.Atoi(string(msg[:2])); err == nil && (kind == megucaClosePost || kind == megucaInsertImage) {
+					select {
+					case changed <- struct{}{}:
+					default: // A check is already due
+					}
+				}
+			}
+		}
+	}
+}
+
+// writeFrame writes a single masked websocket frame, as clients must.
+func writeFrame(w io.Writer, opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n < 1<<16:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	mask := make([]byte, 4)
+	if _, err := rand.Read(mask); err != nil {
+		return err
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads a websocket frame and returns its opcode and payload. Parts
+// of fragmented messages come as frames of their own.
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = int64(ext[0])<<8 | int64(ext[1])
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = 0
+		for _, b := range ext {
+			n = n<<8 | int64(b)
+		}
+	}
+	if n < 0 || n > 16<<20 {
+		return 0, nil, fmt.Errorf("websocket frame of %d bytes", n)
+	}
+	var mask []byte
+	if head[1]&0x80 != 0 {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(r, mask); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range mask {
+		for j := i; j < len(payload); j += 4 {
+			payload[j] ^= mask[i]
+		}
+	}
+	return head[0] & 0x0f, payload, nil
+}
+
+// addSites adds the sites of the [site.<name>] sections to siteInfoMap, so
+// other chans running a supported engine can be archived:
+//
+//	[site.mychan]
+//	url = https://mychan.example/
+//	engine = meguca
+//
+// Besides url, sections may set engine (meguca, the default, is the only one
+// so far), media-hosts (a comma-separated list, by default the host of url),
+// and the api-interval and min-refresh durations the site asks for.
+func (c *Config) addSites() error {
+	for section, entries := range c.sections {
+		if !strings.HasPrefix(section, "site.") {
+			continue
+		}
+		id := strings.TrimPrefix(section, "site.")
+		if _, builtin := siteInfoMap[id]; builtin {
+			return fmt.Errorf("%s: [%s] redefines a built-in site", c.path, section)
+		}
+		values := make(map[string]string)
+		for _, e := range entries {
+			switch e.key {
+			case "url", "engine", "media-hosts", "api-interval", "min-refresh":
+				values[e.key] = e.value
+			default:
+				return fmt.Errorf("%s:%d: unknown site setting %q", c.path, e.line, e.key)
+			}
+		}
+		base := values["url"]
+		if u, err := url.Parse(base); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("%s: [%s] needs the url of the site, e.g. url = https://%s.example/", c.path, section, id)
+		}
+		if !strings.HasSuffix(base, "/") {
+			base += "/"
+		}
+		if engine := values["engine"]; engine != "" && engine != "meguca" {
+			return fmt.Errorf("%s: [%s] has an unsupported engine %q, only meguca is", c.path, section, engine)
+		}
+		site := megucaSite(id, base)
+		if hosts := values["media-hosts"]; hosts != "" {
+			site.MediaHosts = nil
+			for _, host := range strings.Split(hosts, ",") {
+				site.MediaHosts = append(site.MediaHosts, strings.TrimSpace(host))
+			}
+		}
+		for key, d := range map[string]*time.Duration{"api-interval": &site.APIInterval, "min-refresh": &site.MinRefresh} {
+			if values[key] == "" {
+				continue
+			}
+			var err error
+			if *d, err = time.ParseDuration(values[key]); err != nil {
+				return fmt.Errorf("%s: [%s] has an invalid %s: %v", c.path, section, key, err)
+			}
+		}
+		siteInfoMap[id] = site
+	}
+	return nil
+}
+
+// apply sets the flags of a config section, except those in explicit, which
+// were given on the command line and take precedence. Repeatable flags set in
+// the section replace the values set before, by the sections applied earlier.
+func (c *Config) apply(fs *flag.FlagSet, section string, explicit map[string]bool) error {
+	replaced := make(map[string]bool)
+	for _, e := range c.sections[section] {
+		if explicit[e.key] {
+			continue
+		}
+		f := fs.Lookup(e.key)
+		if f == nil {
+			return fmt.Errorf("%s:%d: unknown option %q", c.path, e.line, e.key)
+		}
+		if list, repeatable := f.Value.(*listFlag); repeatable && !replaced[e.key] {
+			*list, replaced[e.key] = nil, true
+		}
+		if err := fs.Set(e.key, e.value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value for %s: %v", c.path, e.line, e.key, err)
+		}
+	}
+	return nil
+}
+
+// envPrefix starts the environment variables that set options, e.g.
+// FOURCGET_SLEEP=1 or FOURCGET_MEDIA_HOST for --media-host.
+const envPrefix = "FOURCGET_"
+
+// applyEnv sets the flags given in the environment, except those in explicit,
+// and adds them to explicit so the configuration file doesn't override them.
+// Repeatable flags take several values separated by spaces.
+func applyEnv(fs *flag.FlagSet, explicit map[string]bool) error {
+	var errEnv error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if !ok || explicit[f.Name] || errEnv != nil {
+			return
+		}
+		values := []string{value}
+		if _, repeatable := f.Value.(*listFlag); repeatable {
+			values = strings.Fields(value)
+		}
+		for _, v := range values {
+			if err := fs.Set(f.Name, v); err != nil {
+				errEnv = fmt.Errorf("invalid value for %s: %v", name, err)
+				return
+			}
+		}
+		explicit[f.Name] = true
+	})
+	return errEnv
+}
+
+// sessionJar returns a cookie jar sending the --cookie cookies, and the 4chan
+// Pass cookies for --pass-id, to the site, its API and its media hosts.
+func sessionJar(site SiteInfo, cookies []string, passID string) (http.CookieJar, error) {
+	var session []*http.Cookie
+	for _, c := range cookies {
+		name, value, ok := strings.Cut(c, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid cookie %q, expected name=value", c)
+		}
+		session = append(session, &http.Cookie{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)})
+	}
+	if passID != "" {
+		session = append(session, &http.Cookie{Name: "pass_id", Value: passID}, &http.Cookie{Name: "pass_enabled", Value: "1"})
+	}
+
+	jar, _ := cookiejar.New(nil)
+	hosts := append([]string{site.URL, site.ThreadAPI}, site.MediaHosts...)
+	for _, host := range hosts {
+		// Site URLs and API format strings start with a scheme, media hosts don't
+		if _, rest, ok := strings.Cut(host, "://"); ok {
+			host, _, _ = strings.Cut(rest, "/")
+		}
+		if host != "" {
+			jar.SetCookies(&url.URL{Scheme: "https", Host: host, Path: "/"}, session)
+		}
+	}
+	return jar, nil
+}
+
+// parseMediaHosts parses --media-host overrides of the form "from=to", where to
+// is a host name or a base URL such as http://cache.local:8080.
+func parseMediaHosts(overrides []string) (map[string]string, error) {
+	hosts := make(map[string]string)
+	for _, override := range overrides {
+		from, to, ok := strings.Cut(override, "=")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid media host override %q (use from=to)", override)
+		}
+		hosts[from] = to
+	}
+	return hosts, nil
+}
+
+// rewriteMediaHost applies the --media-host overrides to a file URL.
+func rewriteMediaHost(fileURL string) string {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return fileURL
+	}
+	to, ok := mediaHosts[u.Host]
+	if !ok {
+		return fileURL
+	}
+	if base, err := url.Parse(to); err == nil && base.Scheme != "" && base.Host != "" {
+		u.Scheme = base.Scheme
+		u.Host = base.Host
+		u.Path = strings.TrimSuffix(base.Path, "/") + u.Path
+	} else {
+		u.Host = to
+	}
+	return u.String()
+}
+
+// parseArgs parses the flags in args into fs and returns the positional arguments.
+// Positional arguments may come before the flags; flags must start with '--'.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			// All remaining args are positional
+			positional = append(positional, args[i+1:]...)
+			return positional
+		}
+		if strings.HasPrefix(arg, "--") {
+			// Flag
+			fs.Parse(args[i:])
+			break
+		}
+		if strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") {
+			fmt.Printf("Invalid flag: %s. Flags must start with '--'.\n", arg)
+			os.Exit(1)
+		}
+		// Positional argument
+		positional = append(positional, arg)
+	}
+
+	// After parsing flags, any remaining arguments are positional
+	return append(positional, fs.Args()...)
+}
+
+// runCommand runs the subcommand named by args[0], if there is one.
+// It reports whether a subcommand was found.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "find":
+		findCommand(args[1:])
+	case "index":
+		indexCommand(args[1:])
+	case "service":
+		serviceCommand(args[1:])
+	case "watch":
+		watchCommand(args[1:])
+	case "gui":
+		guiCommand(args[1:])
+	case "catalog":
+		catalogCommand(args[1:])
+	case "diff":
+		diffCommand(args[1:])
+	case "state":
+		stateCommand(args[1:])
+	case "tier":
+		tierCommand(args[1:])
+	case "keygen":
+		keygenCommand(args[1:])
+	case "verify":
+		verifyCommand(args[1:])
+	case "decrypt":
+		decryptCommand(args[1:])
+	case "self-update":
+		selfUpdateCommand(args[1:])
+	default:
+		return false
+	}
+	return true
+}
+
+// findCommand searches the dedupe index for an image, given its MD5 or a local copy.
+func findCommand(args []string) {
+	fs := flag.NewFlagSet("find", flag.ExitOnError)
+	md5Flag := fs.String("md5", "", "MD5 hash to look for (hex or base64)")
+	fileFlag := fs.String("file", "", "Local file to hash and look for")
+	parseArgs(fs, args)
+
+	var sum string
+	var err error
+	switch {
+	case *md5Flag != "":
+		sum, err = normalizeMD5(*md5Flag)
+	case *fileFlag != "":
+		sum, _, err = hashFile(*fileFlag)
+	default:
+		fmt.Println("[!] USAGE: 4cget find --md5 <hash> | --file <image>")
+		os.Exit(1)
+	}
+	if err != nil {
+		fail("Error", err)
+	}
+
+	actualPath, _ := os.Getwd()
+	h, err := openHistory(actualPath)
+	if err != nil {
+		fail("Error reading dedupe index", err)
+	}
+
+	entries := h.Lookup(sum)
+	if len(entries) == 0 {
+		fmt.Printf("[*] %s not found in the archive\n", sum)
+		os.Exit(1)
+	}
+	fmt.Printf("[*] %s found in %d location(s):\n", sum, len(entries))
+	for _, e := range entries {
+		fmt.Printf("  %s", e.Path)
+		if e.URL != "" {
+			fmt.Printf(" (%s)", e.URL)
+		}
+		fmt.Println()
+	}
+}
+
+// indexCommand walks an existing collection and seeds the dedupe index with its files.
+func indexCommand(args []string) {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	dirs := parseArgs(fs, args)
+	if len(dirs) < 1 {
+		fmt.Println("[!] USAGE: 4cget index <dir>...")
+		os.Exit(1)
+	}
+
+	actualPath, _ := os.Getwd()
+	h, err := openHistory(actualPath)
+	if err != nil {
+		fail("Error reading dedupe index", err)
+	}
+
+	start := time.Now()
+	files := 0
+	for _, dir := range dirs {
+		dir, _ = filepath.Abs(dir)
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Println("[!] Error reading", path+":", err)
+				return nil
+			}
+			if info.IsDir() {
+				if path != dir && strings.HasPrefix(info.Name(), ".") {
+					return filepath.SkipDir // Skip 4cget's own state and other hidden folders
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			sum, size, err := hashFile(path)
+			if err != nil {
+				fmt.Println("[!] Error hashing", path+":", err)
+				return nil
+			}
+			if err := h.Add(HistoryEntry{MD5: sum, Path: path, Size: size, Time: info.ModTime()}); err != nil {
+				return err
+			}
+			files++
+			fmt.Printf("Indexed: %s\n", path)
+			return nil
+		})
+		if err != nil {
+			fail("Error updating dedupe index", err)
+		}
+	}
+
+	fmt.Printf("\n✓ INDEX COMPLETE, %v FILES IN %v\n", files, time.Since(start))
+}
+
+// completionValues are the values offered when completing some options.
+var completionValues = map[string]string{
+	"layout":   "board date",
+	"tags":     "sidecar file",
+	"order":    "newest oldest largest smallest",
+	"spoilers": "prefix folder",
+	"group-by": "poster",
+	"export":   "markdown html",
+	"tls-min":  "1.0 1.1 1.2 1.3",
+}
+
+// completionBoards are the boards of 4chan, offered along with those of the
+// configuration file when completing a board name.
+const completionBoards = "3 a aco adv an b bant biz c cgl ck cm co d diy e f fa fit g gd gif h hc his hm hr i ic int jp k lgbt lit m mlp mu n news o out p po pol pw qst r r9k s s4s sci soc sp t tg toy trv tv u v vg vip vm vmg vp vr vrpg vst vt w wg wsg wsr x xs y"
+
+// completionSubcommands are the subcommands and their own words. Those
+// without words (from-file, watch, gui) take the options of a thread run,
+// --config included, which are completed after them like anywhere else.
+var completionSubcommands = map[string]string{
+	"find":        "--md5 --file",
+	"index":       "",
+	"from-file":   "",
+	"service":     "install uninstall start stop --name",
+	"watch":       "",
+	"gui":         "",
+	"catalog":     "--format",
+	"diff":        "--config",
+	"state":       "export import --watch",
+	"tier":        "--remote --older-than --dry-run",
+	"keygen":      "",
+	"verify":      "--workers",
+	"decrypt":     "--key",
+	"completion":  "bash zsh fish powershell",
+	"self-update": "--check",
+}
+
+// completionCommand prints the shell completion script for the options of fs,
+// except the hidden ones.
+func completionCommand(fs *flag.FlagSet, args []string, hidden ...string) {
+	if len(args) != 1 {
+		fmt.Println("[!] USAGE: 4cget completion bash|zsh|fish|powershell")
+		os.Exit(1)
+	}
+	type option struct {
+		name, usage string
+		takesValue  bool
+	}
+	var options []option
+	fs.VisitAll(func(f *flag.Flag) {
+		for _, name := range hidden {
+			if f.Name == name {
+				return
+			}
+		}
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		options = append(options, option{f.Name, f.Usage, !ok || !b.IsBoolFlag()})
+	})
+	var subcommands []string
+	for name := range completionSubcommands {
+		subcommands = append(subcommands, name)
+	}
+	sort.Strings(subcommands)
+
+	// Board names: those of 4chan and of the [board.<name>] sections
+	boards := make(map[string]bool)
+	for _, board := range strings.Fields(completionBoards) {
+		boards[board] = true
+	}
+	if config, err := loadArgsConfig(nil); err == nil {
+		for section := range config.sections {
+			if board := strings.TrimPrefix(section, "board."); board != section && board != "" {
+				boards[board] = true
+			}
+		}
+	}
+	var boardNames []string
+	for board := range boards {
+		boardNames = append(boardNames, board)
+	}
+	sort.Strings(boardNames)
+	completionValues["board"] = strings.Join(boardNames, " ")
+	completionSubcommands["catalog"] += " " + completionValues["board"]
+
+	switch args[0] {
+	case "bash", "zsh":
+		var flags, values, words strings.Builder
+		var others []string // Options taking anything else, files included
+		for _, o := range options {
+			flags.WriteString(" --" + o.name)
+			if v, ok := completionValues[o.name]; ok {
+				fmt.Fprintf(&values, "\t\t--%s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")); return ;;\n", o.name, v)
+			} else if o.takesValue {
+				others = append(others, "--"+o.name)
+			}
+		}
+		fmt.Fprintf(&values, "\t\t%s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", strings.Join(others, "|"))
+		for _, name := range subcommands {
+			if w := completionSubcommands[name]; w != "" {
+				fmt.Fprintf(&words, "\t\t%s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")); return ;;\n", name, w)
+			}
+		}
+		if args[0] == "zsh" {
+			fmt.Print("autoload -U +X bashcompinit && bashcompinit\n\n")
+		}
+		fmt.Printf(`_4cget() {
+	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+	if [ "$COMP_CWORD" -eq 1 ] && [[ $cur != -* ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		return
+	fi
+	case $prev in
+%s	esac
+	case ${COMP_WORDS[1]} in
+%s	esac
+	COMPREPLY=($(compgen -W "%s" -- "$cur"))
+}
+complete -o default -F _4cget 4cget
+`, strings.Join(subcommands, " "), values.String(), words.String(), strings.TrimSpace(flags.String()))
+	case "fish":
+		quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace
+		fmt.Printf("complete -c 4cget -n __fish_use_subcommand -f -a '%s'\n", strings.Join(subcommands, " "))
+		for _, name := range subcommands {
+			if w := completionSubcommands[name]; w != "" {
+				fmt.Printf("complete -c 4cget -n '__fish_seen_subcommand_from %s' -f -a '%s'\n", name, w)
+			}
+		}
+		for _, o := range options {
+			line := fmt.Sprintf("complete -c 4cget -l %s -d '%s'", o.name, quote(o.usage))
+			if v, ok := completionValues[o.name]; ok {
+				line += " -x -a '" + v + "'"
+			} else if o.takesValue {
+				line += " -r"
+			}
+			fmt.Println(line)
+		}
+	case "powershell":
+		var words []string
+		for _, o := range options {
+			words = append(words, "'--"+o.name+"'")
+		}
+		var values strings.Builder
+		for _, name := range subcommands {
+			if w := completionSubcommands[name]; w != "" {
+				fmt.Fprintf(&values, "\t\t'%s' { $words = '%s' -split ' ' }\n", name, w)
+			}
+		}
+		for _, o := range options {
+			if v, ok := completionValues[o.name]; ok {
+				fmt.Fprintf(&values, "\t\t'--%s' { $words = '%s' -split ' ' }\n", o.name, v)
+			}
+		}
+		fmt.Printf(`Register-ArgumentCompleter -Native -CommandName 4cget -ScriptBlock {
+	param($wordToComplete, $commandAst, $cursorPosition)
+	$elements = $commandAst.CommandElements | ForEach-Object { $_.ToString() }
+	$prev = if ($wordToComplete) { $elements[-2] } else { $elements[-1] }
+	$words = @(%s)
+	if ($elements.Count -le 2 -and -not $wordToComplete.StartsWith('-')) { $words = '%s' -split ' ' }
+	switch ($prev) {
+%s	}
+	$words | Where-Object { $_ -like "$wordToComplete*" } | ForEach-Object {
+		[System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+	}
+}
+`, strings.Join(words, ", "), strings.Join(subcommands, " "), values.String())
+	default:
+		fmt.Printf("[!] Unknown shell: %s (use bash, zsh, fish or powershell)\n", args[0])
+		os.Exit(1)
+	}
+}
+
+// secretOptions hold credentials. They are forwarded to another 4cget through
+// its environment, not its command line, which other users can read with ps.
+var secretOptions = []string{"pass-id", "cookie", "proxypass", "ia-secret", "saucenao-key", "matrix-token"}
+
+// forwardedArgs returns the options of this run that are in given, the ones
+// of the command line, except those in skip and the secret ones. Another 4cget
+// reads the environment and the configuration file, with its own board
+// section, by itself.
+func forwardedArgs(fs *flag.FlagSet, given map[string]bool, skip ...string) []string {
+	var args []string
+	skip = append(skip, secretOptions...)
+	fs.Visit(func(f *flag.Flag) {
+		if !given[f.Name] {
+			return
+		}
+		for _, name := range skip {
+			if f.Name == name {
+				return
+			}
+		}
+		if list, ok := f.Value.(*listFlag); ok {
+			for _, v := range *list {
+				args = append(args, "--"+f.Name+"="+v)
+			}
+			return
+		}
+		args = append(args, "--"+f.Name+"="+f.Value.String())
+	})
+	return args
+}
+
+// forwardedSecrets returns the secret options of the command line as the
+// environment variables another 4cget reads them from.
+func forwardedSecrets(fs *flag.FlagSet, given map[string]bool) []string {
+	var env []string
+	for _, name := range secretOptions {
+		f := fs.Lookup(name)
+		if f == nil || !given[name] {
+			continue
+		}
+		value := f.Value.String()
+		if list, ok := f.Value.(*listFlag); ok {
+			value = strings.Join(*list, " ")
+		}
+		env = append(env, envPrefix+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))+"="+value)
+	}
+	return env
+}
+
+// threadLauncher archives the threads added while 4cget runs, with --listen or
+// --clipboard. Each one is archived by a new 4cget process started from the
+// archive root with the options of this one, its output going to .4cget/added.
+type threadLauncher struct {
+	exe     string
+	options []string
+	secrets []string // Environment variables of the secret options
+	mu      sync.Mutex
+	started map[string]bool // Threads being archived, by URL
+}
+
+var errNotThread = errors.New("not a thread of a supported site")
+
+// threadID returns the site, board and thread number of a thread URL. 4chan
+// URLs may end with a slug of the subject, which changes when the subject is
+// edited, and any URL may have a query or a fragment: none of them is part of
+// the thread's identity.
+func threadID(rawURL string) (site, board, thread string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", "", errNotThread
+	}
+	site = siteForHost(u.Host)
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch {
+	case site == "":
+		return "", "", "", errNotThread
+	case siteInfoMap[site].Engine == "4chan":
+		if len(parts) < 3 || parts[1] != "thread" || parts[2] == "" {
+			return "", "", "", errNotThread
+		}
+		return site, parts[0], parts[2], nil
+	case len(parts) < 2 || parts[1] == "":
+		return "", "", "", errNotThread
+	}
+	return site, parts[0], parts[1], nil
+}
+
+// canonicalThreadURL returns the URL of a thread without slug, query and
+// fragment, so every URL of a thread maps to the same archive.
+func canonicalThreadURL(rawURL string) (string, error) {
+	site, board, thread, err := threadID(rawURL)
+	if err != nil {
+		return "", err
+	}
+	u, _ := url.Parse(rawURL)
+	if siteInfoMap[site].Engine == "4chan" {
+		return fmt.Sprintf("%s://%s/%s/thread/%s", u.Scheme, u.Host, board, thread), nil
+	}
+	return fmt.Sprintf("%s://%s/%s/%s", u.Scheme, u.Host, board, thread), nil
+}
+
+// newThreadLauncher returns a launcher for threads other than current, the one
+// this 4cget archives already.
+func newThreadLauncher(current string, options []string) (*threadLauncher, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	l := &threadLauncher{exe: exe, options: options, started: make(map[string]bool)}
+	if current != "" {
+		l.started[current] = true
+	}
+	return l, nil
+}
+
+// Running returns how many threads are being archived.
+func (l *threadLauncher) Running() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.started)
+}
+
+// Archiving reports whether the thread at rawURL is being archived.
+func (l *threadLauncher) Archiving(rawURL string) bool {
+	key, err := canonicalThreadURL(rawURL)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return err == nil && l.started[key]
+}
+
+// Add starts archiving the thread at rawURL unless that's already being done.
+// It returns the canonical thread URL and whether a new 4cget was started for it.
+func (l *threadLauncher) Add(rawURL string) (string, bool, error) {
+	key, err := canonicalThreadURL(rawURL)
+	if err != nil {
+		return "", false, err
+	}
+	threadURL, _ := url.Parse(key)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.started[key] {
+		return key, false, nil
+	}
+	logDir := filepath.Join(archiveRoot, addedLogDir)
+	os.MkdirAll(logDir, os.ModePerm)
+	out, err := os.OpenFile(filepath.Join(logDir, safeName(strings.Trim(threadURL.Host+threadURL.Path, "/"))+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return key, false, err
+	}
+	cmd := exec.Command(l.exe, append([]string{key}, l.options...)...)
+	cmd.Dir, cmd.Stdout, cmd.Stderr = archiveRoot, out, out
+	if len(l.secrets) > 0 {
+		cmd.Env = append(os.Environ(), l.secrets...)
+	}
+	if err := cmd.Start(); err != nil {
+		out.Close()
+		return key, false, err
+	}
+	l.started[key] = true
+	fmt.Printf("[*] THREAD ADDED (%s) [*]\n", key)
+	go func() {
+		cmd.Wait()
+		out.Close()
+		l.mu.Lock()
+		delete(l.started, key)
+		l.mu.Unlock()
+	}()
+	return key, true, nil
+}
+
+// startListener serves POST /add?url=<thread URL> on addr, so a bookmarklet or
+// browser extension can send a thread to the launcher. Requests must carry the
+// token, as a token parameter or an "Authorization: Bearer" header.
+func startListener(addr, token string, launcher *threadLauncher) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/add", func(w http.ResponseWriter, r *http.Request) {
+		// Bookmarklets post from the thread page, let them read the answer
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		given := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			given = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		key, started, err := launcher.Add(r.URL.Query().Get("url"))
+		switch {
+		case err == errNotThread:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		case !started:
+			fmt.Fprintln(w, "already archiving", key)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintln(w, "archiving", key)
+		}
+	})
+	go http.Serve(ln, mux)
+	return nil
+}
+
+// clipboardText returns the text in the system clipboard.
+func clipboardText() (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("pbpaste")
+	case "windows":
+		cmd = exec.Command("powershell", "-NoProfile", "-Command", "Get-Clipboard")
+	default:
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			cmd = exec.Command("wl-paste", "--no-newline")
+		} else {
+			cmd = exec.Command("xclip", "-o", "-selection", "clipboard")
+		}
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("reading the clipboard with %s: %v", cmd.Path, err)
+	}
+	return string(out), nil
+}
+
+// watchClipboard checks the clipboard every interval and sends the thread URLs
+// copied to the launcher. What the clipboard holds when it starts is ignored.
+func watchClipboard(launcher *threadLauncher, interval time.Duration) error {
+	last, err := clipboardText()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(interval) {
+			text, err := clipboardText()
+			if err != nil || text == last {
+				continue
+			}
+			last = text
+			for _, word := range strings.Fields(text) {
+				if strings.HasPrefix(word, "http") {
+					launcher.Add(word)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// checksumsFile lists the SHA-256 of every file of a thread folder, in the
+// format of sha256sum, so the folder can be checked with standard tools.
+const checksumsFile = "SHA256SUMS"
+
+// provenanceFile is the manifest of a thread folder signed with --sign-key.
+const provenanceFile = "provenance.json"
+
+// manifestFile reports whether a file name is one of the manifests of a thread
+// folder or their signatures, which describe the other files and are left out
+// of SHA256SUMS and encryption.
+func manifestFile(name string) bool {
+	return strings.HasPrefix(name, checksumsFile) || strings.HasPrefix(name, provenanceFile)
+}
+
+// provenance records where and when a thread was captured and the SHA-256 of
+// each file, signed so it can be shown later that nothing was altered.
+type provenance struct {
+	URL           string            `json:"url"`
+	Site          string            `json:"site,omitempty"`
+	Board         string            `json:"board"`
+	Thread        string            `json:"thread"`
+	FirstArchived time.Time         `json:"first_archived"`
+	Signed        time.Time         `json:"signed"`
+	Version       string            `json:"version"`
+	Files         map[string]string `json:"files"` // SHA-256 by path in the folder, as in SHA256SUMS
+}
+
+// signKey is the --sign-key private key, an OpenSSH or minisign secret key.
+var signKey string
+
+// writeProvenance writes provenance.json from the SHA256SUMS of the folder
+// and signs it with signKey: with ssh-keygen into provenance.json.sig, or with
+// minisign into provenance.json.minisig, depending on the key. The time of
+// the first capture is kept from the previous provenance.json.
+func writeProvenance(dir string, meta threadMetadata) error {
+	sums, err := readChecksums(filepath.Join(dir, checksumsFile))
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, provenanceFile)
+	manifest := provenance{URL: meta.URL, Site: meta.Site, Board: meta.Board, Thread: meta.Thread,
+		FirstArchived: meta.Archived.UTC(), Signed: time.Now().UTC(), Version: meta.Version, Files: sums}
+	var previous provenance
+	if data, err := ioutil.ReadFile(path); err == nil && json.Unmarshal(data, &previous) == nil && !previous.FirstArchived.IsZero() {
+		manifest.FirstArchived = previous.FirstArchived
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+
+	key, err := ioutil.ReadFile(signKey)
+	if err != nil {
+		return err
+	}
+	var cmd *exec.Cmd
+	if strings.HasPrefix(string(key), "untrusted comment:") {
+		cmd = exec.Command("minisign", "-S", "-s", signKey, "-m", path, "-x", path+".minisig",
+			"-t", fmt.Sprintf("4cget %s /%s/%s", meta.URL, meta.Board, meta.Thread))
+	} else {
+		os.Remove(path + ".sig") // ssh-keygen won't replace it
+		cmd = exec.Command("ssh-keygen", "-Y", "sign", "-q", "-f", signKey, "-n", "4cget", path)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v %s", filepath.Base(cmd.Path), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// readChecksums reads a SHA256SUMS file into a map of hashes by path, relative
+// to its folder with forward slashes.
+func readChecksums(path string) (map[string]string, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]string)
+	for _, line := range lines {
+		if sum, name, ok := strings.Cut(line, "  "); ok && len(sum) == 64 {
+			sums[strings.TrimPrefix(name, "*")] = sum
+		} else if sum, name, ok := strings.Cut(line, " *"); ok && len(sum) == 64 {
+			sums[name] = sum
+		}
+	}
+	return sums, nil
+}
+
+// sha256File returns the hex SHA-256 of a file, also copying it to progress
+// (a speedMeter, or ioutil.Discard).
+func sha256File(path string, progress io.Writer) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(h, progress), f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeChecksums writes the SHA256SUMS of a thread folder. Files that haven't
+// changed since the previous SHA256SUMS keep their hash instead of being read
+// again, so large folders are cheap to update at every check, and files moved
+// away by 'tier' stay listed.
+func writeChecksums(dir string) error {
+	path := filepath.Join(dir, checksumsFile)
+	previous, _ := readChecksums(path)
+	var written time.Time
+	if info, err := os.Stat(path); err == nil {
+		written = info.ModTime()
+	}
+	var lines []string
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case info.IsDir() && file != dir && strings.HasPrefix(info.Name(), "."):
+			return filepath.SkipDir
+		case !info.Mode().IsRegular() || manifestFile(info.Name()) || strings.HasSuffix(file, ".tmp"):
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, file)
+		rel = filepath.ToSlash(rel)
+		sum, known := previous[rel]
+		if !known || !info.ModTime().Before(written) {
+			if sum, err = sha256File(file, ioutil.Discard); err != nil {
+				return err
+			}
+		}
+		lines = append(lines, sum+"  "+rel)
+		delete(previous, rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for rel, sum := range previous {
+		if tiered(filepath.Join(dir, filepath.FromSlash(rel))) {
+			lines = append(lines, sum+"  "+rel)
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i][66:] < lines[j][66:] })
+	if err := ioutil.WriteFile(path+".tmp", []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// verifyJob is a file checked by 'verify', with its SHA-256 in SHA256SUMS.
+type verifyJob struct {
+	path string
+	sum  string
+	size int64
+}
+
+// verifyCommand checks the files of every thread folder under the given
+// folders (by default the current one) against their SHA256SUMS, and exits
+// with status 1 if any is missing or altered. Files are hashed by a pool of
+// workers, one per CPU by default.
+func verifyCommand(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	workers := fs.Int("workers", runtime.NumCPU(), "Number of files hashed at once")
+	dirs := parseArgs(fs, args)
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	if *workers < 1 {
+		fmt.Println("[!] --workers must be at least 1")
+		os.Exit(1)
+	}
+	var manifests []string
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			switch {
+			case err != nil:
+				return err
+			case info.IsDir() && path != dir && strings.HasPrefix(info.Name(), "."):
+				return filepath.SkipDir
+			case info.Name() == checksumsFile:
+				manifests = append(manifests, path)
+			}
+			return nil
+		})
+		if err != nil {
+			fail("Error reading "+dir, err)
+		}
+	}
+	if len(manifests) == 0 {
+		fmt.Println("[!] No " + checksumsFile + " found")
+		os.Exit(1)
+	}
+
+	start := time.Now()
+	var jobs []verifyJob
+	var total int64
+	bad, remote := 0, 0
+	for _, manifest := range manifests {
+		sums, err := readChecksums(manifest)
+		if err != nil {
+			printError("Error reading "+manifest, err)
+			bad++
+			continue
+		}
+		names := make([]string, 0, len(sums))
+		for name := range sums {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			job := verifyJob{path: filepath.Join(filepath.Dir(manifest), filepath.FromSlash(name)), sum: sums[name]}
+			if info, err := os.Stat(job.path); err == nil {
+				job.size = info.Size()
+				total += job.size
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	checked := len(jobs)
+
+	type verifyResult struct {
+		verifyJob
+		got string // SHA-256 of the file
+		err error
+	}
+	queue := make(chan verifyJob)
+	results := make(chan verifyResult)
+	hashed := &speedMeter{start: start}
+	for i := 0; i < *workers; i++ {
+		go func() {
+			for job := range queue {
+				sum, err := sha256File(job.path, hashed)
+				results <- verifyResult{job, sum, err}
+			}
+		}()
+	}
+	go func() {
+		for _, job := range jobs {
+			queue <- job
+		}
+		close(queue)
+	}()
+
+	// Results come in as the workers finish, with the progress every few
+	// seconds, as hashing a large archive takes a while
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for done := 0; done < len(jobs); {
+		select {
+		case <-ticker.C:
+			fmt.Printf("[~] Verified %d of %d files, %s of %s at %s\n", done, len(jobs),
+				formatBytes(hashed.Total()), formatBytes(total), formatRate(hashed.Average()))
+		case r := <-results:
+			done++
+			switch {
+			case os.IsNotExist(r.err) && tiered(r.path):
+				remote++ // Checked by rclone when it was moved
+			case os.IsNotExist(r.err):
+				fmt.Println("MISSING:", r.path)
+				bad++
+			case r.err != nil:
+				printError("Error reading "+r.path, r.err)
+				bad++
+			case r.got != r.sum:
+				fmt.Println("ALTERED:", r.path)
+				bad++
+			}
+		}
+	}
+	if bad > 0 {
+		fmt.Printf("\n[!] VERIFY FAILED, %d OF %d FILES MISSING OR ALTERED IN %d THREADS\n", bad, checked, len(manifests))
+		os.Exit(1)
+	}
+	fmt.Printf("\n✓ VERIFY PASSED, %d FILES IN %d THREADS IN %v\n", checked-remote, len(manifests), time.Since(start))
+	if remote > 0 {
+		fmt.Printf("  %d files moved to remote storage by tier were not checked\n", remote)
+	}
+}
+
+// tierStub is left in place of a file moved to remote storage by 'tier', as
+// <file>.tiered, saying where it went.
+type tierStub struct {
+	Remote string    `json:"remote"`
+	MD5    string    `json:"md5"`
+	Size   int64     `json:"size"`
+	Tiered time.Time `json:"tiered"`
+}
+
+const tierSuffix = ".tiered"
+
+// tiered reports whether the file at path was moved to remote storage.
+func tiered(path string) bool {
+	_, err := os.Stat(path + tierSuffix)
+	return err == nil
+}
+
+// storedAway reports whether the file at path is archived in another form:
+// encrypted with --encrypt-key, moved to remote storage by 'tier', or both.
+func storedAway(path string) bool {
+	if _, err := os.Stat(path + encryptedSuffix); err == nil {
+		return true
+	}
+	return tiered(path) || tiered(path+encryptedSuffix)
+}
+
+// tierCommand moves the files of the archive older than --older-than to an
+// rclone remote (S3, B2, SFTP, ... anything rclone supports), leaving a stub
+// behind so they aren't downloaded again. It keeps the local disk small while
+// other 4cgets keep archiving into it.
+func tierCommand(args []string) {
+	fs := flag.NewFlagSet("tier", flag.ExitOnError)
+	olderFlag := fs.String("older-than", "30d", "Move files last modified before this (e.g. 30d or 720h)")
+	remoteFlag := fs.String("remote", "", "rclone remote and path to move files to (e.g. s3:bucket/4cget)")
+	dryRunFlag := fs.Bool("dry-run", false, "Only list the files that would be moved")
+	rest := parseArgs(fs, args)
+	if *remoteFlag == "" || len(rest) > 1 {
+		fmt.Println("[!] USAGE: 4cget tier --remote <remote:path> [--older-than 30d] [--dry-run] [dir]")
+		os.Exit(1)
+	}
+	cutoff, err := parseSince(*olderFlag, time.Now())
+	if err != nil {
+		fmt.Println("[!] Invalid --older-than: use a duration like 720h or 30d")
+		os.Exit(1)
+	}
+	root, _ := os.Getwd()
+	if len(rest) == 1 {
+		root, _ = filepath.Abs(rest[0])
+	}
+	if _, err := exec.LookPath("rclone"); err != nil && !*dryRunFlag {
+		fail("Error", errors.New("tier needs rclone (https://rclone.org) in PATH"))
+	}
+
+	var paths []string
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case info.IsDir() && path != root && strings.HasPrefix(info.Name(), "."):
+			return filepath.SkipDir // 4cget's own state, the quarantine and other hidden folders
+		case !info.Mode().IsRegular() || !info.ModTime().Before(cutoff) || threadFiles[info.Name()]:
+		case strings.HasPrefix(info.Name(), "."), strings.HasSuffix(info.Name(), tierSuffix), strings.HasSuffix(info.Name(), ".tmp"):
+		default:
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		fail("Error reading "+root, err)
+	}
+
+	var moved, bytes int64
+	for _, path := range paths {
+		rel, _ := filepath.Rel(root, path)
+		remote := strings.TrimSuffix(*remoteFlag, "/") + "/" + filepath.ToSlash(rel)
+		if *dryRunFlag {
+			fmt.Printf("Would move: %s -> %s\n", rel, remote)
+			continue
+		}
+		sum, size, err := hashFile(path)
+		if err != nil {
+			printError("Error hashing "+rel, err)
+			continue
+		}
+		// rclone checks the copy before removing the local file
+		if out, err := exec.Command("rclone", "moveto", path, remote).CombinedOutput(); err != nil {
+			printError("Error moving "+rel, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out))))
+			continue
+		}
+		data, _ := json.MarshalIndent(tierStub{Remote: remote, MD5: sum, Size: size, Tiered: time.Now().UTC()}, "", "  ")
+		if err := ioutil.WriteFile(path+tierSuffix, append(data, '\n'), 0644); err != nil {
+			printError("Error writing stub of "+rel, err)
+			continue
+		}
+		fmt.Printf("File tiered: %s -> %s\n", rel, remote)
+		moved++
+		bytes += size
+	}
+	if !*dryRunFlag {
+		fmt.Printf("\n[*] MOVED %d FILES (%s) TO %s [*]\n", moved, formatBytes(bytes), *remoteFlag)
+	}
+}
+
+// stateExport is the state of an archive as written by 'state export': its
+// dedupe index, the checkpoints and unfinished queues of its threads, and its
+// lists, readable JSON that 'state import' merges into another archive.
+type stateExport struct {
+	Version   string                   `json:"version"`
+	Exported  time.Time                `json:"exported"`
+	History   []HistoryEntry           `json:"history,omitempty"`
+	Threads   map[string]threadState   `json:"threads,omitempty"` // By state file name, such as "4chan-g-123"
+	Queues    map[string][]downloadJob `json:"queues,omitempty"`  // Likewise
+	Lists     map[string][]string      `json:"lists,omitempty"`   // By path under the archive root
+	WatchList []string                 `json:"watch_list,omitempty"`
+}
+
+// stateLists are the lists of the archive, one entry per line.
+var stateLists = []string{skipListFile, blocklistFile, classifiedFile, ignoreFile}
+
+// readLines returns the non-empty lines of a file.
+func readLines(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// mergeLines appends to a file the lines it doesn't have yet and returns how
+// many were added.
+func mergeLines(path string, lines []string) (int, error) {
+	existing, err := readLines(path)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	known := make(map[string]bool)
+	for _, line := range existing {
+		known[line] = true
+	}
+	var added []string
+	for _, line := range lines {
+		if !known[line] {
+			known[line] = true
+			added = append(added, line)
+		}
+	}
+	if len(added) == 0 {
+		return 0, nil
+	}
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	_, err = f.WriteString(strings.Join(added, "\n") + "\n")
+	return len(added), err
+}
+
+// readStateFiles passes every JSON file of a folder under .4cget to decode,
+// with its name without extension.
+func readStateFiles(dir string, decode func(name string, data []byte) error) error {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := decode(strings.TrimSuffix(filepath.Base(path), ".json"), data); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// stateCommand exports the state of the archive in the current folder to a
+// JSON file, or merges such a file into it, to move an archive to another
+// machine or back it up.
+func stateCommand(args []string) {
+	fs := flag.NewFlagSet("state", flag.ExitOnError)
+	watchFlag := fs.String("watch", "", "Watch list to export or merge the imported one into")
+	rest := parseArgs(fs, args)
+	if len(rest) != 2 || (rest[0] != "export" && rest[0] != "import") {
+		fmt.Println("[!] USAGE: 4cget state export|import <state.json> [--watch <list>]")
+		os.Exit(1)
+	}
+	root, _ := os.Getwd()
+	stateDir := filepath.Join(root, ".4cget", "state")
+	queueDir := filepath.Join(root, ".4cget", "queue")
+
+	if rest[0] == "export" {
+		h, err := openHistory(root)
+		if err != nil {
+			fail("Error reading dedupe index", err)
+		}
+		export := stateExport{Version: version, Exported: time.Now().UTC(), Threads: make(map[string]threadState),
+			Queues: make(map[string][]downloadJob), Lists: make(map[string][]string)}
+		for _, entries := range h.byMD5 {
+			export.History = append(export.History, entries...)
+		}
+		sort.Slice(export.History, func(i, j int) bool { return export.History[i].Time.Before(export.History[j].Time) })
+		err = readStateFiles(stateDir, func(name string, data []byte) error {
+			var st threadState
+			err := json.Unmarshal(data, &st)
+			export.Threads[name] = st
+			return err
+		})
+		if err == nil {
+			err = readStateFiles(queueDir, func(name string, data []byte) error {
+				var jobs []downloadJob
+				err := json.Unmarshal(data, &jobs)
+				// Folders relative to the archive, like the dedupe index, to
+				// import them into an archive somewhere else
+				for i, job := range jobs {
+					if rel, err := filepath.Rel(root, job.Path); err == nil && filepath.IsAbs(job.Path) && !strings.HasPrefix(rel, "..") {
+						jobs[i].Path = filepath.ToSlash(rel)
+					}
+				}
+				export.Queues[name] = jobs
+				return err
+			})
+		}
+		if err != nil {
+			fail("Error reading thread state", err)
+		}
+		for _, list := range stateLists {
+			if lines, err := readLines(filepath.Join(root, list)); err == nil {
+				export.Lists[list] = lines
+			}
+		}
+		if *watchFlag != "" {
+			if export.WatchList, err = readLines(*watchFlag); err != nil {
+				fail("Error reading watch list", err)
+			}
+		}
+		data, err := json.MarshalIndent(export, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(rest[1], append(data, '\n'), 0644)
+		}
+		if err != nil {
+			fail("Error writing "+rest[1], err)
+		}
+		fmt.Printf("[*] EXPORTED %d INDEX ENTRIES, %d THREADS AND %d QUEUES TO %s [*]\n",
+			len(export.History), len(export.Threads), len(export.Queues), rest[1])
+		return
+	}
+
+	data, err := ioutil.ReadFile(rest[1])
+	if err != nil {
+		fail("Error reading "+rest[1], err)
+	}
+	var imported stateExport
+	if err := json.Unmarshal(data, &imported); err != nil {
+		fail("Error reading "+rest[1], err)
+	}
+	h, err := openHistory(root)
+	if err != nil {
+		fail("Error reading dedupe index", err)
+	}
+	for _, e := range imported.History {
+		if err := h.Add(e); err != nil {
+			fail("Error updating dedupe index", err)
+		}
+	}
+	// A checkpoint only replaces an older one, and a queue only a missing one
+	threads, queues := 0, 0
+	for name, st := range imported.Threads {
+		path := filepath.Join(stateDir, safeName(name)+".json")
+		var local threadState
+		if data, err := ioutil.ReadFile(path); err == nil && json.Unmarshal(data, &local) == nil && !st.Checked.After(local.Checked) {
+			continue
+		}
+		data, _ := json.Marshal(st)
+		os.MkdirAll(stateDir, os.ModePerm)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			fail("Error writing thread state", err)
+		}
+		threads++
+	}
+	for name, jobs := range imported.Queues {
+		path := filepath.Join(queueDir, safeName(name)+".json")
+		if _, err := os.Stat(path); err == nil || len(jobs) == 0 {
+			continue
+		}
+		for i, job := range jobs {
+			if !filepath.IsAbs(job.Path) {
+				jobs[i].Path = filepath.Join(root, filepath.FromSlash(job.Path))
+			}
+		}
+		data, _ := json.Marshal(jobs)
+		os.MkdirAll(queueDir, os.ModePerm)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			fail("Error writing queue", err)
+		}
+		queues++
+	}
+	for _, list := range stateLists {
+		if _, err := mergeLines(filepath.Join(root, list), imported.Lists[list]); err != nil {
+			fail("Error updating "+list, err)
+		}
+	}
+	if *watchFlag != "" {
+		if _, err := mergeLines(*watchFlag, imported.WatchList); err != nil {
+			fail("Error updating watch list", err)
+		}
+	}
+	fmt.Printf("[*] MERGED %d INDEX ENTRIES, %d THREADS AND %d QUEUES FROM %s [*]\n", len(imported.History), threads, queues, rest[1])
+}
+
+// loadArgsConfig reads the configuration file given with --config in args,
+// FOURCGET_CONFIG or the default one.
+func loadArgsConfig(args []string) (*Config, error) {
+	configPath, given := os.LookupEnv(envPrefix + "CONFIG")
+	for i, arg := range args {
+		if arg == "--config" && i+1 < len(args) {
+			configPath, given = args[i+1], true
+		} else if strings.HasPrefix(arg, "--config=") {
+			configPath, given = strings.TrimPrefix(arg, "--config="), true
+		}
+	}
+	if !given {
+		configPath = defaultConfigPath()
+	}
+	return loadConfig(configPath, given)
+}
+
+// loadConfiguredSites adds the sites of the configuration file given with
+// --config in args, FOURCGET_CONFIG or the default one, so subcommands
+// recognize their threads too.
+func loadConfiguredSites(args []string) {
+	config, err := loadArgsConfig(args)
+	if err == nil {
+		err = config.addSites()
+	}
+	if err != nil {
+		fail("Error reading configuration", err)
+	}
+}
+
+// threadFiles are the files 4cget writes to a thread folder besides the media.
+var threadFiles = map[string]bool{
+	"metadata.json": true, "info.json": true, "README.txt": true, checksumsFile: true,
+	provenanceFile: true, provenanceFile + ".sig": true, provenanceFile + ".minisig": true,
+	"thread.md": true, "thread.html": true, "tags.txt": true,
+}
+
+// numberPrefixRE matches the prefix --numbered gives file names.
+var numberPrefixRE = regexp.MustCompile(`^\d{4,}_`)
+
+// archivedName returns the name a local file had in the thread, without the
+// prefixes of --numbered and --spoilers prefix.
+func archivedName(name string) string {
+	name = strings.TrimPrefix(name, "spoiler_")
+	return numberPrefixRE.ReplaceAllString(name, "")
+}
+
+// storedName returns the name a local file was written under, without the
+// suffixes of --encrypt-key and --tier.
+func storedName(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, tierSuffix), encryptedSuffix)
+}
+
+// diffCommand compares a thread with its folder without downloading anything:
+// the files of the thread missing from the folder, and the files of the folder
+// the thread doesn't have anymore. Like diff, it exits with status 1 when they
+// differ. Files the archive leaves out on purpose, by its blocklist, ignore
+// rules, classifier or dedupe index, aren't missing.
+func diffCommand(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.String("config", "", "Configuration file to read sites from")
+	rest := parseArgs(fs, args)
+	if len(rest) != 1 {
+		fmt.Println("[!] USAGE: 4cget diff <thread_url>")
+		os.Exit(1)
+	}
+	archiveRoot, _ = os.Getwd()
+	loadConfiguredSites(args)
+	threadURL, err := canonicalThreadURL(rest[0])
+	if err != nil {
+		fail("Error", err)
+	}
+	siteID, board, thread, _ := threadID(threadURL)
+	site := siteInfoMap[siteID]
+
+	dir := threadFolder(archiveRoot, board, thread, 0)
+	if _, err := os.Stat(dir); err != nil {
+		// With --layout date, the folder is named after the day of the thread
+		if matches, _ := filepath.Glob(filepath.Join(archiveRoot, "*", "*", "*", board+"-"+thread)); len(matches) > 0 {
+			dir = matches[0]
+		}
+	}
+	posts, err := fetchPosts(newHTTPClient(netOptions{MaxConns: 2}), site, threadURL, board, thread)
+	if err != nil {
+		failWith(fetchExitCode(err), "Error fetching URL", err)
+	}
+
+	// The lists of the archive, as a run in it would apply them
+	if _, err := os.Stat(filepath.Join(archiveRoot, blocklistFile)); err == nil {
+		if blocklist, err = loadBlocklist(filepath.Join(archiveRoot, blocklistFile)); err != nil {
+			fail("Error reading blocklist", err)
+		}
+	}
+	if ignores, err = loadIgnoreList(archiveRoot, board, thread); err != nil {
+		fail("Error reading "+ignoreFile, err)
+	}
+	if classifier, err = openClassifier(archiveRoot, "", nil, 0); err != nil {
+		fail("Error reading "+classifiedFile, err)
+	}
+	if history, err = openHistory(archiveRoot); err != nil {
+		fail("Error reading dedupe index", err)
+	}
+
+	local := make(map[string]bool) // Names of the local files, as in the thread
+	var paths []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return nil
+		case info.IsDir() && path != dir && strings.HasPrefix(info.Name(), "."):
+			return filepath.SkipDir
+		case info.Mode().IsRegular() && !threadFiles[info.Name()] && !strings.HasSuffix(info.Name(), ".tmp"):
+			name := storedName(info.Name())
+			if threadFiles[name] {
+				return nil
+			}
+			if !strings.HasSuffix(name, ".txt") { // The --tags sidecars don't make their file present
+				local[archivedName(name)] = true
+			}
+			paths = append(paths, path)
+		}
+		return nil
+	})
+
+	remote := make(map[string]bool)
+	var missing []string
+	files, skipped := 0, 0
+	for _, post := range posts {
+		for _, f := range post.Files {
+			files++
+			remote[f.Name] = true
+			if local[f.Name] {
+				continue
+			}
+			if _, duplicate := history.Duplicate(f.MD5, filepath.Join(dir, placeFile(post, f))); skippedFile(site, f) || ignores.IgnoresThread() || (f.MD5 != "" && duplicate) {
+				skipped++
+			} else {
+				missing = append(missing, fmt.Sprintf("%s (post %d)", f.Name, post.No))
+			}
+		}
+	}
+	var gone []string
+	for _, path := range paths {
+		// A sidecar <file>.txt goes with its file
+		if name := archivedName(storedName(filepath.Base(path))); !remote[name] && !remote[strings.TrimSuffix(name, ".txt")] {
+			rel, _ := filepath.Rel(archiveRoot, path)
+			gone = append(gone, rel)
+		}
+	}
+
+	fmt.Printf("[*] DIFF OF %s AND %s [*]\n", threadURL, dir)
+	if len(missing) > 0 {
+		fmt.Printf("\nMissing from the folder (%d):\n", len(missing))
+		for _, m := range missing {
+			fmt.Println("  " + m)
+		}
+	}
+	if len(gone) > 0 {
+		fmt.Printf("\nNo longer in the thread (%d):\n", len(gone))
+		for _, g := range gone {
+			fmt.Println("  " + g)
+		}
+	}
+	fmt.Printf("\n%d files in the thread (%d left out on purpose), %d missing from the folder, %d no longer in the thread\n", files, skipped, len(missing), len(gone))
+	if len(missing) > 0 || len(gone) > 0 {
+		os.Exit(1)
+	}
+}
+
+// catalogThread is a live thread of a board, as listed by 'catalog'.
+type catalogThread struct {
+	URL       string    `json:"url"`
+	Board     string    `json:"board"`
+	Thread    int64     `json:"thread"`
+	Subject   string    `json:"subject,omitempty"`
+	Comment   string    `json:"comment,omitempty"` // Text of the opening post
+	Replies   int       `json:"replies"`
+	Images    int       `json:"images"`
+	Posted    time.Time `json:"posted"`
+	Bumped    time.Time `json:"bumped"`
+	Page      int       `json:"page"`
+	Sticky    bool      `json:"sticky,omitempty"`
+	Closed    bool      `json:"closed,omitempty"`
+	Thumbnail string    `json:"thumbnail,omitempty"` // Of the file of the opening post
+}
+
+// archivedIn reports whether the run of the thread that left st got every post
+// of the thread after its last bump.
+func (t catalogThread) archivedIn(st threadState) bool {
+	return st.Posts == t.Replies+1 && !st.Checked.Before(t.Bumped)
+}
+
+// fetchCatalog lists the live threads of a board from the catalog of a site,
+// in catalog order.
+func fetchCatalog(client *http.Client, site SiteInfo, board string) ([]catalogThread, error) {
+	body, err := fetchAPI(client, site, fmt.Sprintf(site.CatalogAPI, board))
+	if err != nil {
+		return nil, err
+	}
+	var pages []struct {
+		Page    int `json:"page"`
+		Threads []struct {
+			No           int64  `json:"no"`
+			Sub          string `json:"sub"`
+			Com          string `json:"com"`
+			Replies      int    `json:"replies"`
+			Images       int    `json:"images"`
+			Time         int64  `json:"time"`
+			LastModified int64  `json:"last_modified"`
+			Tim          int64  `json:"tim"`
+			Sticky       int    `json:"sticky"`
+			Closed       int    `json:"closed"`
+		} `json:"threads"`
+	}
+	if err := json.Unmarshal(body, &pages); err != nil {
+		return nil, err
+	}
+	var threads []catalogThread
+	for _, p := range pages {
+		for _, t := range p.Threads {
+			c := catalogThread{
+				URL:     fmt.Sprintf("%s/%s/thread/%d", site.URL, board, t.No),
+				Board:   board,
+				Thread:  t.No,
+				Subject: html.UnescapeString(t.Sub),
+				Comment: postText(t.Com),
+				Replies: t.Replies,
+				Images:  t.Images,
+				Posted:  time.Unix(t.Time, 0).UTC(),
+				Bumped:  time.Unix(t.LastModified, 0).UTC(),
+				Page:    p.Page,
+				Sticky:  t.Sticky == 1,
+				Closed:  t.Closed == 1,
+			}
+			if t.Tim != 0 {
+				c.Thumbnail = fmt.Sprintf("https://i.4cdn.org/%s/%ds.jpg", board, t.Tim)
+			}
+			threads = append(threads, c)
+		}
+	}
+	return threads, nil
+}
+
+// sharedCatalogTTL is how long the threads started by watch use the catalog of
+// their board it read, rather than asking the site which page they are on.
+const sharedCatalogTTL = 2 * watchListInterval
+
+// sharedCatalog is a catalog read by watch, kept in catalogsDir.
+type sharedCatalog struct {
+	Fetched time.Time       `json:"fetched"`
+	Threads []catalogThread `json:"threads"`
+}
+
+func sharedCatalogPath(site SiteInfo, board string) string {
+	return filepath.Join(archiveRoot, catalogsDir, safeName(site.ID)+"-"+safeName(board)+".json")
+}
+
+// saveSharedCatalog keeps the catalog of a board read by watch for the threads
+// it starts, replacing the previous one at once.
+func saveSharedCatalog(site SiteInfo, board string, threads []catalogThread) error {
+	data, err := json.Marshal(sharedCatalog{Fetched: time.Now(), Threads: threads})
+	if err != nil {
+		return err
+	}
+	path := sharedCatalogPath(site, board)
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// loadSharedCatalog returns the threads of the catalog of a board saved by
+// watch, if it was read less than sharedCatalogTTL ago.
+func loadSharedCatalog(site SiteInfo, board string) ([]catalogThread, bool) {
+	var c sharedCatalog
+	data, err := ioutil.ReadFile(sharedCatalogPath(site, board))
+	if err != nil || json.Unmarshal(data, &c) != nil || time.Since(c.Fetched) > sharedCatalogTTL {
+		return nil, false
+	}
+	return c.Threads, true
+}
+
+// catalogCommand prints the live threads of a board as JSON or CSV, to be
+// filtered (with jq for example) and handed back to 'watch -'.
+func catalogCommand(args []string) {
+	fs := flag.NewFlagSet("catalog", flag.ExitOnError)
+	formatFlag := fs.String("format", "json", "Output format: 'json' or 'csv'")
+	rest := parseArgs(fs, args)
+	if len(rest) != 1 || (*formatFlag != "json" && *formatFlag != "csv") {
+		fmt.Println("[!] USAGE: 4cget catalog [--format json|csv] <board|board_url>")
+		os.Exit(1)
+	}
+	archiveRoot, _ = os.Getwd()
+	loadConfiguredSites(args)
+
+	// A bare board is a 4chan one
+	site, board := siteInfoMap["4chan"], strings.Trim(rest[0], "/")
+	if u, err := url.Parse(rest[0]); err == nil && u.Host != "" {
+		site, board = siteInfoMap[siteForHost(u.Host)], strings.Split(strings.Trim(u.Path, "/"), "/")[0]
+	}
+	if site.CatalogAPI == "" || board == "" {
+		fmt.Println("[!] No catalog known for " + rest[0])
+		os.Exit(1)
+	}
+	threads, err := fetchCatalog(newHTTPClient(netOptions{MaxConns: 2}), site, board)
+	if err != nil {
+		failWith(fetchExitCode(err), "Error fetching catalog", err)
+	}
+
+	if *formatFlag == "json" {
+		data, _ := json.MarshalIndent(threads, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"url", "board", "thread", "subject", "replies", "images", "posted", "bumped", "page", "sticky", "closed", "thumbnail", "comment"})
+	for _, t := range threads {
+		w.Write([]string{t.URL, t.Board, fmt.Sprint(t.Thread), t.Subject, fmt.Sprint(t.Replies), fmt.Sprint(t.Images),
+			t.Posted.Format(time.RFC3339), t.Bumped.Format(time.RFC3339), fmt.Sprint(t.Page), fmt.Sprint(t.Sticky), fmt.Sprint(t.Closed), t.Thumbnail, t.Comment})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		fail("Error writing catalog", err)
+	}
+}
+
+func main() {
+	if runCommand(os.Args[1:]) {
+		return
+	}
+
+	var wg sync.WaitGroup
+	var inputUrl string
+	var thread string
+	var siteID string
+
+	// Define command-line flags
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	helpFlag := fs.Bool("help", false, "Display this help message")
+	verboseFlag := fs.Bool("verbose", false, "Show more details when something goes wrong")
+	monitorIntervalFlag := fs.Int("monitor", 0, "Enable monitor mode with interval in seconds")
+	logFileFlag := fs.String("log-file", "", "Also write the output to this log file")
+	logMaxSizeFlag := fs.Int("log-max-size", 10, "Rotate the log file once it reaches this size in MB (0 disables)")
+	logMaxAgeFlag := fs.Duration("log-max-age", 0, "Rotate the log file once it is this old (e.g. 24h)")
+	syslogFlag := fs.Bool("syslog", false, "Also send the output to syslog/journald")
+	chmodFlag := fs.String("chmod", "", "Give the archived files this mode (e.g. 0644), and their folders the matching one")
+	chownFlag := fs.String("chown", "", "Give the archived files and folders this owner (user, user:group or :group)")
+	reportFlag := fs.String("report", "", "Write a CSV report of every file and what happened to it")
+	feedFlag := fs.String("feed", "", "Keep an Atom feed of the downloaded files at this path")
+	progressJSONFlag := fs.Bool("progress-json", false, "Print download progress events as JSON lines on stdout, and the rest on stderr")
+	onDeathFlag := fs.String("on-death", "", "In monitor mode, run this command when the thread is deleted, archived or closed")
+	deathWebhookFlag := fs.String("death-webhook", "", "In monitor mode, POST a JSON event to this URL when the thread is deleted, archived or closed")
+	notifyFlag := fs.Bool("notify", false, "Show a desktop notification when a monitored thread gets new files or dies")
+	matrixHomeserverFlag := fs.String("matrix-homeserver", "", "Post a message to a Matrix room through this homeserver when a monitored thread gets new files or dies")
+	matrixTokenFlag := fs.String("matrix-token", "", "Access token of the Matrix account posting the messages")
+	matrixTokenFileFlag := fs.String("matrix-token-file", "", "File holding the access token of the Matrix account, instead of --matrix-token")
+	matrixRoomFlag := fs.String("matrix-room", "", "ID of the Matrix room to post to (!...:server)")
+	adaptiveFlag := fs.Bool("adaptive", false, "Check more often as a monitored thread nears its end")
+	liveFlag := fs.Bool("live", false, "On meguca sites, check a monitored thread as soon as a post gets a file")
+	sleepFlag := fs.Int("sleep", 0, "Sleep duration in seconds between downloads")
+	limitRateFlag := fs.String("limit-rate", "", "Cap the download rate (e.g. 2M), or by time of day (e.g. 01:00-08:00=0,else=1M)")
+	maxConnsFlag := fs.Int("max-conns", 8, "Maximum simultaneous connections per host")
+	cacheTTLFlag := fs.Duration("cache-ttl", 0, "Keep thread data on disk and reuse it across runs for this long (e.g. 10m)")
+	checkFlag := fs.Bool("check", false, "Fetch the thread again at the end and report files missing locally")
+	apiConnsFlag := fs.Int("api-conns", 2, "Maximum simultaneous connections per host for thread pages and API calls")
+	orderFlag := fs.String("order", "", "Download the 'newest' or 'oldest' posts, or the 'largest' or 'smallest' files first")
+	priorityFlag := fs.String("priority", "", "Older name of --order")
+	workersFlag := fs.Int("workers", 8, "Number of simultaneous downloads")
+	queueSizeFlag := fs.Int("queue-size", 64, "Maximum number of files waiting to be downloaded")
+	maxDownloadsFlag := fs.Int("max-downloads", 0, "Simultaneous downloads shared by every 4cget running from this folder, taken in turns")
+	resolverFlag := fs.String("resolver", "", "DNS server to use instead of the system resolver (e.g. 9.9.9.9)")
+	dohFlag := fs.String("doh", "", "Resolve names with DNS-over-HTTPS (e.g. https://1.1.1.1/dns-query)")
+	ipv4Flag := fs.Bool("4", false, "Only connect over IPv4")
+	ipv6Flag := fs.Bool("6", false, "Only connect over IPv6")
+	tlsMinFlag := fs.String("tls-min", "", "Minimum TLS version (1.0, 1.1, 1.2 or 1.3)")
+	caFileFlag := fs.String("ca-file", "", "PEM file of extra certificate authorities to trust")
+	insecureFlag := fs.Bool("insecure", false, "Don't verify TLS certificates")
+	proxyFlag := fs.String("proxy", "", "Proxy URL (e.g., http://proxyserver:port)")
+	fallbackProxyFlag := fs.String("fallback-proxy", "", "Proxy to switch downloads to when the media host keeps answering HTTP 403")
+	maxFailuresFlag := fs.Int("max-failures", 200, "Abort the run after this many failed requests, retries included (0 disables)")
+	maxFailureRateFlag := fs.Float64("max-failure-rate", 50, "Abort the run once more than this percentage of the files failed (0 disables)")
+	proxyUserFlag := fs.String("proxyuser", "", "Proxy username")
+	proxyPassFlag := fs.String("proxypass", "", "Proxy password")
+	var cookieFlag listFlag
+	fs.Var(&cookieFlag, "cookie", "Send this cookie to the site, as name=value (repeatable)")
+	passIDFlag := fs.String("pass-id", "", "4chan Pass session (the pass_id cookie)")
+	skipExistingFlag := fs.Bool("skip-existing", false, "Never download a file that already exists locally")
+	overwriteFlag := fs.Bool("overwrite", false, "Always download files again, replacing local copies")
+	updateFlag := fs.Bool("update", false, "Download files again only if the remote size or MD5 differs")
+	chunkThresholdFlag := fs.Int("chunk-threshold", 10, "Download files of at least this many MB in parallel ranges (0 disables)")
+	chunksFlag := fs.Int("chunks", 4, "Number of parallel ranges for large files")
+	verifyMD5Flag := fs.Bool("verify-md5", false, "Also compare MD5s when checking whether a local file is complete")
+	dedupeFlag := fs.Bool("dedupe", false, "Skip files already stored anywhere in the archive")
+	blocklistFlag := fs.String("blocklist", "", "File of MD5s and filename patterns that are never downloaded")
+	filterCommentFlag := fs.String("filter-comment", "", "Only download files of posts whose text matches this regex")
+	excludeCommentFlag := fs.String("exclude-comment", "", "Skip files of posts whose text matches this regex")
+	sinceFlag := fs.String("since", "", "Only download files of posts newer than this duration ago (e.g. 2h) or time")
+	spoilersFlag := fs.String("spoilers", "", "Mark spoilered files with a 'prefix' or put them in a 'folder'")
+	numberedFlag := fs.Bool("numbered", false, "Prefix filenames with their position in the thread (0001_, 0002_, ...)")
+	groupByFlag := fs.String("group-by", "", "Put files into subfolders by 'poster' ID")
+	layoutFlag := fs.String("layout", "board", "Archive threads in 'board' or 'date' folders")
+	metadataFlag := fs.Bool("metadata", false, "Write the thread's post and file metadata to metadata.json")
+	signKeyFlag := fs.String("sign-key", "", "Sign a provenance manifest of each thread folder with this OpenSSH or minisign private key")
+	noChecksumsFlag := fs.Bool("no-checksums", false, "Don't write SHA256SUMS to the thread folder")
+	noInfoFlag := fs.Bool("no-info", false, "Don't write README.txt and info.json to the thread folder")
+	tombstonesFlag := fs.Bool("tombstones", false, "Record posts and files deleted from the thread in metadata.json")
+	exportFlag := fs.String("export", "", "Also save the thread as 'markdown' and/or 'html' (comma separated)")
+	fsyncFlag := fs.Bool("fsync", false, "Flush every download to disk before counting it as done")
+	tempDirFlag := fs.String("direct-temp-dir", "", "Write downloads to this folder first and move them into the archive once complete")
+	encryptKeyFlag := fs.String("encrypt-key", "", "Encrypt the files stored in the thread folders with this key file (see 4cget keygen)")
+	xattrFlag := fs.Bool("xattr", false, "Store the URL and MD5 of the files in extended attributes (Linux and macOS)")
+	tagsFlag := fs.String("tags", "", "Write booru tags of the files: 'sidecar' (<file>.txt) or 'file' (tags.txt)")
+	saveThreadFlag := fs.Bool("save-thread", false, "Save the thread text: same as --metadata --export markdown,html")
+	noMediaFlag := fs.Bool("no-media", false, "Don't download any file, only the thread text with --save-thread")
+	refreshMetadataFlag := fs.Bool("refresh-metadata", false, "Update the text of the threads archived in the given folders, without downloading files")
+	classifyFlag := fs.String("classify", "", "Command printing the categories of a downloaded file ({path} is replaced)")
+	classifySkipFlag := fs.String("classify-skip", "", "Remove downloaded files classified in these categories (comma separated)")
+	classifyThresholdFlag := fs.Float64("classify-threshold", 0.5, "Minimum score for --classify-skip to remove a file")
+	sauceNAOKeyFlag := fs.String("saucenao-key", "", "Look up the source of downloaded images on SauceNAO with this API key")
+	sauceNAOMinFlag := fs.Float64("saucenao-min", 80, "Minimum SauceNAO similarity, in percent, to save a source")
+	var postProcessFlag, threadProcessFlag listFlag
+	fs.Var(&postProcessFlag, "post-process", "Run this step on each downloaded file: strip-exif, convert png|jpeg, hash or exec <command> (repeatable, in order)")
+	fs.Var(&threadProcessFlag, "thread-process", "Run this step on the finished thread: exec <command> or upload (repeatable, in order)")
+	iaItemFlag := fs.String("ia-item", "", "Upload the finished thread to this Internet Archive item ({site}, {board} and {thread} are replaced)")
+	iaAccessFlag := fs.String("ia-access", "", "Internet Archive S3 access key, for --ia-item")
+	iaSecretFlag := fs.String("ia-secret", "", "Internet Archive S3 secret key, for --ia-item")
+	var mediaHostFlag listFlag
+	fs.Var(&mediaHostFlag, "media-host", "Fetch media from another host, as from=to (repeatable)")
+	listenFlag := fs.String("listen", "", "In monitor mode, accept threads to archive with POST /add on this address")
+	tokenFlag := fs.String("token", "", "Token that requests to --listen must carry (default: a random one)")
+	clipboardFlag := fs.Bool("clipboard", false, "In monitor mode, also archive the thread URLs copied to the clipboard")
+	configFlag := fs.String("config", "", "Configuration file")
+	profileFlag := fs.String("profile", "", "Use the settings of this profile of the configuration file")
+	boardFlag := fs.String("board", "", "Board of a from-file snapshot, when the snapshot doesn't say")
+	threadFlag := fs.String("thread", "", "Thread of a from-file snapshot, when the snapshot doesn't say")
+
+	// Diagnostics, intentionally left out of --help
+	pprofFlag := fs.String("pprof", "", "Serve net/http/pprof on this address (e.g. 127.0.0.1:6060)")
+	cpuProfileFlag := fs.String("cpuprofile", "", "Write a CPU profile to this file")
+	memProfileFlag := fs.String("memprofile", "", "Write a heap profile to this file on exit")
+
+	// Completion scripts are generated from the options above
+	if len(os.Args) > 1 && os.Args[1] == "completion" {
+		completionCommand(fs, os.Args[2:], "pprof", "cpuprofile", "memprofile", "priority")
+		return
+	}
+
+	args := parseArgs(fs, os.Args[1:])
+
+	// Settings from the environment apply unless given on the command line, and
+	// those from the configuration file unless given in either
+	explicit := make(map[string]bool)
+	commandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name], commandLine[f.Name] = true, true })
+	errConfig := applyEnv(fs, explicit)
+	configPath := *configFlag
+	if configPath == "" {
+		configPath = defaultConfigPath()
+	}
+	var config *Config
+	if errConfig == nil {
+		config, errConfig = loadConfig(configPath, *configFlag != "")
+	}
+	if errConfig == nil {
+		errConfig = config.addSites()
+	}
+	if errConfig == nil {
+		errConfig = config.apply(fs, "", explicit)
+	}
+	if errConfig != nil {
+		fail("Error reading configuration", errConfig)
+	}
+	if config.exposesSecrets(secretOptions...) {
+		fmt.Printf("[!] Warning: %s holds credentials but other users can read it, restrict it with: chmod 600 %[1]s\n", configPath)
+	}
+
+	// If --help is provided, display help message and exit
+	if *helpFlag {
+		displayHelp()
+		return
+	}
+
+	// Input URL validation
+	if len(args) < 1 && !*refreshMetadataFlag {
+		fmt.Println("[!] USAGE: 4cget [options] <thread_url>")
+		fmt.Println("Use '--help' to see available options.")
+		os.Exit(1)
+	}
+	if *refreshMetadataFlag {
+		// The arguments are archive folders, each thread says its own URL
+		if len(args) == 0 {
+			args = []string{"."}
+		}
+	} else {
+		inputUrl = args[0]
+	}
+
+	// Then those of the board's own section, such as [board.wg]
+	board := *boardFlag
+	if parsed, err := url.Parse(inputUrl); err == nil && inputUrl != "from-file" {
+		board = strings.Split(strings.Trim(parsed.Path, "/"), "/")[0]
+	}
+	if board != "" {
+		if err := config.apply(fs, "board."+board, explicit); err != nil {
+			fmt.Println("[!] Error reading configuration:", err)
+			os.Exit(1)
+		}
+	}
+
+	// And last those of the chosen profile, such as [profile.videos]
+	if *profileFlag != "" {
+		if _, ok := config.sections["profile."+*profileFlag]; !ok {
+			fmt.Printf("[!] No [profile.%s] section in %s\n", *profileFlag, configPath)
+			os.Exit(1)
+		}
+		if err := config.apply(fs, "profile."+*profileFlag, explicit); err != nil {
+			fmt.Println("[!] Error reading configuration:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *progressJSONFlag {
+		events = newProgressEvents(os.Stdout)
+		os.Stdout = os.Stderr
+	}
+	monitorMode = (*monitorIntervalFlag > 0)
+	cacheTTL = *cacheTTLFlag
+	dedupeMode = *dedupeFlag
+	notifyMode = *notifyFlag
+	verboseMode = *verboseFlag
+	verifyMD5 = *verifyMD5Flag
+	chunkThreshold = int64(*chunkThresholdFlag) * 1024 * 1024
+	chunkCount = *chunksFlag
+	downloadOrder := *orderFlag
+	if downloadOrder == "" {
+		downloadOrder = *priorityFlag
+	}
+	switch downloadOrder {
+	case "", "newest", "oldest", "largest", "smallest":
+	default:
+		fmt.Println("[!] --order must be 'newest', 'oldest', 'largest' or 'smallest'")
+		os.Exit(1)
+	}
+	if (*listenFlag != "" || *clipboardFlag) && !monitorMode {
+		fmt.Println("[!] --listen and --clipboard need --monitor, to keep 4cget running")
+		os.Exit(1)
+	}
+	if *refreshMetadataFlag && monitorMode {
+		fmt.Println("[!] --refresh-metadata updates the archive once, it can't be used with --monitor")
+		os.Exit(1)
+	}
+	if *matrixTokenFileFlag != "" {
+		data, err := ioutil.ReadFile(*matrixTokenFileFlag)
+		if err != nil {
+			fmt.Println("[!] Error reading --matrix-token-file:", err)
+			os.Exit(1)
+		}
+		*matrixTokenFlag = strings.TrimSpace(string(data))
+	}
+	if (*matrixHomeserverFlag != "" || *matrixTokenFlag != "" || *matrixRoomFlag != "") &&
+		(*matrixHomeserverFlag == "" || *matrixTokenFlag == "" || *matrixRoomFlag == "") {
+		fmt.Println("[!] Use --matrix-homeserver, --matrix-token (or --matrix-token-file) and --matrix-room together")
+		os.Exit(1)
+	}
+	if *matrixRoomFlag != "" && !strings.HasPrefix(*matrixRoomFlag, "!") {
+		fmt.Println("[!] --matrix-room must be a room ID such as !abcdef:matrix.org, not an alias (see the room's advanced settings)")
+		os.Exit(1)
+	}
+	if *workersFlag < 1 || *queueSizeFlag < 0 || *maxDownloadsFlag < 0 {
+		fmt.Println("[!] --workers must be at least 1, and --queue-size and --max-downloads can't be negative")
+		os.Exit(1)
+	}
+
+	stopProfiling := startProfiling(*pprofFlag, *cpuProfileFlag, *memProfileFlag)
+	defer stopProfiling()
+	exitFlush = stopProfiling
+	handleInterrupts()
+	// Without an explicit policy, keep the historical behavior: a single run
+	// refreshes every file, monitor mode only fetches new ones.
+	existingPolicy = "overwrite"
+	if monitorMode {
+		existingPolicy = "skip"
+	}
+	policies := 0
+	for policy, set := range map[string]bool{"skip": *skipExistingFlag, "overwrite": *overwriteFlag, "update": *updateFlag} {
+		if set {
+			existingPolicy = policy
+			policies++
+		}
+	}
+	if policies > 1 {
+		fmt.Println("[!] Use only one of --skip-existing, --overwrite and --update")
+		os.Exit(1)
+	}
+	spoilerMode = *spoilersFlag
+	if spoilerMode != "" && spoilerMode != "prefix" && spoilerMode != "folder" {
+		fmt.Println("[!] --spoilers must be 'prefix' or 'folder'")
+		os.Exit(1)
+	}
+	numbered = *numberedFlag
+	var errHosts error
+	if mediaHosts, errHosts = parseMediaHosts(mediaHostFlag); errHosts != nil {
+		fmt.Println("[!]", errHosts)
+		os.Exit(1)
+	}
+	groupBy = *groupByFlag
+	if groupBy != "" && groupBy != "poster" {
+		fmt.Println("[!] --group-by must be 'poster'")
+		os.Exit(1)
+	}
+	layout = *layoutFlag
+	if layout != "board" && layout != "date" {
+		fmt.Println("[!] --layout must be 'board' or 'date'")
+		os.Exit(1)
+	}
+	if *tagsFlag != "" && *tagsFlag != "sidecar" && *tagsFlag != "file" {
+		fmt.Println("[!] --tags must be 'sidecar' or 'file'")
+		os.Exit(1)
+	}
+	if *tombstonesFlag {
+		*metadataFlag = true
+	}
+	if *saveThreadFlag {
+		*metadataFlag = true
+		if *exportFlag == "" {
+			*exportFlag = "markdown,html"
+		}
+	}
+	var exportFormats []string
+	if *exportFlag != "" {
+		for _, format := range strings.Split(*exportFlag, ",") {
+			format = strings.TrimSpace(format)
+			if format != "markdown" && format != "html" {
+				fmt.Printf("[!] Unknown export format: %s (use 'markdown' or 'html')\n", format)
+				os.Exit(1)
+			}
+			exportFormats = append(exportFormats, format)
+		}
+	}
+	var threadSteps []processStep
+	var errSteps error
+	if fileSteps, errSteps = parseSteps(postProcessFlag, "strip-exif", "convert", "hash", "exec"); errSteps != nil {
+		fmt.Println("[!] Invalid --post-process:", errSteps)
+		os.Exit(1)
+	}
+	if threadSteps, errSteps = parseSteps(threadProcessFlag, "exec", "upload"); errSteps != nil {
+		fmt.Println("[!] Invalid --thread-process:", errSteps)
+		os.Exit(1)
+	}
+	uploads := false
+	for _, step := range threadSteps {
+		uploads = uploads || step.name == "upload"
+	}
+	if uploads && *iaItemFlag == "" {
+		fmt.Println("[!] The upload step needs --ia-item")
+		os.Exit(1)
+	}
+	if *iaItemFlag != "" && !uploads {
+		threadSteps = append(threadSteps, processStep{name: "upload"})
+	}
+	if (*classifyFlag == "") != (*classifySkipFlag == "") {
+		fmt.Println("[!] Use --classify and --classify-skip together")
+		os.Exit(1)
+	}
+	if *iaItemFlag != "" && (*iaAccessFlag == "" || *iaSecretFlag == "") {
+		fmt.Println("[!] --ia-item needs --ia-access and --ia-secret (see https://archive.org/account/s3.php)")
+		os.Exit(1)
+	}
+	if *maxFailuresFlag < 0 || *maxFailureRateFlag < 0 || *maxFailureRateFlag > 100 {
+		fmt.Println("[!] --max-failures can't be negative and --max-failure-rate must be between 0 and 100")
+		os.Exit(1)
+	}
+	budget.maxFailures, budget.maxRate = *maxFailuresFlag, *maxFailureRateFlag
+	if *limitRateFlag != "" {
+		l, err := parseRateSchedule(*limitRateFlag)
+		if err != nil {
+			fmt.Println("[!] Invalid --limit-rate:", err)
+			os.Exit(1)
+		}
+		bandwidth = l
+	}
+	secondsIteration := *monitorIntervalFlag
+	sleepDuration := *sleepFlag
+	proxyURL := *proxyFlag
 
-	fmt.Println("Folder created : " + actualPath + "...\n")
+	// A snapshot read with from-file stands in for the live thread
+	var snapshot *threadMetadata
+	if inputUrl == "from-file" {
+		if len(args) < 2 {
+			fmt.Println("[!] USAGE: 4cget from-file [options] <thread.json|thread.html>")
+			os.Exit(1)
+		}
+		var err error
+		snapshot, err = loadSnapshot(args[1], *boardFlag, *threadFlag)
+		if err != nil {
+			fail("Error reading snapshot", err)
+		}
+		inputUrl = snapshot.URL
+		monitorMode = false
+	}
+
+	if *refreshMetadataFlag {
+		// Each archived thread has its own site, read from its metadata.json
+	} else if snapshot == nil {
+		parsedURL, errParse := url.ParseRequestURI(inputUrl)
+		if errParse != nil {
+			fmt.Println("[!] URL NOT VALID (Example: https://boards.4channel.org/w/thread/.../...)")
+			os.Exit(1)
+		}
+		siteID = siteForHost(parsedURL.Host)
+	} else {
+		siteID = snapshot.Site
+	}
+
+	if siteID == "" && !*refreshMetadataFlag {
+		fmt.Println("[!] Unsupported site")
+		os.Exit(1)
+	}
+	site := siteInfoMap[siteID]
+	if snapshot == nil && !*refreshMetadataFlag {
+		// Folders and state follow the board and thread number, whatever the slug
+		var err error
+		if inputUrl, err = canonicalThreadURL(inputUrl); err != nil {
+			fmt.Println("[!] URL NOT VALID (Example: https://boards.4channel.org/w/thread/.../...)")
+			os.Exit(1)
+		}
+	}
+
+	var errFilter error
+	if *filterCommentFlag != "" {
+		if filterComment, errFilter = regexp.Compile(*filterCommentFlag); errFilter != nil {
+			fmt.Println("[!] Invalid --filter-comment pattern:", errFilter)
+			os.Exit(1)
+		}
+	}
+	if *excludeCommentFlag != "" {
+		if excludeComment, errFilter = regexp.Compile(*excludeCommentFlag); errFilter != nil {
+			fmt.Println("[!] Invalid --exclude-comment pattern:", errFilter)
+			os.Exit(1)
+		}
+	}
+	if monitorMode && time.Duration(secondsIteration)*time.Second < site.MinRefresh {
+		secondsIteration = int(site.MinRefresh / time.Second)
+		fmt.Printf("[!] %s asks for threads to be refreshed at most every %v, using --monitor %d\n", site.ID, site.MinRefresh, secondsIteration)
+	}
+	if (filterComment != nil || excludeComment != nil) && site.ThreadAPI == "" {
+		fmt.Println("[!] Comment filters need post text, which is not available for this site")
+		os.Exit(1)
+	}
+	if *sinceFlag != "" {
+		var err error
+		if since, err = parseSince(*sinceFlag, time.Now()); err != nil {
+			fmt.Println("[!]", err)
+			os.Exit(1)
+		}
+		if site.ThreadAPI == "" && snapshot == nil {
+			fmt.Println("[!] --since needs post times, which are not available for this site")
+			os.Exit(1)
+		}
+	}
+
+	var errPerms error
+	if archivePerms, errPerms = parsePermissions(*chmodFlag, *chownFlag); errPerms != nil {
+		fmt.Println("[!]", errPerms)
+		os.Exit(1)
+	}
+	fsyncMode = *fsyncFlag
+	if tempDir = *tempDirFlag; tempDir != "" {
+		if err := os.MkdirAll(tempDir, os.ModePerm); err != nil {
+			fail("Error creating --direct-temp-dir", err)
+		}
+	}
+	if xattrMode = *xattrFlag; xattrMode && setXattr == nil {
+		fmt.Printf("[!] --xattr is not supported on %s\n", runtime.GOOS)
+		os.Exit(1)
+	}
+	if signKey = *signKeyFlag; signKey != "" {
+		if *noChecksumsFlag {
+			fmt.Println("[!] --sign-key signs the checksums, it can't be used with --no-checksums")
+			os.Exit(1)
+		}
+		if _, err := os.Stat(signKey); err != nil {
+			fmt.Println("[!] Invalid --sign-key:", err)
+			os.Exit(1)
+		}
+	}
+	if *encryptKeyFlag != "" {
+		var err error
+		if archiveKey, err = loadKey(*encryptKeyFlag); err != nil {
+			fmt.Println("[!] Invalid --encrypt-key:", err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Print(`
+░░██╗██╗░█████╗░░██████╗░███████╗████████╗
+░██╔╝██║██╔══██╗██╔════╝░██╔════╝╚══██╔══╝
+██╔╝░██║██║░░╚═╝██║░░██╗░█████╗░░░░░██║░░░
+███████║██║░░██╗██║░░╚██╗██╔══╝░░░░░██║░░░
+╚════██║╚█████╔╝╚██████╔╝███████╗░░░██║░░░
+░░░░░╚═╝░╚════╝░░╚═════╝░╚══════╝░░░╚═╝░░░
+                    [ github.com/SegoCode ]` + "\n\n")
 
 	// Setup HTTP client with optional proxy and authentication
-	client := &http.Client{}
+	tlsConfig, errTLS := newTLSConfig(*tlsMinFlag, *caFileFlag, *insecureFlag)
+	if errTLS != nil {
+		fmt.Println("[!] Invalid TLS settings:", errTLS)
+		os.Exit(1)
+	}
+	if *insecureFlag {
+		fmt.Println("[!] TLS certificate verification is disabled (--insecure)")
+	}
+	var network string
+	switch {
+	case *ipv4Flag && *ipv6Flag:
+		fmt.Println("[!] Use only one of --4 and --6")
+		os.Exit(1)
+	case *ipv4Flag:
+		network = "tcp4"
+	case *ipv6Flag:
+		network = "tcp6"
+	}
+	var proxyParsed *url.URL
 	if proxyURL != "" {
-		proxyParsed, err := url.Parse(proxyURL)
+		var err error
+		proxyParsed, err = url.Parse(proxyURL)
 		if err != nil {
 			fmt.Println("[!] Invalid proxy URL:", err)
 			os.Exit(1)
@@ -325,24 +7926,414 @@ func main() {
 		if *proxyUserFlag != "" {
 			proxyParsed.User = url.UserPassword(*proxyUserFlag, *proxyPassFlag)
 		}
-		client.Transport = &http.Transport{Proxy: http.ProxyURL(proxyParsed)}
 	}
+	netOpts := netOptions{
+		Proxy:    proxyParsed,
+		MaxConns: *maxConnsFlag,
+		Resolver: *resolverFlag,
+		DoH:      *dohFlag,
+		Network:  network,
+		TLS:      tlsConfig,
+	}
+	client := newHTTPClient(netOpts)
 
-	for { // Main loop for monitorMode
-		resp, err := client.Get(inputUrl)
+	// Thread pages and API calls get their own connection pool, so polling
+	// stays responsive while big downloads saturate the media one
+	netOpts.MaxConns = *apiConnsFlag
+	apiClient := newHTTPClient(netOpts)
+
+	if *matrixRoomFlag != "" {
+		matrix = newMatrixRoom(apiClient, *matrixHomeserverFlag, *matrixTokenFlag, *matrixRoomFlag)
+		defer matrix.Close()
+		flushProfiling := exitFlush
+		exitFlush = func() {
+			matrix.Close()
+			flushProfiling()
+		}
+	}
+
+	if *fallbackProxyFlag != "" {
+		fallback, err := url.Parse(*fallbackProxyFlag)
 		if err != nil {
-			fmt.Println("[!] Error fetching URL:", err)
+			fmt.Println("[!] Invalid fallback proxy URL:", err)
 			os.Exit(1)
 		}
-		body, _ := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-		imageURLs := findImages(string(body), siteID)
-		for _, each := range imageURLs {
-			parts := strings.Split(each, "/")
-			nameImg := parts[len(parts)-1]
+		netOpts.Proxy, netOpts.MaxConns = fallback, *maxConnsFlag
+		bans.fallback = newHTTPClient(netOpts)
+	}
+
+	if len(cookieFlag) > 0 || *passIDFlag != "" {
+		jar, err := sessionJar(site, cookieFlag, *passIDFlag)
+		if err != nil {
+			fail("Error", err)
+		}
+		client.Jar, apiClient.Jar = jar, jar
+		if bans.fallback != nil {
+			bans.fallback.Jar = jar
+		}
+	}
+
+	if *logFileFlag != "" || *syslogFlag {
+		stopLogging, err := startLogging(*logFileFlag, int64(*logMaxSizeFlag)*1024*1024, *logMaxAgeFlag, *syslogFlag)
+		if err != nil {
+			fail("Error opening log", err)
+		}
+		defer stopLogging()
+		flush := exitFlush
+		exitFlush = func() {
+			flush()
+			stopLogging()
+		}
+	}
+
+	if *refreshMetadataFlag {
+		start := time.Now()
+		refreshed, failed := refreshMetadata(apiClient, args, exportFormats, *tombstonesFlag)
+		fmt.Printf("\n✓ REFRESH COMPLETE, %d THREADS UPDATED IN %v\n", refreshed, time.Since(start).Round(time.Second))
+		if failed > 0 {
+			fmt.Printf("[!] %d threads couldn't be refreshed\n", failed)
+			exitFlush()
+			os.Exit(1)
+		}
+		return
+	}
+
+	var launcher *threadLauncher
+	if *listenFlag != "" || *clipboardFlag {
+		options := forwardedArgs(fs, commandLine, "listen", "token", "clipboard", "log-file", "syslog", "progress-json", "pprof", "cpuprofile", "memprofile", "check", "board", "thread")
+		var err error
+		if launcher, err = newThreadLauncher(inputUrl, options); err != nil {
+			fail("Error", err)
+		}
+		launcher.secrets = forwardedSecrets(fs, commandLine)
+	}
+	if *clipboardFlag {
+		if err := watchClipboard(launcher, time.Second); err != nil {
+			fail("Error watching the clipboard", err)
+		}
+		fmt.Print("[*] WATCHING THE CLIPBOARD FOR THREAD URLS [*]\n\n")
+	}
+	if *listenFlag != "" {
+		token := *tokenFlag
+		if token == "" {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				fail("Error generating the --listen token", err)
+			}
+			token = hex.EncodeToString(b)
+		}
+		if err := startListener(*listenFlag, token, launcher); err != nil {
+			fail("Error starting listener", err)
+		}
+		if host, _, _ := net.SplitHostPort(*listenFlag); host != "localhost" && !net.ParseIP(host).IsLoopback() {
+			fmt.Println("[!] Warning: --listen is reachable from other machines, anyone with the token can add threads")
+		}
+		// The token stays out of the output, which --log-file and --syslog keep
+		bookmarklet := fmt.Sprintf("javascript:fetch('http://%s/add?token=%s&url='+encodeURIComponent(location.href),{method:'POST',mode:'no-cors'})\n", *listenFlag, token)
+		os.MkdirAll(filepath.Dir(listenFile), os.ModePerm)
+		if err := ioutil.WriteFile(listenFile, []byte(bookmarklet), 0600); err != nil {
+			fail("Error writing "+listenFile, err)
+		}
+		fmt.Printf("[*] LISTENING ON %s [*]\n", *listenFlag)
+		fmt.Printf("Bookmarklet, with the token, in %s\n\n", listenFile)
+	}
+
+	// Check for updates before starting the download
+	latestVersion, updateAvailable := checkForUpdates(apiClient)
+	if updateAvailable {
+		fmt.Printf("[*] UPDATE AVAILABLE %s [*]\n\n", latestVersion)
+	}
+
+	if snapshot != nil {
+		fmt.Printf("[*] DOWNLOAD STARTED (%s) [*]\n\n", args[1])
+	} else {
+		fmt.Printf("[*] DOWNLOAD STARTED (%s) [*]\n\n", inputUrl)
+	}
+	if monitorMode {
+		fmt.Print("[*] MONITOR MODE ENABLED [*]\n\n")
+	}
+
+	start := time.Now()
+
+	// Parse board and thread from URL
+	if snapshot != nil {
+		board, thread = snapshot.Board, snapshot.Thread
+	} else {
+		_, board, thread, _ = threadID(inputUrl)
+	}
+
+	// Create necessary directories
+	actualPath, _ := os.Getwd()
+	archiveRoot = actualPath
+	var pathResult string // With --layout date, known once the thread is fetched
+	if layout != "date" {
+		pathResult = threadFolder(actualPath, board, thread, 0)
+		os.MkdirAll(pathResult, os.ModePerm)
+	}
+
+	var errHistory error
+	history, errHistory = openHistory(actualPath)
+	if errHistory != nil {
+		fail("Error reading dedupe index", errHistory)
+	}
+
+	blocklistPath := *blocklistFlag
+	if blocklistPath == "" {
+		if _, err := os.Stat(filepath.Join(actualPath, blocklistFile)); err == nil {
+			blocklistPath = filepath.Join(actualPath, blocklistFile)
+		}
+	}
+	if blocklistPath != "" {
+		var err error
+		blocklist, err = loadBlocklist(blocklistPath)
+		if err != nil {
+			fail("Error reading blocklist", err)
+		}
+	}
+
+	if *classifyFlag != "" {
+		var err error
+		classifier, err = openClassifier(actualPath, *classifyFlag, strings.Split(*classifySkipFlag, ","), *classifyThresholdFlag)
+		if err != nil {
+			fail("Error reading "+classifiedFile, err)
+		}
+	}
+	if *reportFlag != "" {
+		report = newReport(*reportFlag)
+	}
+	if *sauceNAOKeyFlag != "" {
+		sources = newSourceLookup(apiClient, *sauceNAOKeyFlag, *sauceNAOMinFlag)
+	}
+	if *feedFlag != "" {
+		var err error
+		feed, err = openFeed(*feedFlag)
+		if err != nil {
+			fail("Error reading feed", err)
+		}
+	}
+
+	fmt.Println("Folder created : " + actualPath + "...\n")
+
+	// Downloads go through a bounded queue served by a fixed pool of workers,
+	// so huge threads don't turn into thousands of goroutines
+	jobs := make(chan downloadJob, *queueSizeFlag)
+	if *maxDownloadsFlag > 0 {
+		turns = &downloadTurns{dir: filepath.Join(actualPath, turnsDir), max: *maxDownloadsFlag}
+		os.MkdirAll(turns.dir, os.ModePerm)
+	}
+	queue, leftover := openQueue(actualPath, board, thread)
+	startWorkers(*workersFlag, jobs, &wg, client, queue)
+	if len(leftover) > 0 {
+		fmt.Printf("[*] RESUMING %d FILES LEFT BY THE PREVIOUS RUN [*]\n\n", len(leftover))
+	}
+
+	meter.start = time.Now()
+	stopReport := make(chan struct{})
+	go meter.report(5*time.Second, stopReport)
+
+	var live chan struct{} // With --live, signals that the thread changed
+	if *liveFlag && monitorMode {
+		if site.Engine != "meguca" {
+			fmt.Println("[!] --live is only available on meguca sites, checking every interval")
+		} else {
+			live = make(chan struct{}, 1)
+			go watchLive(apiClient, site, board, thread, live)
+		}
+	}
+
+	// A previous run of the thread, even an interrupted one, is carried on
+	state := loadThreadState(actualPath, siteID, board, thread)
+	lastPost := state.LastPost // Newest post of the previous check, to notify about new files
+	lastPosts := state.Posts   // Posts of the previous check, for the death of the thread
+	for url, n := range state.FileNumbers {
+		fileNumbers[url] = n
+	}
+	if lastPost > 0 {
+		fmt.Printf("[*] CARRYING ON FROM POST %d, LAST CHECKED %s [*]\n\n", lastPost, state.Checked.Local().Format("2006-01-02 15:04"))
+	}
+	var seenPosts []Post       // Posts of the previous check, or of metadata.json, for --tombstones
+	var tombstones []tombstone // Deletions noticed so far, for --tombstones
+	tombstonesLoaded := false
+	announced := false // The title and OP text were shown
+	death := func(reason string) {
+		// A later run of a dead thread, to finish its files, doesn't announce it again
+		if state.Died != "" {
+			return
+		}
+		state.Died = reason
+		if err := saveThreadState(actualPath, siteID, board, thread, state); err != nil {
+			printError("Error saving thread state", err)
+		}
+		announceDeath(client, *onDeathFlag, *deathWebhookFlag, threadDeath{Site: siteID, Board: board, Thread: thread, URL: inputUrl,
+			Dir: pathResult, Reason: reason, Posts: lastPosts, Files: stats.Downloaded(), Bytes: meter.Total()})
+	}
+	baseline := runtime.NumGoroutine()
+	var lastCheck time.Time // Start of the latest check
+
+	// nextCheck waits for the next check of monitor mode, and reports whether
+	// monitoring goes on. Ctrl+C, while waiting or during the check before,
+	// stops monitoring and finishes the run normally.
+	nextCheck := func(wait time.Duration) bool {
+		select {
+		case <-stopping:
+			fmt.Println("\n[*] MONITOR MODE STOPPED [*]")
+			return false
+		default:
+		}
+		fmt.Printf("Next check at %s, press Ctrl+C to stop monitoring\n", time.Now().Add(wait).Format("15:04:05"))
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-live:
+			timer.Stop()
+			// Live updates don't lift the site's minimum refresh interval
+			delay := liveDelay
+			if floor := time.Until(lastCheck.Add(site.MinRefresh)); floor > delay {
+				delay = floor
+			}
+			fmt.Printf("[*] Thread updated, checking it in %v\n", delay.Round(time.Second))
+			select {
+			case <-time.After(delay):
+			case <-stopping:
+				fmt.Println("\n[*] MONITOR MODE STOPPED [*]")
+				return false
+			}
+		case <-stopping:
+			timer.Stop()
+			fmt.Println("\n[*] MONITOR MODE STOPPED [*]")
+			return false
+		}
+		return true
+	}
+
+	if monitorMode {
+		atomic.StoreInt32(&stoppable, 1)
+	}
+	for { // Main loop for monitorMode
+		lastCheck = time.Now()
+		budget.Reset()
+		if threadSkipped(actualPath, board, thread) {
+			fmt.Printf("[*] /%s/%s IS IN THE SKIP LIST (%s), NOTHING TO DO [*]\n", board, thread, skipListFile)
+			break
+		}
+		// Read again at every check, like the skip list, to apply its edits
+		if list, err := loadIgnoreList(actualPath, board, thread); err != nil {
+			printError("Error reading "+ignoreFile, err)
+		} else {
+			ignores = list
+		}
+		if ignores.IgnoresThread() {
+			fmt.Printf("[*] /%s/%s IS IGNORED BY %s, NOTHING TO DO [*]\n", board, thread, ignoreFile)
+			break
+		}
+
+		var posts []Post
+		var err error
+		if snapshot != nil {
+			posts = snapshot.Posts
+		} else {
+			posts, err = fetchPosts(apiClient, site, inputUrl, board, thread)
+		}
+		if err != nil && monitorMode && transient(err) {
+			// The site is down for now, the thread may still be there at the next check
+			printError("Error fetching URL, trying again at the next check", err)
+			if !nextCheck(time.Duration(secondsIteration) * time.Second) {
+				break
+			}
+			continue
+		}
+		if err != nil && monitorMode && lastPost > 0 {
+			if fetchExitCode(err) == exitDeleted {
+				death("deleted")
+			} else {
+				notify("4cget", fmt.Sprintf("/%s/%s is gone: %v", board, thread, err))
+			}
+		}
+		if err != nil && len(leftover) == 0 {
+			failWith(fetchExitCode(err), "Error fetching URL", err)
+		}
+		if err != nil {
+			printError("Error fetching URL, finishing the files left by the previous run", err)
+			monitorMode = false
+		}
+		if pathResult == "" {
+			var opTime int64
+			if len(posts) > 0 {
+				opTime = posts[0].Time
+			}
+			pathResult = threadFolder(actualPath, board, thread, opTime)
+			os.MkdirAll(pathResult, os.ModePerm)
+		}
+		if !announced && len(posts) > 0 && (posts[0].Subject != "" || posts[0].Comment != "") {
+			announced = true
+			fmt.Printf("[*] %s [*]\n", threadTitle(threadMetadata{Thread: thread, Posts: posts}))
+			if op := strings.TrimSpace(postText(posts[0].Comment)); op != "" {
+				fmt.Printf("    %s\n", truncateText(strings.Join(strings.Fields(op), " "), 100))
+			}
+			fmt.Println()
+		}
+		if *tombstonesFlag && !tombstonesLoaded {
+			// Deletions made while 4cget wasn't running show up against the previous run
+			tombstonesLoaded = true
+			var previous threadMetadata
+			if data, err := readSidecar(filepath.Join(pathResult, "metadata.json")); err == nil && json.Unmarshal(data, &previous) == nil {
+				seenPosts, tombstones = previous.Posts, previous.Tombstones
+			}
+		}
+		if *tombstonesFlag && err == nil {
+			for _, t := range findDeletions(seenPosts, posts, time.Now()) {
+				if len(t.Files) > 0 {
+					fmt.Printf("[*] Tombstone: post %d, %s (%s)\n", t.Post, t.Reason, strings.Join(t.Files, ", "))
+				} else {
+					fmt.Printf("[*] Tombstone: post %d, %s\n", t.Post, t.Reason)
+				}
+				tombstones = append(tombstones, t)
+			}
+			seenPosts = posts
+		}
+		var batch []downloadJob
+		for _, post := range posts {
+			if *noMediaFlag || !matchesCommentFilters(post) || post.Time < since.Unix() {
+				continue
+			}
+			for _, f := range post.Files {
+				if !site.mediaAllowed(f.URL) {
+					printFile("Skipped: %s - Not on a media host of the site\n", f.URL)
+					continue
+				}
+				f.Path = placeFile(post, f)
+				dir, nameImg := filepath.Split(pathResult + "/" + f.Path)
+				job := downloadJob{File: f, FileName: nameImg, Path: filepath.Clean(dir), Post: post.No, Time: post.Time}
+				report.Track(board, thread, job)
+				if skipFile(f, dir+nameImg) {
+					continue
+				}
+				os.MkdirAll(dir, os.ModePerm)
+				batch = append(batch, job)
+			}
+		}
+
+		// Files the previous run didn't finish that aren't part of the thread anymore
+		queued := make(map[string]bool)
+		for _, job := range batch {
+			queued[job.File.URL] = true
+		}
+		for _, job := range leftover {
+			if !queued[job.File.URL] {
+				report.Track(board, thread, job)
+				os.MkdirAll(job.Path, os.ModePerm)
+				batch = append(batch, job)
+			}
+		}
+		leftover = nil
+
+		queue.Add(batch)
+		sortJobs(batch, downloadOrder)
+		for _, job := range batch {
+			stats.Queue(job.File.URL)
 			wg.Add(1)
-			go downloadFile(&wg, each, nameImg, pathResult, client)
-			files++
+			events.Queued(job)
+			jobs <- job
 
 			// Sleep between starting downloads if sleepDuration > 0
 			if sleepDuration > 0 {
@@ -350,17 +8341,189 @@ func main() {
 			}
 		}
 		wg.Wait()
+		if !monitorMode {
+			sources.Wait() // Monitor checks don't wait for SauceNAO, the lookups go on in the background
+		}
+		if monitorMode {
+			newFiles := 0
+			for _, job := range batch {
+				if lastPost > 0 && job.Post > lastPost {
+					newFiles++
+				}
+			}
+			if newFiles > 0 {
+				notify("4cget", fmt.Sprintf("%d new files in /%s/%s", newFiles, board, thread))
+			}
+			newPosts, newest := 0, lastPost
+			for _, post := range posts {
+				if post.No > lastPost {
+					newPosts++
+				}
+				if post.No > newest {
+					newest = post.No
+				}
+			}
+			lastPost, lastPosts = newest, len(posts)
+			fmt.Printf("\n[*] Check at %s: %s\n", time.Now().Format("15:04:05"), cycle.Summary(newPosts))
+		}
+		meta := threadMetadata{Site: siteID, URL: inputUrl, Board: board, Thread: thread, Archived: time.Now(), Version: version, Posts: posts, Tombstones: tombstones}
+		if *metadataFlag {
+			if err := writeMetadata(pathResult, meta); err != nil {
+				printError("Error writing metadata", err)
+			}
+		}
+		if err := writeExports(pathResult, meta, exportFormats); err != nil {
+			printError("Error exporting thread", err)
+		}
+		if !*noInfoFlag && len(posts) > 0 {
+			if err := writeThreadInfo(pathResult, meta); err != nil {
+				printError("Error writing thread info", err)
+			}
+		}
+		if *tagsFlag != "" {
+			if err := writeTags(pathResult, meta, *tagsFlag); err != nil {
+				printError("Error writing tags", err)
+			}
+		}
+		if err := feed.Save(); err != nil {
+			printError("Error writing feed", err)
+		}
+		if err := report.Save(); err != nil {
+			printError("Error writing report", err)
+		}
+		if archiveKey != nil {
+			if err := encryptFolder(pathResult); err != nil {
+				printError("Error encrypting the thread folder", err)
+			}
+		}
+		if !*noChecksumsFlag {
+			if err := writeChecksums(pathResult); err != nil {
+				printError("Error writing "+checksumsFile, err)
+			} else if signKey != "" {
+				if err := writeProvenance(pathResult, meta); err != nil {
+					printError("Error signing "+provenanceFile, err)
+				}
+			}
+		}
+		if err := archivePerms.Apply(actualPath, pathResult); err != nil {
+			printError("Error setting permissions", err)
+		}
+		if len(posts) > 0 {
+			newest := lastPost
+			for _, post := range posts {
+				if post.No > newest {
+					newest = post.No
+				}
+			}
+			state = threadState{LastPost: newest, Posts: len(posts), Checked: time.Now(), Died: state.Died}
+			if numbered {
+				state.FileNumbers = fileNumbers
+			}
+			if err := saveThreadState(actualPath, siteID, board, thread, state); err != nil {
+				printError("Error saving thread state", err)
+			}
+		}
+		if reason := budget.Exhausted(); reason != "" {
+			fmt.Printf("\n[!] RUN ABORTED: %s [!]\n", reason)
+			fmt.Println("[!] Check the connection, --proxy and the site, then run 4cget again to get the missing files.")
+			exitFlush()
+			os.Exit(exitAborted)
+		}
 		if !monitorMode {
 			break // Exit main loop
 		} else {
-			for i := secondsIteration; i >= 0; i-- {
-				fmt.Printf("Press Ctrl+C to close 4cget\n")
-				fmt.Printf("Checking for new files in %v seconds....\n", i)
-				time.Sleep(1 * time.Second)
-				print("\033[F\033[F")
+			if activity := threadActivity(posts, time.Now()); activity != "" {
+				fmt.Printf("[*] Thread activity: %s\n", activity)
+			}
+			if verboseMode {
+				fmt.Printf("[*] Resources: %s\n", resourceUsage(baseline))
+			}
+
+			var status *ThreadStatus
+			if len(posts) > 0 {
+				status = posts[0].Status
+			}
+			if status != nil && (status.Archived || status.Closed) {
+				fmt.Println("[*] Thread is archived or closed, no new files will be posted [*]")
+				if status.Archived {
+					death("archived")
+				} else {
+					death("closed")
+				}
+				break
+			}
+			var page, pages int
+			if site.ThreadsAPI != "" {
+				page, pages, _ = threadPage(apiClient, site, board, thread)
+			}
+			lifecycle, wait := threadLifecycle(status, page, pages, time.Duration(secondsIteration)*time.Second, site.MinRefresh, *adaptiveFlag)
+			if lifecycle != "" {
+				fmt.Printf("[*] Thread lifecycle: %s\n", lifecycle)
+			}
+			if !nextCheck(wait) {
+				break
+			}
+		}
+	}
+
+	atomic.StoreInt32(&stoppable, 0)
+	sources.Wait()
+	close(stopReport)
+	for _, step := range threadSteps {
+		if pathResult == "" {
+			break
+		}
+		if step.name == "exec" {
+			vars := map[string]string{"dir": pathResult, "board": board, "thread": thread, "url": inputUrl}
+			if err := runStepCommand(step.arg, pathResult, vars); err != nil {
+				printError("Error post-processing the thread: exec", err)
+				break
 			}
+			continue
+		}
+		identifier := iaIdentifier(*iaItemFlag, siteID, board, thread)
+		meta := threadMetadata{Site: siteID, URL: inputUrl, Board: board, Thread: thread}
+		if data, err := readSidecar(filepath.Join(pathResult, "metadata.json")); err == nil {
+			json.Unmarshal(data, &meta)
+		}
+		n, err := uploadToArchive(client, pathResult, identifier, *iaAccessFlag, *iaSecretFlag, meta)
+		if err != nil {
+			printError(fmt.Sprintf("Error uploading to the Internet Archive after %d files", n), err)
+			break
 		}
+		fmt.Printf("\n[*] UPLOADED %d FILES TO https://archive.org/details/%s [*]\n", n, identifier)
 	}
+	if archiveKey != nil && pathResult != "" && len(threadSteps) > 0 {
+		// What the thread steps wrote
+		if err := encryptFolder(pathResult); err != nil {
+			printError("Error encrypting the thread folder", err)
+		}
+	}
+	var missing []string
+	if *checkFlag {
+		var posts []Post
+		var err error
+		if snapshot != nil {
+			posts = snapshot.Posts
+		} else if posts, err = fetchPosts(apiClient, site, inputUrl, board, thread); err != nil {
+			fail("Error fetching URL for --check", err)
+		}
+		missing = missingFiles(site, posts, pathResult)
+	}
+	fmt.Printf("\n✓ DOWNLOAD COMPLETE, %v FILES IN %v\n", stats.Downloaded(), time.Since(start))
+	fmt.Printf("  %s\n", stats.Summary())
+	fmt.Printf("  /%s/%s: %s at %s average\n", board, thread, formatBytes(meter.Total()), formatRate(meter.Average()))
 
-	fmt.Printf("\n✓ DOWNLOAD COMPLETE, %v FILES IN %v\n", files, time.Since(start))
+	if *checkFlag {
+		if len(missing) == 0 {
+			fmt.Println("\n[*] CHECK PASSED, EVERY FILE OF THE THREAD IS ARCHIVED [*]")
+			return
+		}
+		fmt.Printf("\n[!] CHECK FAILED, %d FILES MISSING:\n", len(missing))
+		for _, m := range missing {
+			fmt.Println("  " + m)
+		}
+		exitFlush()
+		os.Exit(1)
+	}
 }
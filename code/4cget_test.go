@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExpandCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		vars    map[string]string
+		windows bool
+		want    string
+		env     []string
+	}{
+		{`echo {path}`, map[string]string{"path": "a b"}, false, `echo 'a b'`, nil},
+		{`echo {path}`, map[string]string{"path": "it's"}, false, `echo 'it'\''s'`, nil},
+		{`echo '{path}'`, map[string]string{"path": "it's"}, false, `echo 'it'\''s'`, nil},
+		{`echo "{path}"`, map[string]string{"path": "a\"$b`c\\"}, false, `echo "a\"\$b\` + "`" + `c\\"`, nil},
+		{`echo {other} {path}`, map[string]string{"path": "a"}, false, `echo {other} 'a'`, nil},
+		{`echo \" {path}`, map[string]string{"path": "a"}, false, `echo \" 'a'`, nil},
+		{`echo "it's {path}"`, map[string]string{"path": "a'b"}, false, `echo "it's a'b"`, nil},
+		{`echo {path} "{path}"`, map[string]string{"path": "a%b"}, true,
+			`echo "!FOURCGET_STEP_PATH!" "!FOURCGET_STEP_PATH!"`, []string{"FOURCGET_STEP_PATH=a%b"}},
+		{`copy {path} '{dir}'`, map[string]string{"path": "a", "dir": "b"}, true,
+			`copy "!FOURCGET_STEP_PATH!" '"!FOURCGET_STEP_DIR!"'`, []string{"FOURCGET_STEP_PATH=a", "FOURCGET_STEP_DIR=b"}},
+	}
+	for _, tt := range tests {
+		got, env := expandCommand(tt.command, tt.vars, tt.windows)
+		if got != tt.want || !reflect.DeepEqual(env, tt.env) {
+			t.Errorf("expandCommand(%q, %v, %v) = %q, %q, want %q, %q", tt.command, tt.vars, tt.windows, got, env, tt.want, tt.env)
+		}
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		value string
+		want  time.Time
+		err   bool
+	}{
+		{"2h", now.Add(-2 * time.Hour), false},
+		{"90m", now.Add(-90 * time.Minute), false},
+		{"3d", time.Date(2024, 5, 7, 12, 0, 0, 0, time.Local), false},
+		{"2024-05-01", time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local), false},
+		{"2024-05-01T08:30", time.Date(2024, 5, 1, 8, 30, 0, 0, time.Local), false},
+		{"2024-05-01T08:30:00Z", time.Date(2024, 5, 1, 8, 30, 0, 0, time.UTC), false},
+		{"d", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSince(tt.value, now)
+		if (err != nil) != tt.err || !got.Equal(tt.want) {
+			t.Errorf("parseSince(%q) = %v, %v, want %v (error: %v)", tt.value, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParseRateSchedule(t *testing.T) {
+	at := func(clock string) time.Time {
+		t, _ := time.Parse("15:04", clock)
+		return t
+	}
+	tests := []struct {
+		value string
+		at    string
+		want  int64 // Rate in force at at
+		err   bool
+	}{
+		{"500K", "12:00", 500 << 10, false},
+		{"1.5M", "12:00", 3 << 19, false},
+		{"0", "12:00", 0, false},
+		{"01:00-08:00=0,else=1M", "03:00", 0, false},
+		{"01:00-08:00=0,else=1M", "08:00", 1 << 20, false},
+		{"01:00-08:00=0, else=1M", "00:59", 1 << 20, false},
+		{"22:00-06:00=100K,else=1M", "23:30", 100 << 10, false},
+		{"22:00-06:00=100K,else=1M", "05:59", 100 << 10, false},
+		{"22:00-06:00=100K,else=1M", "06:00", 1 << 20, false},
+		{"22:00-06:00=100K", "12:00", 0, false}, // Unlimited outside the windows
+		{"fast", "", 0, true},
+		{"-1M", "", 0, true},
+		{"01:00=1M", "", 0, true},
+		{"25:00-08:00=1M", "", 0, true},
+	}
+	for _, tt := range tests {
+		l, err := parseRateSchedule(tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("parseRateSchedule(%q) error = %v, want error: %v", tt.value, err, tt.err)
+			continue
+		}
+		if err == nil {
+			if got := l.Rate(at(tt.at)); got != tt.want {
+				t.Errorf("parseRateSchedule(%q).Rate(%s) = %d, want %d", tt.value, tt.at, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestFindDeletions(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	files := func(names ...string) []*File {
+		var fs []*File
+		for _, name := range names {
+			fs = append(fs, &File{Name: name})
+		}
+		return fs
+	}
+	thread := []Post{
+		{No: 1, Files: files("a.jpg")},
+		{No: 2, Files: files("b.jpg", "c.png")},
+		{No: 3},
+		{No: 0, Files: files("scraped.jpg")},
+	}
+	tests := []struct {
+		name string
+		cur  []Post
+		want []tombstone
+	}{
+		{"unchanged", thread, nil},
+		{"post deleted", []Post{thread[1], thread[2]}, []tombstone{
+			{Post: 1, Files: []string{"a.jpg"}, Reason: "post deleted", Deleted: now},
+		}},
+		{"post without files deleted", []Post{thread[0], thread[1]}, []tombstone{
+			{Post: 3, Reason: "post deleted", Deleted: now},
+		}},
+		{"file deleted", []Post{thread[0], {No: 2, Files: files("b.jpg")}, thread[2]}, []tombstone{
+			{Post: 2, Files: []string{"c.png"}, Reason: "file deleted", Deleted: now},
+		}},
+		{"everything deleted", nil, []tombstone{
+			{Post: 1, Files: []string{"a.jpg"}, Reason: "post deleted", Deleted: now},
+			{Post: 2, Files: []string{"b.jpg", "c.png"}, Reason: "post deleted", Deleted: now},
+			{Post: 3, Reason: "post deleted", Deleted: now},
+		}},
+		{"new posts", append(thread, Post{No: 4, Files: files("d.jpg")}), nil},
+	}
+	for _, tt := range tests {
+		if got := findDeletions(thread, tt.cur, now); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: findDeletions() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	if got := findDeletions(nil, thread, now); got != nil {
+		t.Errorf("findDeletions() of a first read = %+v, want none", got)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// archiveKey is the AES-256 key of --encrypt-key, which encrypts everything
+// 4cget stores in the thread folders. Nil without it.
+var archiveKey []byte
+
+const encryptedSuffix = ".enc"
+
+// encryptedMagic starts every file encrypted by 4cget, followed by the 8 byte
+// nonce prefix of the file and its chunks.
+const encryptedMagic = "4CGETE1\n"
+
+// encryptedChunk is the size of the plaintext chunks sealed one by one with
+// AES-GCM, so files of any size can be streamed.
+const encryptedChunk = 64 << 10
+
+// loadKey reads a key file: 32 raw bytes, or 64 hex digits.
+func loadKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	return nil, fmt.Errorf("%s must hold a 256-bit key, as 32 bytes or 64 hex digits (make one with 4cget keygen)", path)
+}
+
+// chunkNonce is the GCM nonce of chunk n of a file.
+func chunkNonce(prefix []byte, n uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], n)
+	return nonce
+}
+
+// encryptStream encrypts src to dst in chunks. The last chunk, shorter than
+// the others and possibly empty, is marked as such so a truncated file fails
+// to decrypt instead of looking complete.
+func encryptStream(key []byte, dst io.Writer, src io.Reader) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	if _, err := dst.Write(append([]byte(encryptedMagic), prefix...)); err != nil {
+		return err
+	}
+	buf := make([]byte, encryptedChunk)
+	for n := uint32(0); ; n++ {
+		read, err := io.ReadFull(src, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := []byte{0}
+		if read < encryptedChunk {
+			last[0] = 1
+		}
+		if _, err := dst.Write(gcm.Seal(nil, chunkNonce(prefix, n), buf[:read], last)); err != nil {
+			return err
+		}
+		if last[0] == 1 {
+			return nil
+		}
+	}
+}
+
+// decryptStream decrypts to dst a file written by encryptStream.
+func decryptStream(key []byte, dst io.Writer, src io.Reader) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, len(encryptedMagic)+8)
+	if _, err := io.ReadFull(src, header); err != nil || string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return errors.New("not a file encrypted by 4cget")
+	}
+	prefix := header[len(encryptedMagic):]
+	buf := make([]byte, encryptedChunk+gcm.Overhead())
+	for n := uint32(0); ; n++ {
+		read, err := io.ReadFull(src, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				return errors.New("the encrypted file is truncated")
+			}
+			return err
+		}
+		last := []byte{0}
+		if read < len(buf) {
+			last[0] = 1
+		}
+		plain, err := gcm.Open(nil, chunkNonce(prefix, n), buf[:read], last)
+		if err != nil {
+			return errors.New("wrong key, or the encrypted file is damaged")
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if last[0] == 1 {
+			return nil
+		}
+	}
+}
+
+// encryptFile replaces a file with its encrypted copy, <file>.enc.
+func encryptFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path + encryptedSuffix + ".tmp")
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriterSize(out, writeBufferSize)
+	err = encryptStream(archiveKey, buf, in)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil && fsyncMode {
+		err = out.Sync()
+	}
+	if errClose := out.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(path+encryptedSuffix+".tmp", path+encryptedSuffix)
+	}
+	if err != nil {
+		os.Remove(path + encryptedSuffix + ".tmp")
+		return err
+	}
+	in.Close()
+	return os.Remove(path)
+}
+
+// encryptFolder encrypts every file of a thread folder that isn't encrypted
+// yet: the sidecars and exports written during a check, and the files
+// downloaded before --encrypt-key was used.
+func encryptFolder(dir string) error {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case info.IsDir() && path != dir && strings.HasPrefix(info.Name(), "."):
+			return filepath.SkipDir
+		case !info.Mode().IsRegular():
+		case strings.HasSuffix(path, encryptedSuffix), strings.HasSuffix(path, tierSuffix), strings.HasSuffix(path, ".tmp"):
+		case manifestFile(info.Name()): // Hashes of the encrypted files
+		default:
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	for _, path := range paths {
+		if err := encryptFile(path); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// readSidecar reads a file 4cget wrote to a thread folder, decrypting it with
+// --encrypt-key when only its encrypted copy is there.
+func readSidecar(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil || archiveKey == nil || !os.IsNotExist(err) {
+		return data, err
+	}
+	f, err := os.Open(path + encryptedSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var plain bytes.Buffer
+	if err := decryptStream(archiveKey, &plain, f); err != nil {
+		return nil, err
+	}
+	return plain.Bytes(), nil
+}
+
+// keygenCommand writes a new random key for --encrypt-key.
+func keygenCommand(args []string) {
+	if len(args) != 1 {
+		fmt.Println("[!] USAGE: 4cget keygen <keyfile>")
+		os.Exit(1)
+	}
+	if _, err := os.Stat(args[0]); err == nil {
+		fmt.Printf("[!] %s already exists, it may be the key of an archive\n", args[0])
+		os.Exit(1)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		fail("Error", err)
+	}
+	f, err := os.OpenFile(args[0], os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err == nil {
+		_, err = f.WriteString(hex.EncodeToString(key) + "\n")
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+	}
+	if err != nil {
+		fail("Error writing key", err)
+	}
+	fmt.Printf("[*] KEY WRITTEN TO %s, KEEP A COPY OF IT: WITHOUT IT THE ARCHIVE CAN'T BE DECRYPTED [*]\n", args[0])
+}
+
+// decryptCommand decrypts files encrypted with --encrypt-key next to them,
+// without the .enc extension.
+func decryptCommand(args []string) {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keyFlag := fs.String("key", "", "Key file given to --encrypt-key")
+	paths := parseArgs(fs, args)
+	if *keyFlag == "" || len(paths) == 0 {
+		fmt.Println("[!] USAGE: 4cget decrypt --key <keyfile> <file.enc>...")
+		os.Exit(1)
+	}
+	key, err := loadKey(*keyFlag)
+	if err != nil {
+		fail("Error reading key", err)
+	}
+	failed := false
+	for _, path := range paths {
+		out := strings.TrimSuffix(path, encryptedSuffix)
+		if out == path {
+			out += ".dec"
+		}
+		err := func() error {
+			in, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			w, err := os.Create(out)
+			if err != nil {
+				return err
+			}
+			buf := bufio.NewWriterSize(w, writeBufferSize)
+			err = decryptStream(key, buf, in)
+			if err == nil {
+				err = buf.Flush()
+			}
+			if errClose := w.Close(); err == nil {
+				err = errClose
+			}
+			if err != nil {
+				os.Remove(out)
+			}
+			return err
+		}()
+		if err != nil {
+			printError("Error decrypting "+path, err)
+			failed = true
+			continue
+		}
+		fmt.Println("File decrypted:", out)
+	}
+	if failed {
+		exitFlush()
+		os.Exit(1)
+	}
+}
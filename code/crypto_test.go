@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptStream(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	header := len(encryptedMagic) + 8
+	for _, size := range []int{0, 1, encryptedChunk - 1, encryptedChunk, 2*encryptedChunk + 5} {
+		plain := make([]byte, size)
+		for i := range plain {
+			plain[i] = byte(i * 31)
+		}
+		var sealed bytes.Buffer
+		if err := encryptStream(key, &sealed, bytes.NewReader(plain)); err != nil {
+			t.Fatalf("size %d: encryptStream: %v", size, err)
+		}
+		// The header, then every chunk with its 16 byte tag, ending with a
+		// short one, empty when the size is a multiple of the chunk size
+		if want := header + size + 16*(size/encryptedChunk+1); sealed.Len() != want {
+			t.Errorf("size %d: encrypted to %d bytes, want %d", size, sealed.Len(), want)
+		}
+		if !bytes.HasPrefix(sealed.Bytes(), []byte(encryptedMagic)) {
+			t.Errorf("size %d: encrypted file doesn't start with %q", size, encryptedMagic)
+		}
+		var out bytes.Buffer
+		if err := decryptStream(key, &out, bytes.NewReader(sealed.Bytes())); err != nil || !bytes.Equal(out.Bytes(), plain) {
+			t.Errorf("size %d: decryptStream = %d bytes, %v, want the %d bytes encrypted", size, out.Len(), err, size)
+		}
+	}
+}
+
+func TestDecryptStreamFailures(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	var sealed bytes.Buffer
+	if err := encryptStream(key, &sealed, bytes.NewReader(make([]byte, encryptedChunk))); err != nil {
+		t.Fatal(err)
+	}
+	data := sealed.Bytes()
+	flipped := append([]byte(nil), data...)
+	flipped[len(encryptedMagic)+8+100] ^= 1
+	tests := []struct {
+		name string
+		key  []byte
+		data []byte
+	}{
+		{"wrong key", bytes.Repeat([]byte{8}, 32), data},
+		{"damaged", key, flipped},
+		{"last chunk cut off", key, data[:len(data)-16]},
+		{"truncated in a chunk", key, data[:len(data)-100]},
+		{"not encrypted", key, []byte("plain text, long enough for a header")},
+		{"empty", key, nil},
+	}
+	for _, tt := range tests {
+		if err := decryptStream(tt.key, ioutil.Discard, bytes.NewReader(tt.data)); err == nil {
+			t.Errorf("%s: decryptStream succeeded", tt.name)
+		}
+	}
+}
+
+func TestEncryptFile(t *testing.T) {
+	defer func(key []byte) { archiveKey = key }(archiveKey)
+	archiveKey = bytes.Repeat([]byte{7}, 32)
+	path := filepath.Join(t.TempDir(), "info.json")
+	if err := ioutil.WriteFile(path, []byte(`{"thread":"1"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := encryptFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the plain file is still there after encryptFile (%v)", err)
+	}
+	if data, err := readSidecar(path); err != nil || string(data) != `{"thread":"1"}` {
+		t.Errorf("readSidecar = %q, %v, want the plain file", data, err)
+	}
+}
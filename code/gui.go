@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// guiDownload is a thread downloaded from the page of 'gui', followed through
+// the --progress-json events of its 4cget.
+type guiDownload struct {
+	URL     string    `json:"url"`
+	Started time.Time `json:"started"`
+	Running bool      `json:"running"`
+	Result  string    `json:"result,omitempty"` // Once it has finished
+	Queued  int       `json:"queued"`
+	Done    int       `json:"done"`
+	Skipped int       `json:"skipped"`
+	Failed  int       `json:"failed"`
+	Bytes   int64     `json:"bytes"`
+	Log     string    `json:"log"` // Everything else its 4cget printed
+
+	cmd     *exec.Cmd
+	stopped bool                     // From the page
+	files   map[string]progressEvent // Latest outcome by file URL, as monitor checks queue every file again
+}
+
+// count records a progress event of the download. Each file counts once,
+// by its latest outcome.
+func (d *guiDownload) count(e progressEvent) {
+	last, seen := d.files[e.URL]
+	if e.Event == "queued" {
+		if !seen {
+			d.files[e.URL] = e
+			d.Queued++
+		}
+		return
+	}
+	if e.Event != "done" && e.Event != "skipped" && e.Event != "failed" {
+		return
+	}
+	tally := func(e progressEvent, n int) {
+		switch e.Event {
+		case "done":
+			d.Done += n
+			d.Bytes += int64(n) * e.Size
+		case "skipped":
+			d.Skipped += n
+		case "failed":
+			d.Failed += n
+		}
+	}
+	tally(last, -1) // The outcome of a previous check, if any
+	tally(e, 1)
+	if !seen {
+		d.Queued++
+	}
+	d.files[e.URL] = e
+}
+
+// guiServer runs the downloads started from the page of 'gui'.
+type guiServer struct {
+	mu        sync.Mutex
+	exe       string
+	options   []string // Given to every download
+	downloads []*guiDownload
+}
+
+// exitResults describe the exit statuses of a download.
+var exitResults = map[int]string{
+	1:           "finished with errors",
+	exitDeleted: "the thread was deleted",
+	exitBlocked: "the site refuses the connection",
+	exitServer:  "the site kept failing",
+	exitAborted: "aborted, too many failed downloads",
+}
+
+// guiOptions are the options that can be given from the page of 'gui', true
+// for those taking a value. Options running commands, writing files elsewhere
+// or sending data away can only be given to 'gui' itself, since any page open
+// in the browser could fill the form.
+var guiOptions = map[string]bool{
+	"verbose": false, "monitor": true, "adaptive": false, "live": false, "notify": false, "sleep": true,
+	"limit-rate": true, "max-conns": true, "order": true, "priority": true, "workers": true, "max-downloads": true,
+	"max-failures": true, "max-failure-rate": true, "4": false, "6": false, "check": false, "skip-existing": false,
+	"overwrite": false, "update": false, "verify-md5": false, "dedupe": false, "filter-comment": true,
+	"exclude-comment": true, "since": true, "spoilers": true, "numbered": false, "group-by": true, "layout": true,
+	"metadata": false, "no-checksums": false, "no-info": false, "tombstones": false, "export": true, "xattr": false,
+	"tags": true, "save-thread": false, "no-media": false,
+}
+
+// parseGUIOptions splits the options typed in the page of 'gui', refusing any
+// option not in guiOptions.
+func parseGUIOptions(options string) ([]string, error) {
+	args := strings.Fields(options)
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if j := strings.Index(name, "="); j >= 0 {
+			name = name[:j]
+		}
+		takesValue, allowed := guiOptions[name]
+		if !strings.HasPrefix(args[i], "-") || !allowed {
+			return nil, fmt.Errorf("%s can't be given from the page, give it to 4cget gui instead", args[i])
+		}
+		if takesValue && !strings.Contains(args[i], "=") {
+			i++ // Its value, which mustn't look like another option
+			if i < len(args) && strings.HasPrefix(args[i], "-") {
+				return nil, fmt.Errorf("%s needs a value", args[i-1])
+			}
+		}
+	}
+	return args, nil
+}
+
+// Start downloads a thread with its own 4cget, unless it is being downloaded
+// already. options are added to those of the server.
+func (g *guiServer) Start(rawURL string, options []string) (*guiDownload, error) {
+	key, err := canonicalThreadURL(strings.TrimSpace(rawURL))
+	if err != nil {
+		return nil, err
+	}
+	threadURL, _ := url.Parse(key)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, d := range g.downloads {
+		if d.URL == key && d.Running {
+			return d, nil
+		}
+	}
+	logDir := filepath.Join(archiveRoot, addedLogDir)
+	os.MkdirAll(logDir, os.ModePerm)
+	logPath := filepath.Join(logDir, safeName(strings.Trim(threadURL.Host+threadURL.Path, "/"))+".log")
+	out, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	args := append(append([]string{key, "--progress-json"}, g.options...), options...)
+	cmd := exec.Command(g.exe, args...)
+	cmd.Dir, cmd.Stderr = archiveRoot, out
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+	d := &guiDownload{URL: key, Started: time.Now(), Running: true, Log: logPath, cmd: cmd, files: make(map[string]progressEvent)}
+	g.downloads = append(g.downloads, d)
+	fmt.Printf("[*] THREAD ADDED (%s) [*]\n", key)
+	go g.follow(d, stdout, out)
+	return d, nil
+}
+
+// follow counts the progress events of a download until its 4cget exits.
+func (g *guiServer) follow(d *guiDownload, stdout io.Reader, out *os.File) {
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		var e progressEvent
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		g.mu.Lock()
+		d.count(e)
+		g.mu.Unlock()
+	}
+	err := d.cmd.Wait()
+	out.Close()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	d.Running = false
+	d.Result = "finished"
+	if d.stopped {
+		d.Result = "stopped"
+	} else if exit, ok := err.(*exec.ExitError); ok && exitResults[exit.ExitCode()] != "" {
+		d.Result = exitResults[exit.ExitCode()]
+	} else if err != nil {
+		d.Result = err.Error()
+	}
+	fmt.Printf("[*] %s: %s [*]\n", d.URL, strings.ToUpper(d.Result))
+}
+
+// Stop kills the 4cget of a running download. Its unfinished files are picked
+// up by the next download of the thread.
+func (g *guiServer) Stop(rawURL string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, d := range g.downloads {
+		if d.URL == rawURL && d.Running {
+			d.stopped = true
+			d.cmd.Process.Kill()
+		}
+	}
+}
+
+// Downloads returns the state of every download, the latest first.
+func (g *guiServer) Downloads() []guiDownload {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	list := make([]guiDownload, 0, len(g.downloads))
+	for i := len(g.downloads) - 1; i >= 0; i-- {
+		list = append(list, *g.downloads[i])
+	}
+	return list
+}
+
+// openBrowser opens a URL in the default browser.
+func openBrowser(pageURL string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", pageURL)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", pageURL)
+	default:
+		cmd = exec.Command("xdg-open", pageURL)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// guiCommand serves a page on localhost to paste thread URLs and follow their
+// downloads, for those who'd rather not use a terminal, and opens it in the
+// browser. Every request must carry the random token of the page address, so
+// other sites open in the browser can't start downloads.
+func guiCommand(args []string) {
+	archiveRoot, _ = os.Getwd()
+	loadConfiguredSites(args)
+	exe, err := os.Executable()
+	if err != nil {
+		fail("Error", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fail("Error starting the GUI", err)
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		fail("Error starting the GUI", err)
+	}
+	token := hex.EncodeToString(b)
+	addr := ln.Addr().String()
+	g := &guiServer{exe: exe, options: args}
+
+	guard := func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			// The Host check stops DNS rebinding
+			if r.Host != addr || subtle.ConstantTimeCompare([]byte(r.FormValue("token")), []byte(token)) != 1 {
+				http.Error(w, "bad token", http.StatusForbidden)
+				return
+			}
+			if r.Method != http.MethodGet && r.Method != http.MethodPost {
+				http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+				return
+			}
+			handler(w, r)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", guard(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, guiPage)
+	}))
+	mux.HandleFunc("/downloads", guard(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(g.Downloads())
+	}))
+	mux.HandleFunc("/add", guard(func(w http.ResponseWriter, r *http.Request) {
+		options, err := parseGUIOptions(r.FormValue("options"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err = g.Start(r.FormValue("url"), options)
+		switch {
+		case err == errNotThread:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	mux.HandleFunc("/stop", guard(func(w http.ResponseWriter, r *http.Request) {
+		g.Stop(r.FormValue("url"))
+	}))
+
+	pageURL := fmt.Sprintf("http://%s/?token=%s", addr, token)
+	fmt.Printf("[*] 4CGET GUI AT %s [*]\n", pageURL)
+	fmt.Print("Downloads go to this folder. Keep this window open, press Ctrl+C to quit\n\n")
+	if err := openBrowser(pageURL); err != nil {
+		printError("Error opening the browser, open the address above instead", err)
+	}
+	fail("Error serving the GUI", http.Serve(ln, mux))
+}
+
+// guiPage is the page of 'gui'. It polls /downloads every second.
+const guiPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>4cget</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; padding: 0 1em; color: #222; }
+form { display: flex; gap: .5em; margin-bottom: 1.5em; }
+input { padding: .5em; font-size: 1em; }
+#url { flex: 3; }
+#options { flex: 1; }
+button { padding: .5em 1em; font-size: 1em; cursor: pointer; }
+.download { border: 1px solid #ccc; border-radius: 4px; padding: .7em 1em; margin-bottom: .7em; }
+.download a { font-weight: bold; word-break: break-all; }
+.state { color: #555; margin-top: .3em; }
+.running .state { color: #07a; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>4cget</h1>
+<form id="add">
+<input id="url" placeholder="Thread URL" required autofocus>
+<input id="options" placeholder="Options, e.g. --monitor 60">
+<button>Download</button>
+</form>
+<p id="error" class="error"></p>
+<div id="downloads"></div>
+<script>
+const token = new URLSearchParams(location.search).get("token");
+
+function post(path, params) {
+  params.token = token;
+  return fetch(path, {method: "POST", body: new URLSearchParams(params)});
+}
+
+document.getElementById("add").addEventListener("submit", async e => {
+  e.preventDefault();
+  const url = document.getElementById("url");
+  const resp = await post("/add", {url: url.value, options: document.getElementById("options").value});
+  document.getElementById("error").textContent = resp.ok ? "" : await resp.text();
+  if (resp.ok) {
+    url.value = "";
+    refresh();
+  }
+});
+
+function size(n) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i ? n.toFixed(2) : n) + " " + units[i];
+}
+
+async function refresh() {
+  const resp = await fetch("/downloads?token=" + token);
+  if (!resp.ok) {
+    return;
+  }
+  const list = document.getElementById("downloads");
+  list.textContent = "";
+  for (const d of await resp.json()) {
+    const div = document.createElement("div");
+    div.className = "download" + (d.running ? " running" : "");
+    const link = document.createElement("a");
+    link.href = d.url;
+    link.target = "_blank";
+    link.textContent = d.url;
+    div.appendChild(link);
+    const state = document.createElement("div");
+    state.className = "state";
+    state.textContent = (d.running ? "Downloading" : d.result) + ": " + d.done + " of " + d.queued +
+      " files downloaded (" + size(d.bytes) + "), " + d.skipped + " skipped, " + d.failed + " failed. Log: " + d.log;
+    div.appendChild(state);
+    if (d.running) {
+      const stop = document.createElement("button");
+      stop.textContent = "Stop";
+      stop.onclick = () => post("/stop", {url: d.url}).then(refresh);
+      div.appendChild(stop);
+    }
+    list.appendChild(div);
+  }
+}
+
+refresh();
+setInterval(refresh, 1000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseGUIOptions(t *testing.T) {
+	tests := []struct {
+		options string
+		want    string // The options split, joined by spaces
+		err     bool
+	}{
+		{"", "", false},
+		{"--dedupe", "--dedupe", false},
+		{"  --monitor 60   --dedupe ", "--monitor 60 --dedupe", false},
+		{"--monitor=60 -verbose", "--monitor=60 -verbose", false},
+		{"--since 2h --group-by poster", "--since 2h --group-by poster", false},
+		{"--monitor", "--monitor", false}, // Its default applies
+		{"--monitor --dedupe", "", true},
+		{"60", "", true},
+		{"--exec rm", "", true},
+		{"--post-process=exec", "", true},
+		{"--dedupe --root=/tmp", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseGUIOptions(tt.options)
+		if (err != nil) != tt.err || strings.Join(got, " ") != tt.want {
+			t.Errorf("parseGUIOptions(%q) = %q, %v, want %q (error: %v)", tt.options, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestGUIDownloadCount(t *testing.T) {
+	type counts struct {
+		Queued, Done, Skipped, Failed int
+		Bytes                         int64
+	}
+	event := func(name, url string, size int64) progressEvent {
+		return progressEvent{Event: name, URL: url, Size: size}
+	}
+	tests := []struct {
+		name   string
+		events []progressEvent
+		want   counts
+	}{
+		{"nothing", nil, counts{}},
+		{"queued", []progressEvent{event("queued", "a", 10), event("queued", "b", 20)}, counts{Queued: 2}},
+		{"outcomes", []progressEvent{
+			event("queued", "a", 10), event("queued", "b", 20), event("queued", "c", 30),
+			event("started", "a", 10), event("percent", "a", 10), event("done", "a", 10),
+			event("skipped", "b", 0), event("failed", "c", 0),
+		}, counts{Queued: 3, Done: 1, Skipped: 1, Failed: 1, Bytes: 10}},
+		{"checked again by monitor", []progressEvent{
+			event("queued", "a", 10), event("done", "a", 10),
+			event("queued", "a", 10), event("skipped", "a", 0),
+		}, counts{Queued: 1, Skipped: 1}},
+		{"failed then downloaded", []progressEvent{
+			event("queued", "a", 0), event("failed", "a", 0),
+			event("queued", "a", 0), event("done", "a", 5),
+		}, counts{Queued: 1, Done: 1, Bytes: 5}},
+		{"outcome without queued", []progressEvent{event("done", "a", 3)}, counts{Queued: 1, Done: 1, Bytes: 3}},
+	}
+	for _, tt := range tests {
+		d := &guiDownload{files: make(map[string]progressEvent)}
+		for _, e := range tt.events {
+			d.count(e)
+		}
+		if got := (counts{d.Queued, d.Done, d.Skipped, d.Failed, d.Bytes}); got != tt.want {
+			t.Errorf("%s: counted %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
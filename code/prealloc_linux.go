@@ -0,0 +1,24 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE: the blocks are allocated but the file
+// size is left alone, so a response shorter than announced isn't padded.
+const fallocKeepSize = 0x01
+
+// On Linux, downloads of known size reserve their disk space with fallocate.
+func init() {
+	preallocate = func(f *os.File, size int64) error {
+		err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+		if err == syscall.ENOSPC {
+			return fmt.Errorf("not enough disk space for %s: %w", formatBytes(size), err)
+		}
+		return nil // Filesystems without fallocate are written to as usual
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf16"
+)
+
+// serviceCommand registers 4cget as a background service of the current user,
+// running it with the given arguments from the current directory: a systemd
+// user unit on Linux, a launchd agent on macOS and a logon task on Windows.
+func serviceCommand(args []string) {
+	name := "4cget"
+	if len(args) >= 3 && args[1] == "--name" {
+		name = args[2]
+		args = append(args[:1:1], args[3:]...)
+	}
+	if len(args) == 0 || (args[0] == "install" && len(args) < 2) {
+		fmt.Println("[!] USAGE: 4cget service install [--name <name>] <thread URL> [options]")
+		fmt.Println("[!]        4cget service start|stop|uninstall [--name <name>]")
+		os.Exit(1)
+	}
+
+	var err error
+	switch args[0] {
+	case "install":
+		err = installService(name, args[1:])
+	case "uninstall":
+		err = uninstallService(name)
+	case "start", "stop":
+		err = controlService(name, args[0])
+	default:
+		err = fmt.Errorf("unknown action %q", args[0])
+	}
+	if err != nil {
+		fail("Error", err)
+	}
+	fmt.Printf("[*] SERVICE %s: %s [*]\n", strings.ToUpper(args[0]), name)
+}
+
+// serviceFile is where the service definition of the current platform goes.
+func serviceFile(name string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	switch runtime.GOOS {
+	case "linux":
+		return filepath.Join(home, ".config", "systemd", "user", name+".service"), nil
+	case "darwin":
+		return filepath.Join(home, "Library", "LaunchAgents", "com.github.m0ller."+name+".plist"), nil
+	}
+	return "", nil // Windows tasks live in the Task Scheduler
+}
+
+func installService(name string, args []string) error {
+	// The service definition is a plain file, or a task anyone can list
+	for _, arg := range args {
+		option := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+		for _, secret := range secretOptions {
+			if strings.HasPrefix(arg, "-") && option == secret {
+				return fmt.Errorf("--%s would be stored in the service, set it in the configuration file instead", secret)
+			}
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	path, err := serviceFile(name)
+	if err != nil {
+		return err
+	}
+
+	var unit string
+	switch runtime.GOOS {
+	case "linux":
+		quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%").Replace
+		words := []string{`"` + quote(exe) + `"`}
+		for _, arg := range args {
+			words = append(words, `"`+quote(arg)+`"`)
+		}
+		// A deleted thread or an aborted run won't do better when restarted
+		unit = fmt.Sprintf("[Unit]\nDescription=4cget %s\nAfter=network-online.target\n\n[Service]\nWorkingDirectory=%s\nExecStart=%s\nRestart=on-failure\nRestartSec=60\nRestartPreventExitStatus=%d %d\n\n[Install]\nWantedBy=default.target\n",
+			name, dir, strings.Join(words, " "), exitDeleted, exitAborted)
+	case "darwin":
+		var program strings.Builder
+		for _, arg := range append([]string{exe}, args...) {
+			program.WriteString("\t\t<string>" + html.EscapeString(arg) + "</string>\n")
+		}
+		unit = fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>com.github.m0ller.%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>WorkingDirectory</key>
+	<string>%s</string>
+	<key>RunAtLoad</key>
+	<true/>
+</dict>
+</plist>
+`, html.EscapeString(name), program.String(), html.EscapeString(dir))
+	case "windows":
+		return installTask(name, dir, exe, args)
+	default:
+		return fmt.Errorf("services aren't supported on %s", runtime.GOOS)
+	}
+
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err := ioutil.WriteFile(path, []byte(unit), 0644); err != nil {
+		return err
+	}
+	if runtime.GOOS == "darwin" {
+		return runService("launchctl", "load", "-w", path)
+	}
+	if err := runService("systemctl", "--user", "daemon-reload"); err != nil {
+		return err
+	}
+	return runService("systemctl", "--user", "enable", name)
+}
+
+// installTask registers a scheduled task of the current user starting 4cget
+// at logon. Windows services run without a logged-in user, but need a program
+// speaking to the service manager; the task runs as long as the user stays
+// logged in. It is defined in XML rather than with /TR, whose command, run by
+// cmd, is limited to 261 characters.
+func installTask(name, dir, exe string, args []string) error {
+	current, err := user.Current()
+	if err != nil {
+		return err
+	}
+	task := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-16"?>
+<Task version="1.2" xmlns="http://schemas.microsoft.com/windows/2004/02/mit/task">
+  <RegistrationInfo>
+    <Description>4cget %s</Description>
+  </RegistrationInfo>
+  <Triggers>
+    <LogonTrigger>
+      <UserId>%s</UserId>
+    </LogonTrigger>
+  </Triggers>
+  <Principals>
+    <Principal>
+      <UserId>%[2]s</UserId>
+      <LogonType>InteractiveToken</LogonType>
+      <RunLevel>LeastPrivilege</RunLevel>
+    </Principal>
+  </Principals>
+  <Settings>
+    <MultipleInstancesPolicy>IgnoreNew</MultipleInstancesPolicy>
+    <DisallowStartIfOnBatteries>false</DisallowStartIfOnBatteries>
+    <StopIfGoingOnBatteries>false</StopIfGoingOnBatteries>
+    <ExecutionTimeLimit>PT0S</ExecutionTimeLimit>
+  </Settings>
+  <Actions>
+    <Exec>
+      <Command>%s</Command>
+      <Arguments>%s</Arguments>
+      <WorkingDirectory>%s</WorkingDirectory>
+    </Exec>
+  </Actions>
+</Task>
+`, html.EscapeString(name), html.EscapeString(current.Username), html.EscapeString(exe),
+		html.EscapeString(windowsCommandLine(args)), html.EscapeString(dir))
+
+	// schtasks reads the definition as UTF-16, with its byte order mark
+	var data []byte
+	for _, c := range utf16.Encode([]rune("\ufeff" + task)) {
+		data = append(data, byte(c), byte(c>>8))
+	}
+	f, err := ioutil.TempFile("", "4cget-task-*.xml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+	return runService("schtasks", "/Create", "/TN", name, "/XML", f.Name(), "/F")
+}
+
+// windowsCommandLine joins args into a command line that programs built with
+// the C runtime, 4cget included, split back into the same arguments: quoted
+// when needed, quotes and the backslashes before them escaped with backslashes.
+func windowsCommandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && !strings.ContainsAny(arg, " \t\n\v\"") {
+			quoted[i] = arg
+			continue
+		}
+		var b strings.Builder
+		b.WriteByte('"')
+		slashes := 0
+		for j := 0; j < len(arg); j++ {
+			switch arg[j] {
+			case '\\':
+				slashes++
+				continue
+			case '"':
+				b.WriteString(strings.Repeat(`\`, 2*slashes+1))
+			default:
+				b.WriteString(strings.Repeat(`\`, slashes))
+			}
+			slashes = 0
+			b.WriteByte(arg[j])
+		}
+		// The closing quote mustn't be escaped by the backslashes before it
+		b.WriteString(strings.Repeat(`\`, 2*slashes))
+		b.WriteByte('"')
+		quoted[i] = b.String()
+	}
+	return strings.Join(quoted, " ")
+}
+
+func uninstallService(name string) error {
+	path, err := serviceFile(name)
+	if err != nil {
+		return err
+	}
+	switch runtime.GOOS {
+	case "linux":
+		runService("systemctl", "--user", "disable", "--now", name)
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		return runService("systemctl", "--user", "daemon-reload")
+	case "darwin":
+		runService("launchctl", "unload", "-w", path)
+		return os.Remove(path)
+	case "windows":
+		return runService("schtasks", "/Delete", "/TN", name, "/F")
+	}
+	return fmt.Errorf("services aren't supported on %s", runtime.GOOS)
+}
+
+func controlService(name, action string) error {
+	switch runtime.GOOS {
+	case "linux":
+		return runService("systemctl", "--user", action, name)
+	case "darwin":
+		return runService("launchctl", action, "com.github.m0ller."+name)
+	case "windows":
+		if action == "start" {
+			return runService("schtasks", "/Run", "/TN", name)
+		}
+		return runService("schtasks", "/End", "/TN", name)
+	}
+	return fmt.Errorf("services aren't supported on %s", runtime.GOOS)
+}
+
+// runService runs a service manager command, showing its output.
+func runService(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestWindowsCommandLine(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"--monitor", "60"}, `--monitor 60`},
+		{[]string{""}, `""`},
+		{[]string{"a b", "c"}, `"a b" c`},
+		{[]string{`C:\dir\`}, `C:\dir\`}, // Backslashes are only special before quotes
+		{[]string{`C:\my dir\`}, `"C:\my dir\\"`},
+		{[]string{`say "hi"`}, `"say \"hi\""`},
+		{[]string{`a\"b`}, `"a\\\"b"`},
+		{[]string{`a\\b c`}, `"a\\b c"`},
+		{[]string{"tab\there"}, "\"tab\there\""},
+	}
+	for _, tt := range tests {
+		if got := windowsCommandLine(tt.args); got != tt.want {
+			t.Errorf("windowsCommandLine(%q) = %s, want %s", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// On Windows, commands run through cmd with the command line written as is.
+// Go quotes each argument for programs parsing their command line like the C
+// runtime, escaping quotes with backslashes, which cmd doesn't understand: the
+// quotes around the placeholders of expandCommand would break.
+func init() {
+	shellCommand = func(command string) *exec.Cmd {
+		cmd := exec.Command("cmd")
+		// With /S, cmd only removes the outer quotes and runs the rest unchanged
+		cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: `cmd /V:ON /S /C "` + command + `"`}
+		return cmd
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchListInterval is how often watch reads its list again for new threads.
+const watchListInterval = time.Minute
+
+// watchedBoard returns the site and board of a watch list line naming a board,
+// such as https://boards.4chan.org/wg/ or its catalog, rather than a thread.
+func watchedBoard(line string) (SiteInfo, string, bool) {
+	u, err := url.Parse(line)
+	if err != nil || u.Host == "" {
+		return SiteInfo{}, "", false
+	}
+	site, known := siteInfoMap[siteForHost(u.Host)]
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if !known || parts[0] == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != "catalog") {
+		return SiteInfo{}, "", false
+	}
+	return site, parts[0], true
+}
+
+// watchCommand archives every thread listed in a file, one URL per line from
+// any supported site, each by its own 4cget started with the given options so
+// it follows the etiquette of its site. A line naming a board stands for every
+// live thread of its catalog, fetched again at every read of the list, except
+// those archived since their last bump. Threads
+// of the same site are started at least the site's API interval apart, and
+// the list is read again every watchListInterval for new lines. A list of "-"
+// is read from stdin instead, such as the output of 'catalog' filtered by jq,
+// until it ends and every thread is done.
+func watchCommand(args []string) {
+	if len(args) < 1 {
+		fmt.Println("[!] USAGE: 4cget watch <list> [options]")
+		os.Exit(1)
+	}
+	archiveRoot, _ = os.Getwd()
+	loadConfiguredSites(args)
+	launcher, err := newThreadLauncher("", args[1:])
+	if err != nil {
+		fail("Error", err)
+	}
+	client := newHTTPClient(netOptions{MaxConns: 2})
+	handled := make(map[string]bool)        // Lines already started, even if their 4cget has finished
+	nextStart := make(map[string]time.Time) // Per site
+	// Threads of boards are started again, to get their new posts, once their
+	// 4cget has finished: again is set for them
+	launch := func(line string, again bool) {
+		key := line // The same thread may be listed with different slugs
+		if canonical, err := canonicalThreadURL(line); err == nil {
+			key = canonical
+		}
+		if handled[key] && !again {
+			return
+		}
+		handled[key] = true
+		site := ""
+		if u, err := url.Parse(line); err == nil {
+			site = siteForHost(u.Host)
+		}
+		time.Sleep(time.Until(nextStart[site]))
+		if _, _, err := launcher.Add(line); err != nil {
+			printError("Skipping "+line, err)
+			return
+		}
+		nextStart[site] = time.Now().Add(siteInfoMap[site].APIInterval)
+	}
+	// read starts the threads of lines of the list. The catalogs of the boards
+	// are all fetched beforehand at once, within the etiquette of each site,
+	// and saved for the threads to find their page in
+	read := func(lines []string) {
+		type fetched struct {
+			threads []catalogThread
+			err     error
+		}
+		catalogs := make([]fetched, len(lines))
+		var wg sync.WaitGroup
+		for i := range lines {
+			lines[i] = strings.TrimSpace(lines[i])
+			if site, board, isBoard := watchedBoard(lines[i]); isBoard && site.CatalogAPI != "" {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					c := &catalogs[i]
+					if c.threads, c.err = fetchCatalog(client, site, board); c.err == nil {
+						if err := saveSharedCatalog(site, board, c.threads); err != nil {
+							printError("Error saving the catalog of "+lines[i], err)
+						}
+					}
+				}(i)
+			}
+		}
+		wg.Wait()
+
+		started := make(map[string]bool) // Board threads, listed by several lines
+		for i, line := range lines {
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			site, board, isBoard := watchedBoard(line)
+			switch {
+			case !isBoard:
+				launch(line, false)
+			case site.CatalogAPI == "":
+				if !handled[line] {
+					handled[line] = true
+					printError("Skipping "+line, fmt.Errorf("no catalog known for %s, list its threads instead", site.ID))
+				}
+			case catalogs[i].err != nil:
+				printError("Error fetching the catalog of "+line, catalogs[i].err)
+			default:
+				for _, t := range catalogs[i].threads {
+					// Threads fully archived since their last bump by an
+					// earlier pass cost no request at all
+					if !started[t.URL] && !launcher.Archiving(t.URL) && !t.archivedIn(loadThreadState(archiveRoot, site.ID, board, fmt.Sprint(t.Thread))) {
+						started[t.URL] = true
+						launch(t.URL, true)
+					}
+				}
+			}
+		}
+	}
+
+	if args[0] == "-" {
+		fmt.Print("[*] WATCHING THE THREADS READ FROM STDIN [*]\n\n")
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			read([]string{scanner.Text()})
+		}
+		if err := scanner.Err(); err != nil {
+			fail("Error reading watch list", err)
+		}
+		for launcher.Running() > 0 {
+			time.Sleep(time.Second)
+		}
+		fmt.Println("[*] EVERY THREAD IS DONE [*]")
+		return
+	}
+	fmt.Printf("[*] WATCHING THE THREADS LISTED IN %s [*]\n\n", args[0])
+	for {
+		data, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			fail("Error reading watch list", err)
+		}
+		read(strings.Split(string(data), "\n"))
+		time.Sleep(watchListInterval)
+	}
+}
@@ -0,0 +1,34 @@
+//go:build darwin
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// On macOS, extended attributes are set with setxattr, which the syscall
+// package only has the number of.
+func init() {
+	setXattr = func(path, name string, value []byte) error {
+		p, err := syscall.BytePtrFromString(path)
+		if err != nil {
+			return err
+		}
+		n, err := syscall.BytePtrFromString(name)
+		if err != nil {
+			return err
+		}
+		var v unsafe.Pointer
+		if len(value) > 0 {
+			v = unsafe.Pointer(&value[0])
+		}
+		// No position (only for resource forks) and no options
+		_, _, errno := syscall.Syscall6(syscall.SYS_SETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)),
+			uintptr(v), uintptr(len(value)), 0, 0)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
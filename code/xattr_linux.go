@@ -0,0 +1,12 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// On Linux, extended attributes are set with setxattr.
+func init() {
+	setXattr = func(path, name string, value []byte) error {
+		return syscall.Setxattr(path, name, value, 0)
+	}
+}